@@ -0,0 +1,234 @@
+package acl
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Capability is a single operation that a policy can grant.
+type Capability string
+
+const (
+	Read       Capability = "read"
+	Create     Capability = "create"
+	Update     Capability = "update"
+	Share      Capability = "share"
+	Delete     Capability = "delete"
+	List       Capability = "list"
+	ManageKeys Capability = "manage-keys"
+)
+
+// All is every capability known to the server.
+var All = Capabilities{Read, Create, Update, Share, Delete, List, ManageKeys}
+
+// Valid reports whether c is a known capability.
+func (c Capability) Valid() bool {
+	for _, v := range All {
+		if c == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities is a list of capabilities.  It is stored in the DB as a
+// comma separated string.
+type Capabilities []Capability
+
+// Has reports whether c is in the list.
+func (cs Capabilities) Has(c Capability) bool {
+	for _, v := range cs {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Value implements driver.Valuer
+func (cs Capabilities) Value() (driver.Value, error) {
+	s := make([]string, len(cs))
+	for i := range cs {
+		s[i] = string(cs[i])
+	}
+	return strings.Join(s, ","), nil
+}
+
+// Scan implements sql.Scanner
+func (cs *Capabilities) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+		*cs = nil
+		return nil
+	default:
+		return fmt.Errorf("Cannot scan %T into capabilities", src)
+	}
+
+	*cs = (*cs)[:0]
+	for _, c := range strings.Split(s, ",") {
+		if c != "" {
+			*cs = append(*cs, Capability(c))
+		}
+	}
+	return nil
+}
+
+// Rule grants a set of capabilities on every secret whose name matches Pattern.
+type Rule struct {
+	ID           uint         `gorm:"primary_key" json:"-"`
+	PolicyID     uint         `json:"-"`
+	Pattern      string       `sql:"not null"`
+	Capabilities Capabilities `sql:"type:text"`
+}
+
+// Policy is a named set of rules which can be attached to keys.
+type Policy struct {
+	ID        uint   `gorm:"primary_key" json:"-"`
+	Namespace string `sql:"not null;default:'default';unique_index:idx_policies_namespace_name" json:",omitempty"`
+	Name      string `sql:"not null;unique_index:idx_policies_namespace_name"`
+	Rules     []Rule
+}
+
+// KeyPolicy links a key to a policy.
+type KeyPolicy struct {
+	ID       uint `gorm:"primary_key"`
+	KeyID    uint `sql:"not null"`
+	PolicyID uint `sql:"not null"`
+}
+
+// Admin grants every capability on every secret.  It is used for the
+// master key and for keys created without the read-only flag before
+// policies existed.
+var Admin = Policy{
+	Name:  "admin",
+	Rules: []Rule{{Pattern: "*", Capabilities: All}},
+}
+
+// ReadOnly grants read access to every secret.  A key still needs the
+// secret to be shared with it before it can decrypt anything.
+var ReadOnly = Policy{
+	Name:  "read-only",
+	Rules: []Rule{{Pattern: "*", Capabilities: Capabilities{Read}}},
+}
+
+// Validate checks that a policy is well formed.
+func (p *Policy) Validate() error {
+	if p.Name == "" {
+		return errors.New("Policy name is required")
+	}
+	if len(p.Rules) == 0 {
+		return errors.New("Policy must contain at least one rule")
+	}
+	for _, r := range p.Rules {
+		if r.Pattern == "" {
+			return errors.New("Rule pattern is required")
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern: %s", r.Pattern)
+		}
+		if len(r.Capabilities) == 0 {
+			return errors.New("Rule must grant at least one capability")
+		}
+		for _, c := range r.Capabilities {
+			if !c.Valid() {
+				return fmt.Errorf("Unknown capability: %s", c)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the policy grants c on name.
+func (p *Policy) Allows(c Capability, name string) bool {
+	for _, r := range p.Rules {
+		if r.Capabilities.Has(c) && Match(r.Pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is the effective set of policies for a key.
+type Set []Policy
+
+// Allows reports whether any policy in the set grants c on name.
+func (s Set) Allows(c Capability, name string) bool {
+	for i := range s {
+		if s[i].Allows(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether s grants every capability that o grants, on
+// every name o grants it on.  Patterns are compared conservatively, so it
+// can report false for a set which does cover o, but never the reverse.
+func (s Set) Covers(o Set) bool {
+	for _, p := range o {
+		for _, r := range p.Rules {
+			for _, c := range r.Capabilities {
+				if !s.coversPattern(c, r.Pattern) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (s Set) coversPattern(c Capability, pattern string) bool {
+	for _, p := range s {
+		for _, r := range p.Rules {
+			if r.Capabilities.Has(c) && covers(r.Pattern, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers reports whether pattern p matches every name that pattern q does.
+func covers(p, q string) bool {
+	if p == q {
+		return true
+	}
+
+	// A pattern without wildcards is a single name.
+	i := strings.IndexAny(q, `*?[\`)
+	if i < 0 {
+		return Match(p, q)
+	}
+
+	// Every name q matches starts with the part of q before its first
+	// wildcard.
+	if strings.HasSuffix(p, "*") {
+		prefix := strings.TrimSuffix(p, "*")
+		if !strings.ContainsAny(prefix, `*?[\`) {
+			return strings.HasPrefix(q[:i], prefix)
+		}
+	}
+	return false
+}
+
+// Match reports whether name matches a rule pattern.  Patterns use
+// path.Match syntax, and a trailing "*" matches any suffix, so "*"
+// matches every name.
+func Match(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if !strings.ContainsAny(prefix, `*?[\`) {
+			return strings.HasPrefix(name, prefix)
+		}
+	}
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
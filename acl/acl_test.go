@@ -0,0 +1,86 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match("*", "anything"))
+	assert.True(t, Match("team-a-*", "team-a-db"))
+	assert.False(t, Match("team-a-*", "team-b-db"))
+	assert.True(t, Match("db-?", "db-1"))
+	assert.False(t, Match("db-?", "db-10"))
+	assert.True(t, Match("exact", "exact"))
+	assert.False(t, Match("exact", "exactly"))
+}
+
+func TestAllows(t *testing.T) {
+	p := Policy{
+		Name: "team-a",
+		Rules: []Rule{
+			{Pattern: "team-a-*", Capabilities: Capabilities{Read, Update}},
+			{Pattern: "shared-*", Capabilities: Capabilities{Read}},
+		},
+	}
+	assert.NoError(t, p.Validate())
+
+	assert.True(t, p.Allows(Read, "team-a-db"))
+	assert.True(t, p.Allows(Update, "team-a-db"))
+	assert.False(t, p.Allows(Delete, "team-a-db"))
+	assert.True(t, p.Allows(Read, "shared-cert"))
+	assert.False(t, p.Allows(Update, "shared-cert"))
+
+	set := Set{p, ReadOnly}
+	assert.True(t, set.Allows(Read, "team-b-db"))
+	assert.False(t, set.Allows(Update, "team-b-db"))
+
+	assert.True(t, Set{Admin}.Allows(ManageKeys, "anything"))
+}
+
+func TestCovers(t *testing.T) {
+	app := Policy{Name: "app", Rules: []Rule{{Pattern: "app-*", Capabilities: Capabilities{Read, ManageKeys}}}}
+	appDB := Policy{Name: "app-db", Rules: []Rule{{Pattern: "app-db-*", Capabilities: Capabilities{Read}}}}
+	single := Policy{Name: "single", Rules: []Rule{{Pattern: "app-db", Capabilities: Capabilities{ManageKeys}}}}
+	glob := Policy{Name: "glob", Rules: []Rule{{Pattern: "app-?", Capabilities: Capabilities{Read}}}}
+
+	assert.True(t, Set{Admin}.Covers(Set{Admin}))
+	assert.True(t, Set{Admin}.Covers(Set{app, ReadOnly}))
+	assert.False(t, Set{app}.Covers(Set{Admin}))
+	assert.False(t, Set{app}.Covers(Set{ReadOnly}))
+
+	assert.True(t, Set{app}.Covers(Set{appDB}))
+	assert.True(t, Set{app}.Covers(Set{single}))
+	assert.True(t, Set{app}.Covers(Set{glob}))
+	assert.False(t, Set{appDB}.Covers(Set{app}))
+	assert.False(t, Set{single}.Covers(Set{app}))
+
+	// Capabilities count as well as patterns
+	assert.False(t, Set{appDB}.Covers(Set{single}))
+
+	// Globs are only known to cover themselves
+	assert.True(t, Set{glob}.Covers(Set{glob}))
+	assert.False(t, Set{glob}.Covers(Set{Policy{Rules: []Rule{{Pattern: "app-*", Capabilities: Capabilities{Read}}}}}))
+}
+
+func TestValidate(t *testing.T) {
+	assert.Error(t, (&Policy{}).Validate())
+	assert.Error(t, (&Policy{Name: "x"}).Validate())
+	assert.Error(t, (&Policy{Name: "x", Rules: []Rule{{Pattern: "*"}}}).Validate())
+	assert.Error(t, (&Policy{Name: "x", Rules: []Rule{
+		{Pattern: "*", Capabilities: Capabilities{"fly"}}}}).Validate())
+	assert.Error(t, (&Policy{Name: "x", Rules: []Rule{
+		{Pattern: "[", Capabilities: Capabilities{Read}}}}).Validate())
+}
+
+func TestCapabilitiesScan(t *testing.T) {
+	cs := Capabilities{Read, ManageKeys}
+	v, err := cs.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "read,manage-keys", v)
+
+	var out Capabilities
+	assert.NoError(t, out.Scan([]byte("read,manage-keys")))
+	assert.Equal(t, cs, out)
+}
@@ -1,21 +1,30 @@
 package main // import "github.com/nutmegdevelopment/nutcracker"
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
 	"github.com/nutmegdevelopment/nutcracker/secrets"
 	"github.com/pborman/uuid"
 	"golang.org/x/crypto/curve25519"
 )
 
-const pageSize int = 10
+// pageSize is the number of rows fetched at a time when listing.  It is
+// set from Config.PageSize at startup.
+var pageSize = 10
 
 var secretIDRegex *regexp.Regexp
 var secretKeyRegex *regexp.Regexp
@@ -38,6 +47,35 @@ func Health(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Ready returns 200 if the DB is reachable and the vault has been
+// initialised, so the server can serve secrets.
+func Ready(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+
+	master := new(secrets.Secret)
+	master.Namespace = secrets.DefaultNamespace
+	master.Name = secrets.MasterKeyName
+
+	err := database.GetRootSecret(master)
+	switch err {
+
+	case gorm.ErrRecordNotFound:
+		api.error("Vault not initialised", 503)
+
+	case nil:
+		api.reply(map[string]interface{}{
+			"response": "OK",
+			"sealed":   secrets.IsSealed(),
+		}, 200)
+
+	default:
+		api.log().Error(err)
+		api.error("Cannot connect to the DB", 503)
+
+	}
+	return
+}
+
 // Initialise should be run on first use of a new vault.
 func Initialise(w http.ResponseWriter, r *http.Request) {
 
@@ -46,6 +84,7 @@ func Initialise(w http.ResponseWriter, r *http.Request) {
 
 	// Check for an existing master secret
 	master := new(secrets.Secret)
+	master.Namespace = secrets.DefaultNamespace
 	master.Name = secrets.MasterKeyName
 
 	err := database.GetRootSecret(master)
@@ -76,7 +115,7 @@ func Initialise(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info("Vault initialised")
+	api.log().Info("Vault initialised")
 
 	api.reply(secrets.Key{
 		Name: key.Name,
@@ -95,6 +134,7 @@ func Unseal(w http.ResponseWriter, r *http.Request) {
 	}
 
 	master := new(secrets.Secret)
+	master.Namespace = secrets.DefaultNamespace
 	master.Name = secrets.MasterKeyName
 
 	err := database.GetRootSecret(master)
@@ -108,7 +148,7 @@ func Unseal(w http.ResponseWriter, r *http.Request) {
 		break
 
 	default:
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
 		return
 
@@ -120,7 +160,12 @@ func Unseal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info("Vault unsealed")
+	api.log().Info("Vault unsealed")
+
+	err = persistSelfSigned()
+	if err != nil {
+		api.log().Error("Self-signed certificate not stored: ", err)
+	}
 
 	api.message("OK", 200)
 	return
@@ -136,8 +181,15 @@ func Auth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	policies := make([]string, len(api.policies))
+	for i := range api.policies {
+		policies[i] = api.policies[i].Name
+	}
+
 	api.reply(map[string]interface{}{
-		"Admin": api.admin,
+		"Admin":     api.admin,
+		"Namespace": api.namespace,
+		"Policies":  policies,
 	}, 200)
 	return
 }
@@ -147,9 +199,15 @@ func Seal(w http.ResponseWriter, r *http.Request) {
 	api := newAPI(w, r)
 	defer api.req.Body.Close()
 
+	// Sealing stops every tenant, so a namespace admin cannot do it.
+	if !api.auth() || !api.serverAdmin() {
+		api.error("Unauthorized", 401)
+		return
+	}
+
 	secrets.Seal()
 
-	log.Info("Vault sealed")
+	api.log().Info("Vault sealed")
 
 	api.message("OK", 200)
 	return
@@ -160,14 +218,14 @@ func Message(w http.ResponseWriter, r *http.Request) {
 	api := newAPI(w, r)
 	defer api.req.Body.Close()
 
-	if !api.auth() || !api.admin {
+	if !api.auth() {
 		api.error("Unauthorized", 401)
 		return
 	}
 
 	request, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
@@ -181,25 +239,37 @@ func Message(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validSecretName(request.Name) {
+		api.error("Invalid secret name", 400)
+		return
+	}
+
+	if !api.can(acl.Create, request.Name) {
+		api.error("Forbidden", 403)
+		return
+	}
+
 	s, err := secrets.New(request.Name, []byte(request.Message))
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error(err.Error(), 500)
 		return
 	}
+	s.Namespace = api.namespace
+	s.Key.Namespace = api.namespace
 
 	err = database.AddSecret(s)
 	switch {
 
 	case err == nil:
-		log.Info("New secret added: ", s.Name)
+		api.log().Info("New secret added: ", s.Name)
 		api.message("OK", 201)
 
 	case err.Error() == "Secret already exists":
 		api.error("Secret already exists", 409)
 
 	default:
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
 
 	}
@@ -207,19 +277,21 @@ func Message(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// Key adds a new secret key to the vault
+// Key adds a new secret key to the vault.
+// Creating an admin key, or attaching policies to the new key, requires
+// an admin key.
 func Key(w http.ResponseWriter, r *http.Request) {
 	api := newAPI(w, r)
 	defer api.req.Body.Close()
 
-	if !api.auth() || !api.admin {
+	if !api.auth() {
 		api.error("Unauthorized", 401)
 		return
 	}
 
 	request, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
@@ -228,19 +300,54 @@ func Key(w http.ResponseWriter, r *http.Request) {
 		request.Name = uuid.New()
 	}
 
-	if !secretIDRegex.MatchString(request.Name) {
+	if !secretIDRegex.MatchString(request.Name) || request.Name == secrets.MasterKeyName {
 		api.error("Invalid key ID", 400)
+		return
+	}
+
+	if !api.can(acl.ManageKeys, request.Name) {
+		api.error("Forbidden", 403)
+		return
+	}
+
+	if (request.Admin || len(request.Policies) > 0) && !api.admin {
+		api.error("Forbidden", 403)
+		return
+	}
+
+	policies := make([]*acl.Policy, len(request.Policies))
+	for i, name := range request.Policies {
+		policies[i] = &acl.Policy{Namespace: api.namespace, Name: name}
+
+		err = database.GetPolicy(policies[i])
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			api.error("Policy does not exist", 404)
+			return
+
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
+		}
 	}
 
 	key := new(secrets.Key)
 
 	err = key.New(request.Name)
 	if err != nil {
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Server error", 500)
 		return
 	}
 
+	key.Namespace = api.namespace
+
 	if request.Admin {
 		key.ReadOnly = false
 	} else {
@@ -249,12 +356,21 @@ func Key(w http.ResponseWriter, r *http.Request) {
 
 	err = database.AddKey(key)
 	if err != nil {
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
 		return
 	}
 
-	log.Info("New key added: ", key.Name)
+	for _, pol := range policies {
+		err = database.AttachPolicy(key, pol)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+	}
+
+	api.log().Info("New key added: ", key.Name)
 
 	api.reply(secrets.Key{
 		Name:     key.Name,
@@ -264,24 +380,25 @@ func Key(w http.ResponseWriter, r *http.Request) {
 		201)
 }
 
-// Share grants a key access to a message
+// Share grants a key, or every key in a group, access to a message.
+// If the name ends in "/", every secret under that prefix is shared.
 func Share(w http.ResponseWriter, r *http.Request) {
 	api := newAPI(w, r)
 	defer api.req.Body.Close()
 
-	if !api.auth() || !api.admin {
+	if !api.auth() {
 		api.error("Unauthorized", 401)
 		return
 	}
 
 	request, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
 
-	if len(request.KeyID) == 0 {
+	if len(request.KeyID) == 0 && len(request.Group) == 0 {
 		api.error("Missing elements in request", 400)
 		return
 	}
@@ -290,55 +407,220 @@ func Share(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := new(secrets.Key)
-	key.Name = request.KeyID
-	key.Key = request.Key
+	var names []string
+	if isPrefix(request.Name) {
+		names, err = secretNames(api, request.Name, acl.Share)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+		if len(names) == 0 {
+			api.error("Secret does not exist", 404)
+			return
+		}
+	} else {
+		if !api.can(acl.Share, request.Name) {
+			api.error("Forbidden", 403)
+			return
+		}
+		names = []string{request.Name}
+	}
 
-	err = database.GetKey(key)
-	if err != nil {
-		log.Error(err)
-		api.error("Database error", 500)
+	if secrets.IsSealed() {
+		api.error("Please unseal first", 500)
 		return
 	}
 
-	secret := new(secrets.Secret)
-	secret.Name = request.Name
+	var key *secrets.Key
+	var group *secrets.Group
 
-	err = database.GetRootSecret(secret)
-	switch err {
+	if len(request.Group) > 0 {
+		group = &secrets.Group{Namespace: api.namespace, Name: request.Group}
 
-	case gorm.ErrRecordNotFound:
-		api.error("Secret does not exist", 404)
-		return
+		err = database.GetGroup(group)
+		switch err {
 
-	case nil:
-		break
+		case gorm.ErrRecordNotFound:
+			api.error("Group does not exist", 404)
+			return
 
-	default:
-		log.Error(err)
-		api.error("Database error", 500)
-		return
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
+		}
+	} else {
+		key = new(secrets.Key)
+		key.Namespace = api.namespace
+		key.Name = request.KeyID
+		key.Key = request.Key
+
+		err = database.GetKey(key)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+	}
+
+	for _, name := range names {
+		secret := new(secrets.Secret)
+		secret.Namespace = api.namespace
+		secret.Name = name
+
+		err = database.GetRootSecret(secret)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			api.error("Secret does not exist", 404)
+			return
+
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
+		}
 
+		if group != nil {
+			err = shareWithGroup(secret, group)
+		} else {
+			err = shareSecret(secret, key, nil)
+		}
+		if err != nil {
+			api.log().Error(err)
+			api.error("Unable to share secret", 500)
+			return
+		}
+
+		if group != nil {
+			api.log().Info("Secret: ", secret.Name, " shared with group: ", group.Name)
+		} else {
+			api.log().Info("Secret: ", secret.Name, " shared with: ", key.Name)
+		}
 	}
 
-	shared, err := secret.Share(key)
-	if err != nil {
-		log.Error(err)
-		api.error(err.Error(), 500)
+	if isPrefix(request.Name) {
+		api.reply(names, 201)
+	} else {
+		api.message("OK", 201)
+	}
+	return
+}
+
+// Unshare revokes a key's access to a message, without deleting the key
+// or the message.
+// If the name ends in "/", every secret under that prefix is unshared.
+func Unshare(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() {
+		api.error("Unauthorized", 401)
 		return
 	}
 
-	err = database.AddSecret(shared)
+	request, err := api.read()
 	if err != nil {
-		log.Error(err)
-		api.error("Database error", 500)
+		api.log().Debug(err)
+		api.error("Bad request", 400)
 		return
 	}
 
-	log.Info("Secret: ", shared.Name, " shared with: ", key.Name)
+	if len(request.KeyID) == 0 {
+		api.error("Missing elements in request", 400)
+		return
+	}
+	if len(request.Name) == 0 {
+		api.error("Missing elements in request", 400)
+		return
+	}
 
-	api.message("OK", 201)
-	return
+	var names []string
+	if isPrefix(request.Name) {
+		names, err = secretNames(api, request.Name, acl.Share)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+	} else {
+		if !api.can(acl.Share, request.Name) {
+			api.error("Forbidden", 403)
+			return
+		}
+		names = []string{request.Name}
+	}
+
+	var unshared []string
+
+	for _, name := range names {
+		secret := &secrets.Secret{Namespace: api.namespace, Name: name}
+		key := &secrets.Key{Namespace: api.namespace, Name: request.KeyID}
+
+		// Shares made through a group are revoked by removing the key
+		// from the group, or the group would share the secret again.
+		shared := &secrets.Secret{Namespace: api.namespace, Name: name}
+		err = database.GetSharedSecret(shared, &secrets.Key{Namespace: api.namespace, Name: request.KeyID})
+		switch {
+
+		case err == gorm.ErrRecordNotFound:
+			continue
+
+		case err != nil:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
+		case shared.GroupID != 0 && isPrefix(request.Name):
+			continue
+
+		case shared.GroupID != 0:
+			api.error("Secret is shared through a group, remove the key from the group instead", 409)
+			return
+
+		}
+
+		err = database.DeleteSharedSecret(secret, key)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			continue
+
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
+		}
+
+		api.log().Info("Secret: ", name, " unshared from: ", key.Name, " by: ", api.keyID)
+		unshared = append(unshared, name)
+	}
+
+	switch {
+
+	case isPrefix(request.Name):
+		api.reply(unshared, 200)
+
+	case len(unshared) == 0:
+		api.error("Secret is not shared with key", 404)
+
+	default:
+		api.message("OK", 200)
+
+	}
 }
 
 // View downloads a decrypted message
@@ -353,7 +635,7 @@ func View(w http.ResponseWriter, r *http.Request) {
 
 	request, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
@@ -362,12 +644,21 @@ func View(w http.ResponseWriter, r *http.Request) {
 		request.Name = name
 	}
 
+	if !api.can(acl.Read, request.Name) {
+		api.error("Forbidden", 403)
+		return
+	}
+
 	root := new(secrets.Secret)
 	shared := new(secrets.Secret)
+	// Shares only exist within the namespace of the key they were made for.
+	root.Namespace = api.keyNamespace
 	root.Name = request.Name
+	shared.Namespace = api.keyNamespace
 	shared.Name = request.Name
 
 	key := new(secrets.Key)
+	key.Namespace = api.keyNamespace
 	key.Name = api.keyID
 
 	err = database.GetSharedSecret(shared, key)
@@ -381,7 +672,7 @@ func View(w http.ResponseWriter, r *http.Request) {
 		break
 
 	default:
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
 		return
 
@@ -398,21 +689,22 @@ func View(w http.ResponseWriter, r *http.Request) {
 		break
 
 	default:
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
 		return
 	}
 
 	message, err := root.Decrypt(shared, api.key)
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Cannot decrypt secret", 500)
 		return
 	}
 	defer secrets.Zero(message)
 
-	log.Info("Secret: ", shared.Name, " viewed by: ", key.Name)
-	viewCount++
+	api.log().Info("Secret: ", shared.Name, " viewed by: ", key.Name)
+	secretViews.WithLabelValues(shared.Namespace).Inc()
+	recordView(api, root, key)
 
 	api.rawMessage(message, 200)
 }
@@ -429,7 +721,7 @@ func List(w http.ResponseWriter, r *http.Request) {
 
 	_, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
@@ -450,6 +742,24 @@ func List(w http.ResponseWriter, r *http.Request) {
 			listKeys(api)
 		}
 
+	case "policy", "policies":
+		if !api.admin {
+			api.error("Forbidden", 403)
+			return
+		}
+		listPolicies(api)
+
+	case "group", "groups":
+		if !api.admin {
+			api.error("Forbidden", 403)
+			return
+		}
+		if _, ok := api.params["target"]; ok {
+			listGroupMembers(api)
+		} else {
+			listGroups(api)
+		}
+
 	default:
 		api.error("Invalid type to list", 500)
 
@@ -465,24 +775,46 @@ func listSecrets(api *api) {
 		*search = api.params["target"]
 	}
 
-	iter := database.ListSecrets(search)
+	iter := database.ListSecrets(api.namespace, search, api.req.FormValue("prefix"))
 
 	for {
 
-		res, err := iter(pageSize)
+		page, err := iter(pageSize)
 		if err != nil {
-			log.Error(err)
+			api.log().Error(err)
 			api.error("Database error", 500)
 			return
 		}
 
-		if len(res) == 0 {
+		if len(page) == 0 {
 			return
 		}
 
+		// Only show secrets the caller is allowed to list.
+		res := page[:0]
+		var roots []string
+		for _, s := range page {
+			if api.can(acl.List, s.Name) {
+				if s.Root {
+					roots = append(roots, s.Name)
+				}
+				res = append(res, s)
+			}
+		}
+		if len(res) == 0 {
+			continue
+		}
+
+		viewed := pageStats(api, secrets.SecretStats, roots)
+		for i := range res {
+			if res[i].Root {
+				res[i].Stats = viewed[res[i].Name]
+			}
+		}
+
 		data, err := json.MarshalIndent(&res, "", "  ")
 		if err != nil {
-			log.Error(err)
+			api.log().Error(err)
 			api.error("JSON error", 500)
 			return
 		}
@@ -501,26 +833,49 @@ func listKeys(api *api) {
 	if _, ok := api.params["target"]; ok {
 		search = new(string)
 		*search = api.params["target"]
+
+		if !api.can(acl.List, *search) {
+			api.error("Forbidden", 403)
+			return
+		}
 	}
 
-	iter := database.ListKeys(search)
+	iter := database.ListKeys(api.namespace, search)
 
 	for {
 
-		res, err := iter(pageSize)
+		page, err := iter(pageSize)
 		if err != nil {
-			log.Error(err)
+			api.log().Error(err)
 			api.error("Database error", 500)
 			return
 		}
 
-		if len(res) == 0 {
+		if len(page) == 0 {
 			return
 		}
 
+		// Listing every key is limited to the keys the caller manages.
+		res := page[:0]
+		names := make([]string, 0, len(page))
+		for _, k := range page {
+			if search != nil || api.can(acl.ManageKeys, k.Name) {
+				names = append(names, k.Name)
+				res = append(res, k)
+			}
+		}
+		if len(res) == 0 {
+			continue
+		}
+
+		viewed := pageStats(api, secrets.KeyStats, names)
+		for i := range res {
+			res[i].Stats = viewed[res[i].Name]
+		}
+
 		data, err := json.MarshalIndent(&res, "", "  ")
 		if err != nil {
-			log.Error(err)
+			api.log().Error(err)
 			api.error("JSON error", 500)
 			return
 		}
@@ -533,20 +888,71 @@ func listKeys(api *api) {
 
 }
 
+// isPrefix reports whether a secret name refers to every secret under
+// a path prefix, rather than a single secret.
+func isPrefix(name string) bool {
+	return strings.HasSuffix(name, "/")
+}
+
+// validSecretName checks that a secret name is a valid path, made up of
+// non-empty segments separated by "/".
+func validSecretName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// secretNames returns the names of every secret under prefix which the
+// caller has capability c on.
+func secretNames(api *api, prefix string, c acl.Capability) (names []string, err error) {
+	seen := make(map[string]bool)
+
+	iter := database.ListSecrets(api.namespace, nil, prefix)
+
+	for {
+		res, err := iter(pageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) == 0 {
+			break
+		}
+
+		for _, s := range res {
+			if !s.Root || seen[s.Name] || s.Name == secrets.MasterKeyName {
+				continue
+			}
+			seen[s.Name] = true
+
+			if api.can(c, s.Name) {
+				names = append(names, s.Name)
+			}
+		}
+	}
+
+	return
+}
+
 // Update changes the contents of a message but does not affect
 // which keys it is shared with
 func Update(w http.ResponseWriter, r *http.Request) {
 	api := newAPI(w, r)
 	defer api.req.Body.Close()
 
-	if !api.auth() || !api.admin {
+	if !api.auth() {
 		api.error("Unauthorized", 401)
 		return
 	}
 
 	request, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
@@ -560,7 +966,13 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !api.can(acl.Update, request.Name) {
+		api.error("Forbidden", 403)
+		return
+	}
+
 	secret := new(secrets.Secret)
+	secret.Namespace = api.namespace
 	secret.Name = request.Name
 
 	err = database.GetRootSecret(secret)
@@ -574,7 +986,7 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		break
 
 	default:
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
 		return
 
@@ -588,28 +1000,39 @@ func Update(w http.ResponseWriter, r *http.Request) {
 
 	err = database.UpdateSecret(secret)
 	if err != nil {
-		log.Error(err)
+		api.log().Error(err)
 		api.error("Database error", 500)
-	} else {
-		log.Info("Secret updated: ", secret.Name)
-		api.message("OK", 201)
+		return
 	}
+
+	api.log().Info("Secret updated: ", secret.Name)
+
+	// New handshakes should use a rotated cert as soon as the update is
+	// acknowledged.  A bad cert is logged, and the old one kept.
+	if serverCerts.watches(secret.Namespace, secret.Name) {
+		err = serverCerts.Reload()
+		if err != nil {
+			api.log().Error("TLS certificate not reloaded: ", err)
+		}
+	}
+
+	api.message("OK", 201)
 	return
 }
 
-// Delete removes a secret or key
+// Delete removes a secret, key, policy or group
 func Delete(w http.ResponseWriter, r *http.Request) {
 	api := newAPI(w, r)
 	defer api.req.Body.Close()
 
-	if !api.auth() || !api.admin {
+	if !api.auth() {
 		api.error("Unauthorized", 401)
 		return
 	}
 
 	_, err := api.read()
 	if err != nil {
-		log.Debug(err)
+		api.log().Debug(err)
 		api.error("Bad request", 400)
 		return
 	}
@@ -618,77 +1041,215 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 	switch api.params["type"] {
 
 	case "secret", "secrets":
-		s := new(secrets.Secret)
-		s.Name, ok = api.params["target"]
+		target, ok := api.params["target"]
 		if !ok {
-			log.Debug(err)
+			api.log().Debug(err)
 			api.error("Invalid secret", 400)
+			return
 		}
 
-		err = database.DeleteSecret(s)
-		if err != nil {
-			log.Error(err)
-			api.error("Database error", 500)
+		var names []string
+		if isPrefix(target) {
+			names, err = secretNames(api, target, acl.Delete)
+			if err != nil {
+				api.log().Error(err)
+				api.error("Database error", 500)
+				return
+			}
+		} else {
+			if !api.can(acl.Delete, target) {
+				api.error("Forbidden", 403)
+				return
+			}
+			names = []string{target}
+		}
+
+		for _, name := range names {
+			s := new(secrets.Secret)
+			s.Namespace = api.namespace
+			s.Name = name
+
+			err = database.DeleteSecret(s)
+			if err != nil {
+				api.log().Error(err)
+				api.error("Database error", 500)
+				return
+			}
+
+			api.log().Info("Secret deleted: ", s.Name)
+		}
+
+		if isPrefix(target) {
+			api.reply(names, 200)
+			return
 		}
 
 	case "key", "keys":
 		k := new(secrets.Key)
+		k.Namespace = api.namespace
 		k.Name, ok = api.params["target"]
 		if !ok {
-			log.Debug(err)
+			api.log().Debug(err)
 			api.error("Invalid key", 400)
+			return
+		}
+
+		if !api.can(acl.ManageKeys, k.Name) {
+			api.error("Forbidden", 403)
+			return
+		}
+
+		// A key cannot delete one with rights it does not have itself,
+		// such as an admin key.
+		target := &secrets.Key{Namespace: k.Namespace, Name: k.Name}
+		err = database.GetKey(target)
+		if err == gorm.ErrRecordNotFound {
+			api.error("Key does not exist", 404)
+			return
+		}
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+		set, err := keyPolicies(target)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+		if !api.policies.Covers(set) {
+			api.error("Forbidden", 403)
+			return
 		}
 
 		err = database.DeleteKey(k)
 		if err != nil {
-			log.Error(err)
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+
+	case "policy", "policies":
+		p := new(acl.Policy)
+		p.Namespace = api.namespace
+		p.Name, ok = api.params["target"]
+		if !ok {
+			api.error("Invalid policy", 400)
+			return
+		}
+
+		if !api.admin {
+			api.error("Forbidden", 403)
+			return
+		}
+
+		err = database.DeletePolicy(p)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			api.error("Policy does not exist", 404)
+			return
+
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
 			api.error("Database error", 500)
+			return
+
+		}
+
+	case "group", "groups":
+		g := new(secrets.Group)
+		g.Namespace = api.namespace
+		g.Name, ok = api.params["target"]
+		if !ok {
+			api.error("Invalid group", 400)
+			return
+		}
+
+		if !api.admin {
+			api.error("Forbidden", 403)
+			return
+		}
+
+		err = database.DeleteGroup(g)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			api.error("Group does not exist", 404)
+			return
+
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
 		}
 
 	default:
 		api.error("Invalid type to delete", 500)
+		return
 
 	}
 
 	api.message("OK", 200)
 }
 
-// Metrics returns basic server metrics
-func Metrics(w http.ResponseWriter, r *http.Request) {
-	api := newAPI(w, r)
-	defer api.req.Body.Close()
+type request struct {
+	Name       string
+	Key        []byte
+	KeyID      string
+	Group      string
+	Message    string
+	Admin      bool
+	Policies   []string
+	Rules      []acl.Rule
+	Passphrase secretString
+}
 
-	metrics, err := database.Metrics()
-	if err != nil {
-		log.Error(err)
-		api.error("Database error", 500)
-	}
-	metrics["views"] = viewCount
+// secretString is a JSON string read straight into bytes, which unlike a
+// string can be zeroed once used.
+type secretString []byte
 
-	if secrets.IsSealed() {
-		metrics["sealed"] = true
-	} else {
-		metrics["sealed"] = false
+func (s *secretString) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return errors.New("Expected a string")
 	}
 
-	api.reply(metrics, 200)
-}
+	raw := data[1 : len(data)-1]
+	if bytes.IndexByte(raw, '\\') < 0 {
+		*s = append(secretString{}, raw...)
+		return nil
+	}
 
-type request struct {
-	Name    string
-	Key     []byte
-	KeyID   string
-	Message string
-	Admin   bool
+	// Escapes are rare, and left to the JSON decoder, at the cost of a
+	// copy which cannot be zeroed.
+	var v string
+	err := json.Unmarshal(data, &v)
+	*s = secretString(v)
+	return err
 }
 
 type api struct {
-	req    *http.Request
-	resp   http.ResponseWriter
-	keyID  string
-	key    []byte
-	admin  bool
-	params map[string]string
+	req          *http.Request
+	resp         http.ResponseWriter
+	keyID        string
+	keyNamespace string
+	key          []byte
+	admin        bool
+	policies     acl.Set
+	namespace    string
+	params       map[string]string
+	logger       *log.Entry
 }
 
 func newAPI(w http.ResponseWriter, r *http.Request) *api {
@@ -698,6 +1259,14 @@ func newAPI(w http.ResponseWriter, r *http.Request) *api {
 	}
 }
 
+// log returns a logger which tags every line with the request ID.
+func (a *api) log() *log.Entry {
+	if a.logger == nil {
+		a.logger = log.WithField("request_id", requestID(a.req))
+	}
+	return a.logger
+}
+
 func (a *api) read() (req request, err error) {
 	a.params = mux.Vars(a.req)
 
@@ -710,6 +1279,10 @@ func (a *api) read() (req request, err error) {
 	if err != nil {
 		return
 	}
+
+	if a.event().Target == "" {
+		a.event().Target = req.Name
+	}
 	return
 }
 
@@ -738,12 +1311,60 @@ func (a *api) rawMessage(message []byte, code int) {
 	a.resp.Write(message)
 }
 
+// authFailureTime is the least time a failed authentication takes, so
+// that the response time does not show which check failed.
+var authFailureTime = 250 * time.Millisecond
+
+// dummyPublic is compared against when a key does not exist, so that
+// unknown key IDs take the same path as wrong secret keys.
+var dummyPublic = new([32]byte)
+
+func init() {
+	priv := new([32]byte)
+	if _, err := rand.Read(priv[:]); err != nil {
+		panic(err)
+	}
+	curve25519.ScalarBaseMult(dummyPublic, priv)
+	secrets.Zero(priv[:])
+}
+
+// auth checks the credentials sent with the request, and loads the
+// policies for the key.  Every failure gets the same response, and takes
+// at least authFailureTime, so that callers cannot tell which key IDs exist.
 func (a *api) auth() bool {
-	var err error
+	start := time.Now()
+
+	k, secretKey := a.credentials()
+	ip := sourceIP(a.req)
 
-	k := new(secrets.Key)
+	if d := lockedOut(ip, k); d > 0 {
+		a.resp.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+		authFailures.Inc()
+		padAuthFailure(start)
+		return false
+	}
+
+	if !a.authenticate(k, secretKey) {
+		a.log().Debug("Authentication failed for: ", k.Name, " from: ", ip)
+		authFailures.Inc()
+		a.authFailed(ip, k)
+		padAuthFailure(start)
+		return false
+	}
 
-	var secretKey string
+	authSucceeded(k)
+	return true
+}
+
+func padAuthFailure(start time.Time) {
+	if d := authFailureTime - time.Since(start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// credentials reads the key ID, secret key and namespace from the request.
+func (a *api) credentials() (k *secrets.Key, secretKey string) {
+	k = new(secrets.Key)
 
 	// Grab the credentials, look in the header first and fall back to the query string.
 	if k.Name = a.req.Header.Get("X-Secret-ID"); k.Name == "" {
@@ -752,43 +1373,123 @@ func (a *api) auth() bool {
 	if secretKey = a.req.Header.Get("X-Secret-Key"); secretKey == "" {
 		secretKey = a.req.FormValue("secretkey")
 	}
+	// Only look in the URL, as FormValue would consume a POST body sent
+	// as a form.
+	if a.namespace = a.req.Header.Get("X-Secret-Namespace"); a.namespace == "" {
+		a.namespace = queryValue(a.req, "namespace")
+	}
+	if a.namespace == "" {
+		a.namespace = secrets.DefaultNamespace
+	}
+
+	e := a.event()
+	e.KeyID = k.Name
+	e.Namespace = a.namespace
 
-	// If the master key has been used then just check the key, else check both.
+	// Keys can only be used in their own namespace, apart from the master
+	// key, which lives in the default namespace and can act in any of them.
+	k.Namespace = a.namespace
 	if k.Name == secrets.MasterKeyName {
-		if secretKeyRegex.MatchString(secretKey) != true {
-			log.Error("Invalid auth credential format.")
-			return false
-		}
-	} else if secretIDRegex.MatchString(k.Name) != true || secretKeyRegex.MatchString(secretKey) != true {
-		log.Error("Invalid auth credential format.")
-		return false
+		k.Namespace = secrets.DefaultNamespace
 	}
 
-	a.keyID = k.Name
-	a.key, err = base64.StdEncoding.DecodeString(
-		secretKey)
-	if err != nil {
-		return false
+	return
+}
+
+func (a *api) authenticate(k *secrets.Key, secretKey string) bool {
+	// Every check is made whatever the result of the ones before it.
+	ok := secretIDRegex.MatchString(a.namespace)
+	// The master key name does not have to match the ID format.
+	if k.Name != secrets.MasterKeyName {
+		ok = secretIDRegex.MatchString(k.Name) && ok
 	}
+	ok = secretKeyRegex.MatchString(secretKey) && ok
+
+	key, err := base64.StdEncoding.DecodeString(secretKey)
+	ok = err == nil && ok
 
 	priv := new([32]byte)
 	pub := new([32]byte)
 
-	copy(priv[:], a.key)
+	copy(priv[:], key)
 	defer secrets.Zero(priv[:])
 
-	err = database.GetKey(k)
+	// Badly formed credentials can never match, so skip the DB, and let
+	// the failure padding in auth hide the difference.
+	public := dummyPublic[:]
+	if ok {
+		err = database.GetKey(k)
+		if err == nil {
+			public = k.Public
+		} else {
+			ok = false
+		}
+	}
+
+	curve25519.ScalarBaseMult(pub, priv)
+	ok = subtle.ConstantTimeCompare(pub[:], public) == 1 && ok
+
+	if !ok {
+		secrets.Zero(key)
+		return false
+	}
+
+	a.keyID = k.Name
+	a.keyNamespace = k.Namespace
+	a.key = key
+
+	a.policies, err = keyPolicies(k)
 	if err != nil {
+		a.log().Error(err)
 		return false
 	}
 
-	if !k.ReadOnly {
-		a.admin = true
+	// Admin keys can manage every key, and so can grant themselves anything.
+	a.admin = a.policies.Allows(acl.ManageKeys, "*")
+
+	return true
+}
+
+// serverAdmin reports whether the authenticated key can act on the whole
+// server, rather than only its own namespace: the master key, or an admin
+// key in the default namespace.
+func (a *api) serverAdmin() bool {
+	return a.admin && a.keyNamespace == secrets.DefaultNamespace
+}
+
+// can reports whether the authenticated key has capability c on name.
+func (a *api) can(c acl.Capability, name string) bool {
+	return a.policies.Allows(c, name)
+}
+
+// keyPolicies returns the policies in effect for a key.  The master key
+// can do anything, and keys without any attached policies fall back to
+// their ReadOnly flag.
+func keyPolicies(k *secrets.Key) (set acl.Set, err error) {
+	if k.Name == secrets.MasterKeyName {
+		return acl.Set{acl.Admin}, nil
 	}
 
-	curve25519.ScalarBaseMult(pub, priv)
-	if subtle.ConstantTimeCompare(pub[:], k.Public) == 1 {
-		return true
+	iter := database.ListPolicies(k.Namespace, &k.Name)
+
+	for {
+		res, err := iter(pageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) == 0 {
+			break
+		}
+		set = append(set, res...)
 	}
-	return false
+
+	if len(set) == 0 {
+		if k.ReadOnly {
+			set = acl.Set{acl.ReadOnly}
+		} else {
+			set = acl.Set{acl.Admin}
+		}
+	}
+
+	return
 }
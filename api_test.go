@@ -2,17 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/db"
 	"github.com/nutmegdevelopment/nutcracker/db/mocks"
+	"github.com/nutmegdevelopment/nutcracker/memory"
 	"github.com/nutmegdevelopment/nutcracker/secrets"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -22,14 +34,17 @@ import (
 func init() {
 	var buf []byte
 	log.SetOutput(bytes.NewBuffer(buf))
+
+	// Keep tests of failed logins quick.
+	authFailureTime = 20 * time.Millisecond
 }
 
 func TestHealth(t *testing.T) {
 	w := httptest.NewRecorder()
 	testDb := new(mocks.DB)
 	testDb.On("Ping").Return(nil)
-	database = testDb
-	Health(w, nil)
+	defer useDatabase(testDb)()
+	Health(w, httptest.NewRequest("GET", "/health", nil))
 	res := getResp(w.Body.Bytes())
 	assert.Contains(t, res, "response", "Result should contain response")
 	assert.Equal(t, "OK", res["response"])
@@ -38,7 +53,7 @@ func TestHealth(t *testing.T) {
 func TestAuth(t *testing.T) {
 
 	a := new(api)
-	a.req = new(http.Request)
+	a.req = httptest.NewRequest("GET", "/auth", nil)
 	a.req.Header = make(http.Header)
 	a.req.Header.Set("X-Secret-ID", "968cd432-c97a-11e5-9956-625662870761")
 	a.req.Header.Set("X-Secret-Key", base64.StdEncoding.EncodeToString(authKey[:]))
@@ -47,12 +62,12 @@ func TestAuth(t *testing.T) {
 
 	authSetup(testDb, nil, nil)
 
-	database = testDb
+	defer useDatabase(testDb)()
 
 	assert.True(t, a.auth(), "Auth should succeed")
 
 	a = new(api)
-	a.req = new(http.Request)
+	a.req = httptest.NewRequest("GET", "/auth", nil)
 	a.req.Header = make(http.Header)
 	a.req.Header.Set("X-Secret-ID", "968cd432-c97a-11e5-9956-625662870761")
 	a.req.Header.Set("X-Secret-Key", base64.StdEncoding.EncodeToString([]byte("fail")))
@@ -69,13 +84,13 @@ func TestInititalise(t *testing.T) {
 
 	testDb := new(mocks.DB)
 
-	testDb.On("GetRootSecret", &secrets.Secret{Name: "master"}).Return(gorm.ErrRecordNotFound)
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "master"}).Return(gorm.ErrRecordNotFound)
 	testDb.On("AddSecret", mock.AnythingOfType("*secrets.Secret")).Return(nil)
 
-	database = testDb
+	defer useDatabase(testDb)()
 
 	w := httptest.NewRecorder()
-	Initialise(w, nil)
+	Initialise(w, httptest.NewRequest("GET", "/initialise", nil))
 
 	res := getResp(w.Body.Bytes())
 
@@ -86,12 +101,12 @@ func TestInititalise(t *testing.T) {
 
 	testDb = new(mocks.DB)
 
-	testDb.On("GetRootSecret", &secrets.Secret{Name: "master"}).Return(nil)
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "master"}).Return(nil)
 
 	database = testDb
 
 	w = httptest.NewRecorder()
-	Initialise(w, nil)
+	Initialise(w, httptest.NewRequest("GET", "/initialise", nil))
 
 	res = getResp(w.Body.Bytes())
 	assert.Equal(t, "Vault already initialised", res["error"], "Should return error")
@@ -101,20 +116,21 @@ func TestUnseal(t *testing.T) {
 
 	master, err := secrets.Initialise()
 	assert.Nil(t, err, "Should not return error")
+	secrets.Seal()
 
 	testDb := new(mocks.DB)
 
-	r := new(http.Request)
+	r := httptest.NewRequest("GET", "/unseal", nil)
 
 	authSetup(testDb, r, master.Key.Display())
 
-	testDb.On("GetRootSecret", &secrets.Secret{Name: "master"}).Run(func(args mock.Arguments) {
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "master"}).Run(func(args mock.Arguments) {
 		args.Get(0).(*secrets.Secret).Name = "master"
 		args.Get(0).(*secrets.Secret).Nonce = master.Nonce
 		args.Get(0).(*secrets.Secret).Message = master.Message
 	}).Return(nil)
 
-	database = testDb
+	defer useDatabase(testDb)()
 
 	w := httptest.NewRecorder()
 
@@ -125,9 +141,14 @@ func TestUnseal(t *testing.T) {
 	res := getResp(w.Body.Bytes())
 	assert.Contains(t, res, "response", "Result should contain response")
 	assert.Equal(t, "OK", res["response"], "Should unseal vault")
+	assert.False(t, secrets.IsSealed(), "Vault should be unsealed")
 }
 
 func TestMessage(t *testing.T) {
+	if _, err := secrets.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
 	w := httptest.NewRecorder()
 
 	req := request{Name: "test", Message: "message"}
@@ -142,7 +163,7 @@ func TestMessage(t *testing.T) {
 	authSetup(testDb, r, nil)
 
 	testDb.Mock.On("AddSecret", mock.AnythingOfType("*secrets.Secret")).Return(nil)
-	database = testDb
+	defer useDatabase(testDb)()
 
 	Message(w, r)
 
@@ -166,7 +187,7 @@ func TestKey(t *testing.T) {
 	authSetup(testDb, r, nil)
 
 	testDb.Mock.On("AddKey", mock.AnythingOfType("*secrets.Key")).Return(nil)
-	database = testDb
+	defer useDatabase(testDb)()
 
 	Key(w, r)
 	res := getResp(w.Body.Bytes())
@@ -175,6 +196,10 @@ func TestKey(t *testing.T) {
 }
 
 func TestShare(t *testing.T) {
+	if _, err := secrets.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
 	w := httptest.NewRecorder()
 
 	secret, err := secrets.New("testsecret", []byte("testmessage"))
@@ -199,7 +224,7 @@ func TestShare(t *testing.T) {
 		args.Get(0).(*secrets.Key).Public = pub[:]
 	}).Return(nil)
 
-	testDb.On("GetRootSecret", &secrets.Secret{Name: "testsecret"}).Run(func(args mock.Arguments) {
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "testsecret"}).Run(func(args mock.Arguments) {
 		args.Get(0).(*secrets.Secret).Name = secret.Name
 		args.Get(0).(*secrets.Secret).Nonce = secret.Nonce
 		args.Get(0).(*secrets.Secret).Message = secret.Message
@@ -208,7 +233,7 @@ func TestShare(t *testing.T) {
 
 	testDb.On("AddSecret", mock.AnythingOfType("*secrets.Secret")).Return(nil)
 
-	database = testDb
+	defer useDatabase(testDb)()
 
 	Share(w, r)
 
@@ -217,7 +242,57 @@ func TestShare(t *testing.T) {
 	assert.Equal(t, "OK", res["response"])
 }
 
+func TestUnshare(t *testing.T) {
+	data, err := json.Marshal(request{Name: "testsecret", KeyID: "1-2-3-4"})
+	assert.Nil(t, err, "Should not return error")
+
+	defer useDatabase(database)()
+
+	for _, test := range []struct {
+		shared  error
+		groupID uint
+		deleted error
+		code    int
+	}{
+		{nil, 0, nil, 200},
+		{nil, 0, gorm.ErrRecordNotFound, 404},
+		{gorm.ErrRecordNotFound, 0, nil, 404},
+		// Shares made through a group are left to group remove
+		{nil, 3, nil, 409},
+	} {
+		w := httptest.NewRecorder()
+
+		r, err := http.NewRequest("POST", "/secrets/unshare", bytes.NewReader(data))
+		assert.Nil(t, err, "Should not return error")
+
+		testDb := new(mocks.DB)
+		authSetup(testDb, r, nil)
+		testDb.On("GetSharedSecret",
+			&secrets.Secret{Namespace: "default", Name: "testsecret"},
+			&secrets.Key{Namespace: "default", Name: "1-2-3-4"}).Run(func(args mock.Arguments) {
+			args.Get(0).(*secrets.Secret).GroupID = test.groupID
+		}).Return(test.shared)
+		testDb.On("DeleteSharedSecret",
+			&secrets.Secret{Namespace: "default", Name: "testsecret"},
+			&secrets.Key{Namespace: "default", Name: "1-2-3-4"}).Return(test.deleted)
+		database = testDb
+
+		Unshare(w, r)
+
+		assert.Equal(t, test.code, w.Code)
+		if test.shared == nil && test.groupID == 0 {
+			testDb.AssertCalled(t, "DeleteSharedSecret", mock.Anything, mock.Anything)
+		} else {
+			testDb.AssertNotCalled(t, "DeleteSharedSecret", mock.Anything, mock.Anything)
+		}
+	}
+}
+
 func TestView(t *testing.T) {
+	if _, err := secrets.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
 	w := httptest.NewRecorder()
 
 	root, err := secrets.New("testsecret", []byte("testmessage"))
@@ -244,8 +319,8 @@ func TestView(t *testing.T) {
 
 	testDb.On(
 		"GetSharedSecret",
-		&secrets.Secret{Name: "testsecret"},
-		&secrets.Key{Name: "968cd432-c97a-11e5-9956-625662870761"}).Run(
+		&secrets.Secret{Namespace: "default", Name: "testsecret"},
+		&secrets.Key{Namespace: "default", Name: "968cd432-c97a-11e5-9956-625662870761"}).Run(
 		func(args mock.Arguments) {
 			args.Get(0).(*secrets.Secret).Name = shared.Name
 			args.Get(0).(*secrets.Secret).Nonce = shared.Nonce
@@ -262,7 +337,9 @@ func TestView(t *testing.T) {
 		args.Get(0).(*secrets.Secret).Key = root.Key
 	}).Return(nil)
 
-	database = testDb
+	testDb.On("RecordView", mock.AnythingOfType("*secrets.Secret"), mock.AnythingOfType("*secrets.Key")).Return(nil)
+
+	defer useDatabase(testDb)()
 
 	View(w, r)
 	assert.Equal(t, "testmessage", string(w.Body.Bytes()))
@@ -270,6 +347,10 @@ func TestView(t *testing.T) {
 }
 
 func TestListSecret(t *testing.T) {
+	if _, err := secrets.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
 	w := httptest.NewRecorder()
 
 	m := mux.NewRouter()
@@ -285,11 +366,10 @@ func TestListSecret(t *testing.T) {
 
 	testDb := new(mocks.DB)
 
-	r, err := http.NewRequest("GET", "/secrets/list/secrets", nil)
-	assert.Nil(t, err, "Should not return error")
+	r := httptest.NewRequest("GET", "/secrets/list/secrets", nil)
 
 	key := new(secrets.Key)
-	err = key.New("968cd432-c97a-11e5-9956-625662870761")
+	err := key.New("968cd432-c97a-11e5-9956-625662870761")
 	priv := key.Display()
 	assert.Nil(t, err, "Should not return error")
 
@@ -297,7 +377,7 @@ func TestListSecret(t *testing.T) {
 
 	pos := 0
 
-	testDb.On("ListSecrets", mock.Anything).Return(func(n int) ([]secrets.Secret, error) {
+	testDb.On("ListSecrets", mock.Anything, mock.Anything, mock.Anything).Return(func(n int) ([]secrets.Secret, error) {
 		start := pos
 		end := pos + n
 		if start >= len(secretList) {
@@ -309,8 +389,9 @@ func TestListSecret(t *testing.T) {
 		pos = end
 		return secretList[start:end], nil
 	})
+	testDb.On("ListStats", "default", "secret", mock.Anything).Return(nil, nil)
 
-	database = testDb
+	defer useDatabase(testDb)()
 
 	m.ServeHTTP(w, r)
 
@@ -325,6 +406,10 @@ func TestListSecret(t *testing.T) {
 }
 
 func TestUpdate(t *testing.T) {
+	if _, err := secrets.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
 	w := httptest.NewRecorder()
 
 	secret, err := secrets.New("testsecret", []byte("testmessage"))
@@ -341,7 +426,7 @@ func TestUpdate(t *testing.T) {
 
 	authSetup(testDb, r, nil)
 
-	testDb.On("GetRootSecret", &secrets.Secret{Name: "testsecret"}).Run(func(args mock.Arguments) {
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "testsecret"}).Run(func(args mock.Arguments) {
 		args.Get(0).(*secrets.Secret).Name = secret.Name
 		args.Get(0).(*secrets.Secret).Nonce = secret.Nonce
 		args.Get(0).(*secrets.Secret).Message = secret.Message
@@ -349,7 +434,7 @@ func TestUpdate(t *testing.T) {
 	}).Return(nil)
 
 	testDb.Mock.On("UpdateSecret", mock.AnythingOfType("*secrets.Secret")).Return(nil)
-	database = testDb
+	defer useDatabase(testDb)()
 
 	Update(w, r)
 
@@ -359,6 +444,10 @@ func TestUpdate(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
+	if _, err := secrets.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
 	w := httptest.NewRecorder()
 
 	m := mux.NewRouter()
@@ -371,30 +460,380 @@ func TestDelete(t *testing.T) {
 
 	testDb := new(mocks.DB)
 
-	r, err := http.NewRequest("DELETE", "/secrets/delete/secrets/test-secret", nil)
-	assert.Nil(t, err, "Should not return error")
+	r := httptest.NewRequest("DELETE", "/secrets/delete/secrets/test-secret", nil)
 
 	secrets.New("test-secret", []byte("test"))
 
 	authSetup(testDb, r, priv)
 
-	testDb.On("GetRootSecret", &secrets.Secret{Name: "test-secret"}).Run(func(args mock.Arguments) {
-		args.Get(0).(*secrets.Secret).Name = "test-secret"
-		args.Get(0).(*secrets.Secret).ID = 2
-	}).Return(nil)
-	testDb.On("DeleteSecret", &secrets.Secret{ID: 2, Name: "test-secret"}).Return(nil)
+	testDb.On("DeleteSecret", &secrets.Secret{Namespace: "default", Name: "test-secret"}).Return(nil)
 
-	database = testDb
+	defer useDatabase(testDb)()
 
 	m.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
 }
 
-func TestSeal(t *testing.T) {
+func TestPolicyEnforced(t *testing.T) {
+	policy := acl.Policy{
+		Name:  "team-a",
+		Rules: []acl.Rule{{Pattern: "team-a-*", Capabilities: acl.Capabilities{acl.Create}}},
+	}
+
+	defer useDatabase(database)()
+
+	for name, code := range map[string]int{"team-b-db": 403, "team-a-db": 201} {
+		w := httptest.NewRecorder()
+
+		data, err := json.Marshal(request{Name: name, Message: "message"})
+		assert.Nil(t, err, "Should not return error")
+
+		r, err := http.NewRequest("POST", "/secrets/message", bytes.NewReader(data))
+		assert.Nil(t, err, "Should not return error")
+
+		testDb := new(mocks.DB)
+		authSetup(testDb, r, nil, policy)
+		testDb.On("AddSecret", mock.AnythingOfType("*secrets.Secret")).Return(nil)
+		database = testDb
+
+		master, err := secrets.Initialise()
+		assert.Nil(t, err, "Should not return error")
+		assert.Nil(t, secrets.Unseal(master, master.Key.Display()), "Should unseal")
+
+		Message(w, r)
+		assert.Equal(t, code, w.Code, name)
+	}
+}
+
+func TestPolicy(t *testing.T) {
 	w := httptest.NewRecorder()
-	Seal(w, nil)
+
+	req := request{
+		Name:  "team-a",
+		Rules: []acl.Rule{{Pattern: "team-a-*", Capabilities: acl.Capabilities{acl.Read, acl.List}}},
+	}
+	data, err := json.Marshal(req)
+	assert.Nil(t, err, "Should not return error")
+
+	r, err := http.NewRequest("POST", "/secrets/policy", bytes.NewReader(data))
+	assert.Nil(t, err, "Should not return error")
+
+	testDb := new(mocks.DB)
+	authSetup(testDb, r, nil)
+	testDb.On("AddPolicy", mock.AnythingOfType("*acl.Policy")).Return(nil)
+	defer useDatabase(testDb)()
+
+	Policy(w, r)
+
 	res := getResp(w.Body.Bytes())
-	assert.Contains(t, res, "response", "Result should contain response")
 	assert.Equal(t, "OK", res["response"])
+	testDb.AssertCalled(t, "AddPolicy", &acl.Policy{Namespace: "default", Name: "team-a", Rules: req.Rules})
+}
+
+func TestNamespace(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	m := mux.NewRouter()
+	addRoutes(m)
+
+	r, err := http.NewRequest("GET", "/secrets/list/secrets", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	r.Header.Set("X-Secret-Namespace", "team-a")
+	r.Header.Set("X-Secret-ID", "team-a-admin")
+	r.Header.Set("X-Secret-Key", base64.StdEncoding.EncodeToString(authKey[:]))
+
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, &authKey)
+
+	testDb := new(mocks.DB)
+	testDb.On("GetKey", &secrets.Key{Namespace: "team-a", Name: "team-a-admin"}).Run(func(args mock.Arguments) {
+		args.Get(0).(*secrets.Key).Public = pub[:]
+	}).Return(nil)
+	testDb.On("ListPolicies", "team-a", mock.AnythingOfType("*string")).Return(func(n int) ([]acl.Policy, error) {
+		return nil, nil
+	})
+	testDb.On("ListSecrets", "team-a", (*string)(nil), "").Return(func(n int) ([]secrets.Secret, error) {
+		return nil, nil
+	})
+	defer useDatabase(testDb)()
+
+	m.ServeHTTP(w, r)
+
+	assert.Equal(t, 200, w.Code)
+	testDb.AssertCalled(t, "ListSecrets", "team-a", (*string)(nil), "")
+
+	// The same key name does not exist in the default namespace.
+	w = httptest.NewRecorder()
+	r.Header.Del("X-Secret-Namespace")
+	testDb.On("GetKey", &secrets.Key{Namespace: "default", Name: "team-a-admin"}).Return(gorm.ErrRecordNotFound)
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestGroupAdd(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	_, err := secrets.Initialise()
+	assert.Nil(t, err, "Should not return error")
+
+	root, err := secrets.New("testsecret", []byte("testmessage"))
+	assert.Nil(t, err, "Should not return error")
+
+	member := new(secrets.Key)
+	err = member.New("member")
+	assert.Nil(t, err, "Should not return error")
+	priv := append([]byte{}, member.Display()...)
+
+	data, err := json.Marshal(request{Name: "team-a", KeyID: "member"})
+	assert.Nil(t, err, "Should not return error")
+
+	r, err := http.NewRequest("POST", "/secrets/group/add", bytes.NewReader(data))
+	assert.Nil(t, err, "Should not return error")
+
+	testDb := new(mocks.DB)
+	authSetup(testDb, r, nil)
+
+	group := &secrets.Group{Namespace: "default", Name: "team-a"}
+	testDb.On("AddGroupMember", group, &secrets.Key{Namespace: "default", Name: "member"}).Run(func(args mock.Arguments) {
+		args.Get(0).(*secrets.Group).ID = 7
+		args.Get(1).(*secrets.Key).Public = member.Public
+	}).Return(nil)
+
+	listed := false
+	testDb.On("ListGroupSecrets", mock.AnythingOfType("*secrets.Group")).Return(func(n int) ([]secrets.Secret, error) {
+		if listed {
+			return nil, nil
+		}
+		listed = true
+		return []secrets.Secret{{Namespace: "default", Name: "testsecret"}}, nil
+	})
+
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "testsecret"}).Run(func(args mock.Arguments) {
+		*args.Get(0).(*secrets.Secret) = *root
+	}).Return(nil)
+
+	var shared *secrets.Secret
+	testDb.On("AddSecret", mock.AnythingOfType("*secrets.Secret")).Run(func(args mock.Arguments) {
+		shared = args.Get(0).(*secrets.Secret)
+	}).Return(nil)
+
+	defer useDatabase(testDb)()
+
+	GroupAdd(w, r)
+
+	assert.Equal(t, 201, w.Code)
+	if assert.NotNil(t, shared, "Secret should be shared with the new member") {
+		assert.Equal(t, uint(7), shared.GroupID, "Share should belong to the group")
+
+		message, err := root.Decrypt(shared, priv)
+		assert.Nil(t, err, "Should not return error")
+		assert.Equal(t, "testmessage", string(message))
+	}
+}
+
+func TestGroupAddFailure(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	_, err := secrets.Initialise()
+	assert.Nil(t, err, "Should not return error")
+
+	root, err := secrets.New("testsecret", []byte("testmessage"))
+	assert.Nil(t, err, "Should not return error")
+
+	member := new(secrets.Key)
+	err = member.New("member")
+	assert.Nil(t, err, "Should not return error")
+
+	data, err := json.Marshal(request{Name: "team-a", KeyID: "member"})
+	assert.Nil(t, err, "Should not return error")
+
+	r, err := http.NewRequest("POST", "/secrets/group/add", bytes.NewReader(data))
+	assert.Nil(t, err, "Should not return error")
+
+	testDb := new(mocks.DB)
+	authSetup(testDb, r, nil)
+
+	group := &secrets.Group{Namespace: "default", Name: "team-a"}
+	testDb.On("AddGroupMember", group, &secrets.Key{Namespace: "default", Name: "member"}).Run(func(args mock.Arguments) {
+		args.Get(0).(*secrets.Group).ID = 7
+		args.Get(1).(*secrets.Key).Public = member.Public
+	}).Return(nil)
+
+	listed := false
+	testDb.On("ListGroupSecrets", mock.AnythingOfType("*secrets.Group")).Return(func(n int) ([]secrets.Secret, error) {
+		if listed {
+			return nil, nil
+		}
+		listed = true
+		return []secrets.Secret{{Namespace: "default", Name: "testsecret"}}, nil
+	})
+
+	testDb.On("GetRootSecret", &secrets.Secret{Namespace: "default", Name: "testsecret"}).Run(func(args mock.Arguments) {
+		*args.Get(0).(*secrets.Secret) = *root
+	}).Return(nil)
+
+	testDb.On("AddSecret", mock.AnythingOfType("*secrets.Secret")).Return(errors.New("connection lost"))
+
+	removed := false
+	testDb.On("RemoveGroupMember", mock.AnythingOfType("*secrets.Group"), mock.AnythingOfType("*secrets.Key")).Run(func(args mock.Arguments) {
+		removed = args.Get(0).(*secrets.Group).ID == 7
+	}).Return(nil)
+
+	defer useDatabase(testDb)()
+
+	GroupAdd(w, r)
+
+	assert.Equal(t, 500, w.Code)
+	assert.True(t, removed, "The key should be taken out of the group again")
+}
+
+func TestDeletePrefix(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	m := mux.NewRouter()
+	addRoutes(m)
+
+	r, err := http.NewRequest("DELETE", "/secrets/delete/secrets/team/app/", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+
+	testDb := new(mocks.DB)
+	authSetup(testDb, r, nil)
+
+	listed := false
+	testDb.On("ListSecrets", "default", (*string)(nil), "team/app/").Return(func(n int) ([]secrets.Secret, error) {
+		if listed {
+			return nil, nil
+		}
+		listed = true
+		return []secrets.Secret{
+			{Name: "team/app/db", Root: true},
+			{Name: "team/app/db", Root: false},
+			{Name: "team/app/db", Root: true},
+			{Name: "team/app/api", Root: true},
+		}, nil
+	})
+	testDb.On("DeleteSecret", mock.AnythingOfType("*secrets.Secret")).Return(nil)
+
+	defer useDatabase(testDb)()
+
+	m.ServeHTTP(w, r)
+
+	assert.Equal(t, 200, w.Code)
+	testDb.AssertNumberOfCalls(t, "DeleteSecret", 2)
+	testDb.AssertCalled(t, "DeleteSecret", &secrets.Secret{Namespace: "default", Name: "team/app/db"})
+	testDb.AssertCalled(t, "DeleteSecret", &secrets.Secret{Namespace: "default", Name: "team/app/api"})
+}
+
+func TestValidSecretName(t *testing.T) {
+	assert.True(t, validSecretName("db-password"))
+	assert.True(t, validSecretName("team/app/prod/db-password"))
+	assert.False(t, validSecretName(""))
+	assert.False(t, validSecretName("/team/app"))
+	assert.False(t, validSecretName("team/app/"))
+	assert.False(t, validSecretName("team//app"))
+	assert.False(t, validSecretName("team/../app"))
+}
+
+func TestSecretString(t *testing.T) {
+	var req request
+	assert.Nil(t, json.Unmarshal([]byte(`{"Passphrase": "correct horse"}`), &req))
+	assert.Equal(t, []byte("correct horse"), []byte(req.Passphrase))
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"Passphrase": "say \"hi\" \u00e9"}`), &req))
+	assert.Equal(t, []byte("say \"hi\" é"), []byte(req.Passphrase))
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"Passphrase": null}`), &req))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"Passphrase": 12}`), &req))
+}
+
+func TestSeal(t *testing.T) {
+	defer useDatabase(new(memory.DB))()
+	assert.Nil(t, database.Connect())
+	defer database.Close()
+	keyLockout.Reset()
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, initDev(out), "Should not return error")
+	creds := regexp.MustCompile(`X-Secret-ID: (\S+)\n\s+X-Secret-Key: (\S+)`).FindAllStringSubmatch(out.String(), -1)
+	if !assert.Len(t, creds, 2, "Should print two keys") {
+		return
+	}
+
+	reader := new(secrets.Key)
+	assert.Nil(t, reader.New("reader"))
+	reader.ReadOnly = true
+	assert.Nil(t, database.AddKey(reader))
+
+	tenant := new(secrets.Key)
+	assert.Nil(t, tenant.New("tenant-admin"))
+	tenant.Namespace = "team-a"
+	assert.Nil(t, database.AddKey(tenant))
+
+	seal := func(id, key string, namespace ...string) int {
+		r := httptest.NewRequest("GET", "/seal", nil)
+		if id != "" {
+			r.Header.Set("X-Secret-ID", id)
+			r.Header.Set("X-Secret-Key", key)
+		}
+		if len(namespace) > 0 {
+			r.Header.Set("X-Secret-Namespace", namespace[0])
+		}
+		w := httptest.NewRecorder()
+		Seal(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, 401, seal("", ""), "Requests without credentials cannot seal")
+	assert.Equal(t, 401, seal("reader", base64.StdEncoding.EncodeToString(reader.Display())), "Read only keys cannot seal")
+	assert.Equal(t, 401, seal("tenant-admin", base64.StdEncoding.EncodeToString(tenant.Display()), "team-a"),
+		"Namespace admins cannot seal the whole server")
+	assert.False(t, secrets.IsSealed(), "Vault should still be unsealed")
+
+	assert.Equal(t, 200, seal(creds[1][1], creds[1][2]), "Admin keys can seal")
+	assert.True(t, secrets.IsSealed(), "Vault should be sealed")
+}
+
+func TestDeleteKey(t *testing.T) {
+	defer useDatabase(new(memory.DB))()
+	assert.Nil(t, database.Connect())
+	defer database.Close()
+
+	m := mux.NewRouter()
+	addRoutes(m)
+
+	addKey := func(name string, rules ...acl.Rule) *secrets.Key {
+		k := new(secrets.Key)
+		assert.Nil(t, k.New(name))
+		assert.Nil(t, database.AddKey(k))
+		if len(rules) > 0 {
+			assert.Nil(t, database.AddPolicy(&acl.Policy{Name: name, Rules: rules}))
+			assert.Nil(t, database.AttachPolicy(&secrets.Key{Name: name}, &acl.Policy{Name: name}))
+		}
+		return k
+	}
+
+	deployer := addKey("app-deployer", acl.Rule{Pattern: "app-*", Capabilities: acl.Capabilities{acl.Read, acl.ManageKeys}})
+	addKey("app-admin")
+	addKey("app-reader", acl.Rule{Pattern: "app-*", Capabilities: acl.Capabilities{acl.Read}})
+	addKey("app-writer", acl.Rule{Pattern: "app-*", Capabilities: acl.Capabilities{acl.Update}})
+
+	remove := func(name string) int {
+		r := httptest.NewRequest("DELETE", "/secrets/delete/key/"+name, nil)
+		r.Header.Set("X-Secret-ID", "app-deployer")
+		r.Header.Set("X-Secret-Key", base64.StdEncoding.EncodeToString(deployer.Display()))
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, 403, remove("app-admin"), "Admin keys have more rights")
+	assert.Equal(t, 403, remove("app-writer"), "The key can update secrets")
+	assert.Equal(t, 404, remove("app-missing"))
+	assert.Equal(t, 200, remove("app-reader"))
+
+	assert.Nil(t, database.GetKey(&secrets.Key{Name: "app-admin"}))
+	assert.Equal(t, gorm.ErrRecordNotFound, database.GetKey(&secrets.Key{Name: "app-reader"}))
 }
 
 func getResp(data []byte) map[string]string {
@@ -405,7 +844,421 @@ func getResp(data []byte) map[string]string {
 
 var authKey = [32]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
 
-func authSetup(testDb *mocks.DB, req *http.Request, key []byte) {
+func TestAudited(t *testing.T) {
+	m := mux.NewRouter()
+	addRoutes(m)
+
+	testDb := new(mocks.DB)
+	testDb.On("GetLastAuditEvent", mock.AnythingOfType("*audit.Event")).Return(nil)
+	var events []audit.Event
+	testDb.On("AddAuditEvent", mock.AnythingOfType("*audit.Event")).Run(func(args mock.Arguments) {
+		events = append(events, *args.Get(0).(*audit.Event))
+	}).Return(nil)
+	defer useDatabase(testDb)()
+
+	var err error
+	auditLog, err = audit.New(audit.DBSink{Store: testDb})
+	assert.Nil(t, err, "Should not return error")
+	defer func() { auditLog = nil }()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/auth", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	authSetup(testDb, r, nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	// Wrong key
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/secrets/list/key/app/db", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	authSetup(testDb, r, []byte("wrong"))
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	// No credentials
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/secrets/list/secrets", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "968cd432-c97a-11e5-9956-625662870761", events[0].KeyID)
+		assert.Equal(t, "auth", events[0].Operation)
+		assert.Equal(t, audit.Success, events[0].Result)
+		assert.Equal(t, "req-1", events[0].RequestID)
+		assert.Equal(t, "10.0.0.1", events[0].SourceIP)
+
+		assert.Equal(t, "list-keys", events[1].Operation)
+		assert.Equal(t, "app/db", events[1].Target)
+		assert.Equal(t, audit.Denied, events[1].Result)
+		assert.Equal(t, 401, events[1].Status)
+
+		assert.Nil(t, audit.Verify(events, ""))
+	}
+}
+
+func TestAudit(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	r, err := http.NewRequest("GET", "/secrets/audit?secret=db/password&operation=view&limit=2", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+
+	testDb := new(mocks.DB)
+	authSetup(testDb, r, nil)
+	testDb.On("ListAuditEvents", &audit.Query{
+		Namespace: "default",
+		Target:    "db/password",
+		Operation: "view",
+	}).Return(func(n int) ([]audit.Event, error) {
+		assert.Equal(t, 2, n)
+		return []audit.Event{{KeyID: "app", Operation: "view", Target: "db/password"}}, nil
+	})
+	defer useDatabase(testDb)()
+
+	Audit(w, r)
+
+	assert.Equal(t, 200, w.Code)
+	var res []audit.Event
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(t, res, 1)
+	testDb.AssertExpectations(t)
+
+	// Only admins can read the audit log
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/secrets/audit", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	testDb = new(mocks.DB)
+	authSetup(testDb, r, nil, acl.ReadOnly)
+	database = testDb
+
+	Audit(w, r)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestVerifyAudit(t *testing.T) {
+	d := new(memory.DB)
+	assert.Nil(t, d.Connect())
+
+	l, err := audit.New(audit.DBSink{Store: d})
+	assert.Nil(t, err)
+	for _, op := range []string{"message", "share", "view"} {
+		l.Log(&audit.Event{KeyID: "master", Operation: op, Target: "app/db", Result: audit.Success, Status: 200})
+	}
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, verifyAudit(d, out))
+	assert.Equal(t, "Audit chain intact: 3 events.\n", out.String())
+
+	// An event which does not follow on from the last one is reported
+	forged := &audit.Event{
+		Time:      time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC),
+		KeyID:     "app",
+		Operation: "delete-secrets",
+		PrevHash:  "forged",
+	}
+	forged.Hash = forged.Sum()
+	assert.Nil(t, d.AddAuditEvent(forged))
+
+	assert.EqualError(t, verifyAudit(d, out),
+		"Audit chain broken before event "+forged.Hash+": event 4, delete-secrets by app at 2016-03-01T12:00:00Z")
+}
+
+func TestAuditQuery(t *testing.T) {
+	now := time.Date(2016, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	r, err := http.NewRequest("GET", "/secrets/audit?key=app&since=30d&until=2016-03-31T00:00:00Z&offset=20", nil)
+	assert.Nil(t, err, "Should not return error")
+
+	q, limit, err := auditQuery(r, now)
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, pageSize, limit)
+	assert.Equal(t, "app", q.KeyID)
+	assert.Equal(t, 20, q.Offset)
+	assert.Equal(t, time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC), q.Since)
+	assert.Equal(t, time.Date(2016, 3, 31, 0, 0, 0, 0, time.UTC), q.Until)
+
+	for _, bad := range []string{"since=yesterday", "until=-1h", "limit=0", "limit=5000", "offset=-1"} {
+		r, err = http.NewRequest("GET", "/secrets/audit?"+bad, nil)
+		assert.Nil(t, err, "Should not return error")
+		_, _, err = auditQuery(r, now)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := mux.NewRouter()
+	addRoutes(m)
+	h := instrument(m)
+
+	testDb := new(mocks.DB)
+	testDb.On("Metrics").Return(map[string]interface{}{"secrets": 3}, nil)
+	defer useDatabase(testDb)()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/auth", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	r.Header.Set("X-Secret-ID", "968cd432-c97a-11e5-9956-625662870761")
+	r.Header.Set("X-Secret-Key", "not base64!")
+
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	// Metrics are only served on the monitoring listener
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/metrics", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 404, w.Code)
+
+	monitor := mux.NewRouter()
+	addMonitoringRoutes(monitor)
+
+	w = httptest.NewRecorder()
+	monitor.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	body := w.Body.String()
+	assert.Contains(t, body, `nutcracker_http_requests_total{code="401",method="GET",route="/auth"}`)
+	assert.Contains(t, body, `nutcracker_auth_failures_total`)
+	assert.Contains(t, body, `nutcracker_db_objects{type="secrets"} 3`)
+	assert.Contains(t, body, `nutcracker_sealed`)
+	assert.Contains(t, body, `nutcracker_uptime_seconds`)
+}
+
+func TestReady(t *testing.T) {
+	master := &secrets.Secret{Namespace: "default", Name: "master"}
+
+	defer useDatabase(database)()
+
+	for err, code := range map[error]int{
+		nil:                    200,
+		gorm.ErrRecordNotFound: 503,
+		errors.New("DB down"):  503,
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/ready", bytes.NewReader(nil))
+
+		testDb := new(mocks.DB)
+		testDb.On("GetRootSecret", master).Return(err)
+		database = testDb
+
+		Ready(w, r)
+		assert.Equal(t, code, w.Code)
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := mux.NewRouter()
+	addRoutes(m)
+
+	recent := time.Now().Add(-time.Hour)
+
+	testDb := new(mocks.DB)
+	testDb.On("ListSecrets", "default", (*string)(nil), "").Return(func(string, *string, string) func(int) ([]secrets.Secret, error) {
+		served := false
+		return func(n int) ([]secrets.Secret, error) {
+			if served {
+				return nil, nil
+			}
+			served = true
+			return []secrets.Secret{
+				{Namespace: "default", Name: "used", Root: true},
+				{Namespace: "default", Name: "used", Root: true},
+				{Namespace: "default", Name: "used", Root: false},
+				{Namespace: "default", Name: "unused", Root: true},
+			}, nil
+		}
+	})
+	testDb.On("ListStats", "default", "secret", []string{"used", "unused"}).Return([]secrets.Stats{
+		{Namespace: "default", Type: "secret", Name: "used", Views: 3, LastViewed: &recent, LastPeer: "app"},
+	}, nil)
+	testDb.On("GetStats", &secrets.Stats{Namespace: "default", Type: "secret", Name: "used"}).Run(func(args mock.Arguments) {
+		args.Get(0).(*secrets.Stats).Views = 3
+		args.Get(0).(*secrets.Stats).LastViewed = &recent
+		args.Get(0).(*secrets.Stats).LastPeer = "app"
+	}).Return(nil)
+	defer useDatabase(testDb)()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/secrets/stats/secrets", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	authSetup(testDb, r, nil)
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	var res []secrets.Stats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	if assert.Len(t, res, 2) {
+		assert.Equal(t, "used", res[0].Name)
+		assert.Equal(t, int64(3), res[0].Views)
+		assert.Equal(t, "app", res[0].LastPeer)
+		assert.Equal(t, "unused", res[1].Name)
+		assert.Equal(t, int64(0), res[1].Views)
+	}
+
+	// Only secrets not viewed in the last day
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/secrets/stats/secrets?unused=1d", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	authSetup(testDb, r, nil)
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	res = nil
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	if assert.Len(t, res, 1) {
+		assert.Equal(t, "unused", res[0].Name)
+	}
+
+	testDb.AssertNotCalled(t, "GetStats", mock.Anything)
+
+	// A single secret
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/secrets/stats/secret/used", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	authSetup(testDb, r, nil)
+
+	m.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	var st secrets.Stats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &st))
+	assert.Equal(t, int64(3), st.Views)
+}
+
+func TestLockout(t *testing.T) {
+	testDb := new(mocks.DB)
+	authSetup(testDb, nil, nil)
+	defer useDatabase(testDb)()
+
+	defer ipLockout.Reset()
+	defer keyLockout.Reset()
+
+	send := func(key []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/auth", bytes.NewReader(nil))
+		assert.Nil(t, err, "Should not return error")
+		r.RemoteAddr = "10.0.0.2:1234"
+		r.Header.Set("X-Secret-ID", "968cd432-c97a-11e5-9956-625662870761")
+		r.Header.Set("X-Secret-Key", base64.StdEncoding.EncodeToString(key))
+		Auth(w, r)
+		return w
+	}
+
+	assert.Equal(t, 200, send(authKey[:]).Code)
+
+	wrong := make([]byte, 32)
+	for i := 0; i < keyLockout.Threshold; i++ {
+		w := send(wrong)
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, "", w.Header().Get("Retry-After"))
+	}
+
+	// The right key is now locked out too
+	w := send(authKey[:])
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	keyLockout.Reset()
+	assert.Equal(t, 200, send(authKey[:]).Code)
+}
+
+func TestAuthUniform(t *testing.T) {
+	defer ipLockout.Reset()
+
+	testDb := new(mocks.DB)
+	testDb.On("GetKey", &secrets.Key{Namespace: "default", Name: "missing"}).Return(gorm.ErrRecordNotFound)
+	authSetup(testDb, nil, nil)
+	defer useDatabase(testDb)()
+
+	wrong := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	for _, creds := range [][2]string{
+		{"missing", wrong},
+		{"968cd432-c97a-11e5-9956-625662870761", wrong},
+		{"bad name!", wrong},
+		{"968cd432-c97a-11e5-9956-625662870761", "not base64!"},
+		{"", ""},
+	} {
+		keyLockout.Reset()
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/auth", bytes.NewReader(nil))
+		assert.Nil(t, err, "Should not return error")
+		r.Header.Set("X-Secret-ID", creds[0])
+		r.Header.Set("X-Secret-Key", creds[1])
+
+		start := time.Now()
+		Auth(w, r)
+
+		assert.True(t, time.Since(start) >= authFailureTime, creds[0])
+		assert.Equal(t, 401, w.Code, creds[0])
+		assert.Equal(t, "{\n  \"error\": \"Unauthorized\"\n}", w.Body.String(), creds[0])
+	}
+
+	testDb.AssertCalled(t, "GetKey", &secrets.Key{Namespace: "default", Name: "missing"})
+}
+
+func TestAccessLog(t *testing.T) {
+	m := mux.NewRouter()
+	addRoutes(m)
+	h := withRequestID(instrument(m))
+
+	var buf bytes.Buffer
+	accessLog.Out = &buf
+	defer func() { accessLog.Out = os.Stdout }()
+
+	testDb := new(mocks.DB)
+	defer useDatabase(testDb)()
+
+	// Credentials in the URL must not be logged
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/secrets/view/db/password?secretid=app&secretkey=c2VjcmV0", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	r.Header.Set("X-Request-ID", "abc-123")
+	testDb.On("GetKey", &secrets.Key{Namespace: "default", Name: "app"}).Return(gorm.ErrRecordNotFound)
+
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "abc-123", entry["request_id"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/secrets/view/{messageName:.+}", entry["route"])
+	assert.Equal(t, float64(401), entry["status"])
+	assert.Equal(t, "app", entry["key_id"])
+	assert.NotContains(t, buf.String(), "c2VjcmV0")
+	assert.NotContains(t, buf.String(), "password")
+
+	// Badly formed IDs are replaced
+	buf.Reset()
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("GET", "/secrets/list/secrets", bytes.NewReader(nil))
+	assert.Nil(t, err, "Should not return error")
+	r.Header.Set("X-Request-ID", "bad id\n")
+
+	h.ServeHTTP(w, r)
+	id := w.Header().Get("X-Request-ID")
+	assert.NotEqual(t, "", id)
+	assert.NotEqual(t, "bad id\n", id)
+	assert.Contains(t, buf.String(), id)
+}
+
+func authSetup(testDb *mocks.DB, req *http.Request, key []byte, policies ...acl.Policy) {
+	// Failed logins in earlier tests must not lock out this one.
+	keyLockout.Reset()
 
 	priv := new([32]byte)
 	if key == nil {
@@ -423,8 +1276,120 @@ func authSetup(testDb *mocks.DB, req *http.Request, key []byte) {
 	pub := new([32]byte)
 	curve25519.ScalarBaseMult(pub, priv)
 
-	testDb.On("GetKey", &secrets.Key{Name: "968cd432-c97a-11e5-9956-625662870761"}).Run(func(args mock.Arguments) {
+	testDb.On("GetKey", &secrets.Key{Namespace: "default", Name: "968cd432-c97a-11e5-9956-625662870761"}).Run(func(args mock.Arguments) {
 		args.Get(0).(*secrets.Key).Name = "968cd432-c97a-11e5-9956-625662870761"
 		args.Get(0).(*secrets.Key).Public = pub[:]
 	}).Return(nil)
+
+	testDb.On("ListPolicies", mock.AnythingOfType("string"), mock.AnythingOfType("*string")).Return(func(n int) ([]acl.Policy, error) {
+		res := policies
+		policies = nil
+		return res, nil
+	})
+}
+
+// useDatabase swaps in d for the length of a test.  The returned func puts
+// the old database back and seals the vault, so no test relies on the state
+// left by the ones before it.  Tests which need the vault unsealed call
+// secrets.Initialise themselves.
+func useDatabase(d db.DB) func() {
+	old := database
+	database = d
+	keyLockout.Reset()
+	return func() {
+		secrets.Seal()
+		database = old
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	testDb := new(mocks.DB)
+	testDb.On("Close").Return(nil)
+	defer useDatabase(testDb)()
+
+	master, err := secrets.Initialise()
+	assert.Nil(t, err, "Should not return error")
+	assert.Nil(t, secrets.Unseal(master, master.Key.Display()), "Should unseal")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: r}
+	go server.Serve(l)
+
+	resp := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		resp <- string(body)
+	}()
+	<-started
+
+	cert, err := GenCert()
+	assert.Nil(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- shutdown(time.Second, &cert, server)
+	}()
+
+	// The in-flight request holds up shutdown
+	select {
+	case <-done:
+		t.Fatal("Shutdown should wait for in-flight requests")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, "done", <-resp)
+	assert.Nil(t, <-done)
+
+	assert.True(t, secrets.IsSealed(), "Vault should be sealed")
+	assert.Equal(t, 0, cert.PrivateKey.(*ecdsa.PrivateKey).D.Sign(), "TLS key should be wiped")
+	testDb.AssertCalled(t, "Close")
+
+	_, err = http.Get("http://" + l.Addr().String() + "/slow")
+	assert.NotNil(t, err, "New connections should be refused")
+
+	// Requests which do not finish in time are abandoned
+	testDb = new(mocks.DB)
+	testDb.On("Close").Return(nil)
+	database = testDb
+
+	master, err = secrets.Initialise()
+	assert.Nil(t, err, "Should not return error")
+	assert.Nil(t, secrets.Unseal(master, master.Key.Display()), "Should unseal")
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started = make(chan struct{})
+	release = make(chan struct{})
+	defer close(release)
+
+	server = &http.Server{Handler: r}
+	go server.Serve(l)
+	go http.Get("http://" + l.Addr().String() + "/slow")
+	<-started
+
+	assert.Equal(t, context.DeadlineExceeded, shutdown(20*time.Millisecond, nil, server))
+	assert.True(t, secrets.IsSealed(), "Vault should be sealed")
+	testDb.AssertCalled(t, "Close")
 }
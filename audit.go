@@ -0,0 +1,277 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/db"
+)
+
+type contextKey int
+
+const auditEventKey contextKey = iota
+
+var auditLog *audit.Log
+
+// openAuditLog sets up the configured audit sinks.
+func openAuditLog(c AuditConfig) (err error) {
+	var sinks []audit.Sink
+
+	if c.DB {
+		sinks = append(sinks, audit.DBSink{Store: database})
+	}
+
+	if c.File != "" {
+		s, err := audit.NewFileSink(c.File)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, s)
+	}
+
+	if c.Syslog {
+		s, err := audit.NewSyslogSink("nutcracker")
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, s)
+	}
+
+	auditLog, err = audit.New(sinks...)
+	return
+}
+
+// statusWriter records the status code sent by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Plural forms of the types accepted by List and Delete, so that audit
+// events for the same operation always have the same name.
+var auditTypes = map[string]string{
+	"secret": "secrets",
+	"key":    "keys",
+	"policy": "policies",
+	"group":  "groups",
+}
+
+// audited wraps a handler so that every request which presents
+// credentials is recorded in the audit log as operation op.  Routes with
+// a type, such as /secrets/list/{type}, are recorded as op-type.
+func audited(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		operation := op
+		if t, ok := vars["type"]; ok {
+			if plural, ok := auditTypes[t]; ok {
+				t = plural
+			}
+			operation += "-" + t
+		}
+
+		// Requests with a JSON body fill in the target when it is read.
+		target := vars["messageName"]
+		if target == "" {
+			target = vars["target"]
+		}
+
+		e := &audit.Event{
+			Operation: operation,
+			Target:    target,
+			RequestID: requestID(r),
+			SourceIP:  sourceIP(r),
+		}
+		context.Set(r, auditEventKey, e)
+		// The router may pass on a copy of the request, which the
+		// ClearHandler around it would not clear.
+		defer context.Clear(r)
+
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		h(sw, r)
+
+		// Requests without credentials are never authenticated, and are
+		// not audited.
+		if e.KeyID == "" {
+			return
+		}
+
+		e.Status = sw.status
+		e.Result = audit.ResultFor(sw.status)
+		auditLog.Log(e)
+	}
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// event returns the audit event for the current request.  Handlers called
+// without the audit wrapper get a throwaway event.
+func (a *api) event() *audit.Event {
+	if e, ok := context.Get(a.req, auditEventKey).(*audit.Event); ok {
+		return e
+	}
+	return new(audit.Event)
+}
+
+// maxAuditPage is the largest number of events returned by one request.
+const maxAuditPage = 1000
+
+// Audit returns audit events, filtered by the key, secret, operation,
+// since and until parameters, oldest first.  Use limit and offset to page
+// through the results.
+func Audit(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() || !api.admin {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	q, limit, err := auditQuery(r, time.Now())
+	if err != nil {
+		api.error(err.Error(), 400)
+		return
+	}
+	q.Namespace = api.namespace
+
+	res, err := database.ListAuditEvents(q)(limit)
+	if err != nil {
+		api.log().Error(err)
+		api.error("Database error", 500)
+		return
+	}
+	if res == nil {
+		res = []audit.Event{}
+	}
+
+	api.reply(res, 200)
+}
+
+// auditQuery reads the audit query parameters from a request.
+func auditQuery(r *http.Request, now time.Time) (q *audit.Query, limit int, err error) {
+	q = &audit.Query{
+		KeyID:     r.FormValue("key"),
+		Target:    r.FormValue("secret"),
+		Operation: r.FormValue("operation"),
+	}
+
+	if q.Since, err = parseTime(r.FormValue("since"), now); err != nil {
+		return
+	}
+	if q.Until, err = parseTime(r.FormValue("until"), now); err != nil {
+		return
+	}
+
+	limit = pageSize
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPage {
+			return nil, 0, fmt.Errorf("Limit must be between 1 and %d", maxAuditPage)
+		}
+	}
+	if v := r.FormValue("offset"); v != "" {
+		q.Offset, err = strconv.Atoi(v)
+		if err != nil || q.Offset < 0 {
+			return nil, 0, errors.New("Invalid offset")
+		}
+	}
+
+	return q, limit, nil
+}
+
+// parseTime parses an RFC 3339 time, or a duration before now such as
+// "12h" or "30d".
+func parseTime(v string, now time.Time) (t time.Time, err error) {
+	if v == "" {
+		return
+	}
+
+	if t, err = time.Parse(time.RFC3339, v); err == nil {
+		return
+	}
+
+	var d time.Duration
+	if strings.HasSuffix(v, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(v, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(v)
+	}
+	if err != nil || d < 0 {
+		return t, fmt.Errorf("Invalid time: %s", v)
+	}
+
+	return now.Add(-d), nil
+}
+
+// auditCommand runs the audit subcommand in args.  verify checks the chain
+// of audit events in the configured database.
+func auditCommand(args []string) error {
+	if len(args) != 1 || args[0] != "verify" {
+		return errors.New("Usage: nutcracker audit verify")
+	}
+
+	d, err := connectConfigured()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return verifyAudit(d, os.Stdout)
+}
+
+// verifyAudit walks every audit event in d, oldest first, and reports the
+// first one which does not chain onto the event before it.
+func verifyAudit(d db.DB, out io.Writer) error {
+	next := d.ListAuditEvents(new(audit.Query))
+	prev := ""
+	count := 0
+
+	for {
+		events, err := next(pageSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for i := range events {
+			err = audit.Verify(events[i:i+1], prev)
+			if err != nil {
+				e := &events[i]
+				return fmt.Errorf("%s: event %d, %s by %s at %s",
+					err, count+1, e.Operation, e.KeyID, e.Time.Format(time.RFC3339))
+			}
+			prev = events[i].Hash
+			count++
+		}
+	}
+
+	fmt.Fprintf(out, "Audit chain intact: %d events.\n", count)
+	return nil
+}
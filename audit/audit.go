@@ -0,0 +1,168 @@
+// Package audit records a tamper-evident trail of requests made to the vault.
+//
+// Every event is chained to the one before it by a SHA-256 hash, so
+// removing, reordering or editing an entry breaks the chain from that
+// point onwards.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Results recorded against an event.
+const (
+	Success = "success"
+	Denied  = "denied"
+	Failure = "failure"
+)
+
+// Event is a single audited request.
+type Event struct {
+	ID        uint      `gorm:"primary_key" json:"-"`
+	Time      time.Time `sql:"not null"`
+	RequestID string    `json:",omitempty"`
+	Namespace string    `json:",omitempty"`
+	KeyID     string    `sql:"not null"`
+	Operation string    `sql:"not null"`
+	Target    string    `json:",omitempty"`
+	Result    string    `sql:"not null"`
+	Status    int
+	SourceIP  string
+	PrevHash  string `sql:"not null"`
+	Hash      string `sql:"not null;unique_index"`
+}
+
+// Sum returns the hash of the event, which covers every field apart from
+// the ID and the hash itself, chained to PrevHash.
+func (e *Event) Sum() string {
+	data, _ := json.Marshal([]interface{}{
+		e.PrevHash,
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.RequestID,
+		e.Namespace,
+		e.KeyID,
+		e.Operation,
+		e.Target,
+		e.Result,
+		e.Status,
+		e.SourceIP,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ResultFor maps an HTTP status code to an event result.
+func ResultFor(status int) string {
+	switch {
+	case status < 400:
+		return Success
+	case status == 401 || status == 403:
+		return Denied
+	default:
+		return Failure
+	}
+}
+
+// Sink stores audit events.
+type Sink interface {
+	Write(*Event) error
+}
+
+// Resumer is implemented by sinks that can return the last event they
+// stored, so that the chain carries on across restarts.
+type Resumer interface {
+	Last() (*Event, error)
+}
+
+// Log hashes events and writes them to every sink.
+type Log struct {
+	mu    sync.Mutex
+	sinks []Sink
+	last  string
+}
+
+// New returns a log writing to sinks.  The chain carries on from the last
+// event stored by the first sink that implements Resumer.
+func New(sinks ...Sink) (l *Log, err error) {
+	l = &Log{sinks: sinks}
+
+	for _, s := range sinks {
+		r, ok := s.(Resumer)
+		if !ok {
+			continue
+		}
+		e, err := r.Last()
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			l.last = e.Hash
+		}
+		break
+	}
+
+	return l, nil
+}
+
+// Log chains e to the previous event and writes it to every sink.
+// Sink errors are logged, as the request has already been served.
+func (l *Log) Log(e *Event) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// Databases may not keep nanoseconds or the timezone, so store
+	// something that survives a round trip unchanged.
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+
+	e.PrevHash = l.last
+	e.Hash = e.Sum()
+	l.last = e.Hash
+
+	for _, s := range l.sinks {
+		if err := s.Write(e); err != nil {
+			log.Error("Unable to write audit event: ", err)
+		}
+	}
+}
+
+// Verify checks that events form an unbroken chain starting after prev.
+// Pass an empty prev to check a chain from the first event.
+func Verify(events []Event, prev string) error {
+	for i := range events {
+		e := &events[i]
+		if e.PrevHash != prev {
+			return fmt.Errorf("Audit chain broken before event %s", e.Hash)
+		}
+		if e.Sum() != e.Hash {
+			return fmt.Errorf("Audit event %s has been modified", e.Hash)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// Query selects audit events.  Empty fields match every event.
+type Query struct {
+	Namespace string
+	KeyID     string
+	Target    string
+	Operation string
+	Since     time.Time
+	Until     time.Time
+	// Offset skips that many matching events, for paging.
+	Offset int
+}
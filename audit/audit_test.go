@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memSink struct {
+	events []Event
+}
+
+func (m *memSink) Write(e *Event) error {
+	m.events = append(m.events, *e)
+	return nil
+}
+
+func (m *memSink) Last() (*Event, error) {
+	if len(m.events) == 0 {
+		return nil, nil
+	}
+	return &m.events[len(m.events)-1], nil
+}
+
+func TestChain(t *testing.T) {
+	sink := new(memSink)
+	l, err := New(sink)
+	assert.Nil(t, err)
+
+	l.Log(&Event{KeyID: "a", Operation: "view", Target: "db/password", Result: Success, Status: 200})
+	l.Log(&Event{KeyID: "b", Operation: "view", Target: "db/password", Result: Denied, Status: 403})
+	l.Log(&Event{KeyID: "a", Operation: "delete-secrets", Target: "db/password", Result: Success, Status: 200})
+
+	assert.Len(t, sink.events, 3)
+	assert.Equal(t, "", sink.events[0].PrevHash)
+	assert.Equal(t, sink.events[0].Hash, sink.events[1].PrevHash)
+	assert.Nil(t, Verify(sink.events, ""))
+
+	// Modified event
+	events := append([]Event(nil), sink.events...)
+	events[1].KeyID = "a"
+	assert.NotNil(t, Verify(events, ""))
+
+	// Deleted event
+	events = []Event{sink.events[0], sink.events[2]}
+	assert.NotNil(t, Verify(events, ""))
+
+	// Carries on from the last stored event
+	l, err = New(sink)
+	assert.Nil(t, err)
+	l.Log(&Event{KeyID: "a", Operation: "auth", Result: Success, Status: 200})
+	assert.Nil(t, Verify(sink.events, ""))
+	assert.Nil(t, Verify(sink.events[3:], sink.events[2].Hash))
+}
+
+func TestResultFor(t *testing.T) {
+	assert.Equal(t, Success, ResultFor(201))
+	assert.Equal(t, Denied, ResultFor(401))
+	assert.Equal(t, Denied, ResultFor(403))
+	assert.Equal(t, Failure, ResultFor(404))
+	assert.Equal(t, Failure, ResultFor(500))
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	s, err := NewFileSink(path)
+	assert.Nil(t, err)
+	l, err := New(s)
+	assert.Nil(t, err)
+	l.Log(&Event{KeyID: "a", Operation: "view", Target: "x", Result: Success, Status: 200})
+	assert.Nil(t, s.Close())
+
+	s, err = NewFileSink(path)
+	assert.Nil(t, err)
+	l, err = New(s)
+	assert.Nil(t, err)
+	l.Log(&Event{KeyID: "a", Operation: "view", Target: "y", Result: Success, Status: 200})
+	assert.Nil(t, s.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	events, err := ReadEvents(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Nil(t, Verify(events, ""))
+}
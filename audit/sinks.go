@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileSink appends events to a file, one JSON object per line.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// NewFileSink opens path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, f: f}, nil
+}
+
+// Write implements Sink
+func (s *FileSink) Write(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.f.Write(append(data, '\n'))
+	return err
+}
+
+// Last implements Resumer
+func (s *FileSink) Last() (*Event, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events, err := ReadEvents(f)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[len(events)-1], nil
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// ReadEvents decodes events written by a FileSink.
+func ReadEvents(r io.Reader) (events []Event, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Store is the part of the database interface used by DBSink.
+type Store interface {
+	AddAuditEvent(*Event) error
+	GetLastAuditEvent(*Event) error
+}
+
+// DBSink writes events to a database table.
+type DBSink struct {
+	Store Store
+}
+
+// Write implements Sink
+func (s DBSink) Write(e *Event) error {
+	// Each sink stores its own copy, so the DB assigning an ID does not
+	// leak into the other sinks.
+	c := *e
+	c.ID = 0
+	return s.Store.AddAuditEvent(&c)
+}
+
+// Last implements Resumer
+func (s DBSink) Last() (*Event, error) {
+	e := new(Event)
+	err := s.Store.GetLastAuditEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Hash == "" {
+		return nil, nil
+	}
+	return e, nil
+}
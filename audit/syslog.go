@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogSink sends events to the local syslog daemon as JSON.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to syslog, logging events with the auth facility.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+// Write implements Sink
+func (s *SyslogSink) Write(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(data))
+}
+
+// Close disconnects from syslog.
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
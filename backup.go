@@ -0,0 +1,368 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// backupMagic starts every backup file, and changes with the format.
+const backupMagic = "nutcracker backup v1\n"
+
+// minBackupPassphrase is the shortest passphrase a backup can be
+// encrypted with.
+const minBackupPassphrase = 12
+
+// backupPassphraseEnv holds the passphrase for the backup and restore
+// commands, so that it stays out of the process list.
+const backupPassphraseEnv = "BACKUP_PASSPHRASE"
+
+// Key derivation parameters for backups.  They are stored in each file,
+// so that they can be raised without breaking older backups.
+const (
+	backupScryptN = 1 << 15
+	backupScryptR = 8
+	backupScryptP = 1
+)
+
+// backupHeader is written in the clear after backupMagic.
+type backupHeader struct {
+	N, R, P int
+	Salt    [32]byte
+	Nonce   [24]byte
+}
+
+// backupContents is encrypted into a backup.  The summary is checked
+// against the vault on restore.
+type backupContents struct {
+	Created time.Time
+	Summary []exportSummary
+	Vault   *vaultExport
+}
+
+var errBackupPassphrase = fmt.Errorf("The backup passphrase must be at least %d characters", minBackupPassphrase)
+
+var errBackupDecrypt = errors.New("The backup cannot be decrypted: the passphrase is wrong or the file is damaged")
+
+func backupKey(passphrase []byte, h *backupHeader) (*[32]byte, error) {
+	k, err := scrypt.Key(passphrase, h.Salt[:], h.N, h.R, h.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer secrets.Zero(k)
+
+	key := new([32]byte)
+	copy(key[:], k)
+	return key, nil
+}
+
+// writeBackup encrypts e with a key derived from passphrase, and writes
+// it to w.  Secretbox authenticates the contents, so any change to the
+// file stops it from being restored.
+func writeBackup(e *vaultExport, passphrase []byte, w io.Writer) error {
+	if len(passphrase) < minBackupPassphrase {
+		return errBackupPassphrase
+	}
+
+	h := &backupHeader{N: backupScryptN, R: backupScryptR, P: backupScryptP}
+	_, err := io.ReadFull(rand.Reader, h.Salt[:])
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(rand.Reader, h.Nonce[:])
+	if err != nil {
+		return err
+	}
+
+	key, err := backupKey(passphrase, h)
+	if err != nil {
+		return err
+	}
+	defer secrets.Zero(key[:])
+
+	plain := new(bytes.Buffer)
+	err = gob.NewEncoder(plain).Encode(&backupContents{
+		Created: time.Now().UTC(),
+		Summary: e.summary(),
+		Vault:   e,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, backupMagic)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(w).Encode(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(secretbox.Seal(nil, plain.Bytes(), &h.Nonce, key))
+	return err
+}
+
+// readBackup decrypts a backup written by writeBackup, and checks that
+// its contents match the summary stored with them.
+func readBackup(r io.Reader, passphrase []byte) (*backupContents, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(backupMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != backupMagic {
+		return nil, errors.New("Not a nutcracker backup")
+	}
+
+	// The cost parameters are limited, so that a crafted file cannot make
+	// key derivation take forever.
+	h := new(backupHeader)
+	err = gob.NewDecoder(br).Decode(h)
+	if err != nil || h.N > 1<<20 || h.R > 32 || h.P > 16 {
+		return nil, errBackupDecrypt
+	}
+
+	sealed, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := backupKey(passphrase, h)
+	if err != nil {
+		return nil, errBackupDecrypt
+	}
+	defer secrets.Zero(key[:])
+
+	plain, ok := secretbox.Open(nil, sealed, &h.Nonce, key)
+	if !ok {
+		return nil, errBackupDecrypt
+	}
+
+	c := new(backupContents)
+	err = gob.NewDecoder(bytes.NewReader(plain)).Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Vault == nil {
+		c.Vault = new(vaultExport)
+	}
+
+	err = verifyExport(c.Summary, c.Vault.summary())
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Backup returns an encrypted backup of the whole vault, which can be
+// loaded into an empty database with the restore command.  Only the
+// master key can take one, as it covers every namespace.
+func Backup(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() || !api.admin {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	if api.keyID != secrets.MasterKeyName {
+		api.error("Forbidden", 403)
+		return
+	}
+
+	request, err := api.read()
+	if err != nil {
+		api.error("Bad request", 400)
+		return
+	}
+	passphrase := []byte(request.Passphrase)
+	defer secrets.Zero(passphrase)
+
+	if len(passphrase) < minBackupPassphrase {
+		api.error(errBackupPassphrase.Error(), 400)
+		return
+	}
+
+	e, err := exportDB(database)
+	if err != nil {
+		api.log().Error(err)
+		api.error("Database error", 500)
+		return
+	}
+
+	data := new(bytes.Buffer)
+	err = writeBackup(e, passphrase, data)
+	if err != nil {
+		api.log().Error(err)
+		api.error("Error encrypting backup", 500)
+		return
+	}
+
+	api.log().Info("Backup taken")
+
+	name := fmt.Sprintf("nutcracker-%s.backup", time.Now().UTC().Format("20060102T150405Z"))
+	api.resp.Header().Set("Content-Type", "application/octet-stream")
+	api.resp.Header().Set("Content-Disposition", "attachment; filename="+name)
+	api.rawMessage(data.Bytes(), 200)
+}
+
+// backupPassphrase reads the passphrase for the backup and restore
+// commands from the environment.
+func backupPassphrase() ([]byte, error) {
+	p := os.Getenv(backupPassphraseEnv)
+	if p == "" {
+		return nil, fmt.Errorf("Set %s to the backup passphrase", backupPassphraseEnv)
+	}
+	return []byte(p), nil
+}
+
+// connectConfigured connects to the configured database, which cannot be
+// the memory backend, as it would be empty.
+func connectConfigured() (db.DB, error) {
+	conf, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	pageSize = conf.PageSize
+
+	if conf.Database.Driver == "memory" {
+		return nil, errors.New("The memory backend is empty outside the server, so there is nothing to work on")
+	}
+
+	d := conf.Database.open()
+	return d, d.Connect()
+}
+
+// backupCommand writes an encrypted backup of the configured database to
+// the file given by the flags in args.
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	path := fs.String("out", "", "File to write the backup to.  It must not exist.")
+	fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("Give the file to write the backup to with -out")
+	}
+
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	defer secrets.Zero(passphrase)
+	if len(passphrase) < minBackupPassphrase {
+		return errBackupPassphrase
+	}
+
+	d, err := connectConfigured()
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	e, err := exportDB(d)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = writeBackup(e, passphrase, f)
+	if err != nil {
+		f.Close()
+		os.Remove(*path)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range e.summary() {
+		fmt.Fprintf(os.Stdout, "%-13s %6d  %s\n", s.Kind, s.Count, s.SHA256)
+	}
+	fmt.Fprintln(os.Stdout, "Backup written to", *path)
+	return nil
+}
+
+// restoreCommand loads the backup given by the flags in args into the
+// configured database, which must be empty.
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	path := fs.String("in", "", "Backup file to restore")
+	dryRun := fs.Bool("dry-run", false, "Check the backup in memory, without writing to the database")
+	fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("Give the backup file to restore with -in")
+	}
+
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	defer secrets.Zero(passphrase)
+
+	f, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A dry run only checks the backup, so it does not need an empty
+	// database to compare against.
+	var d db.DB = new(memory.DB)
+	if !*dryRun {
+		d, err = connectConfigured()
+	} else {
+		err = d.Connect()
+	}
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return restore(f, passphrase, d, *dryRun, os.Stdout)
+}
+
+// restore loads the backup in r into d, which must be empty, and checks
+// that d then holds the same records.  A dry run loads into memory
+// instead, and leaves d alone.
+func restore(r io.Reader, passphrase []byte, d db.DB, dryRun bool, out io.Writer) error {
+	c, err := readBackup(r, passphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Backup taken at", c.Created.Format(time.RFC3339))
+
+	err = load(c.Vault, c.Summary, d, dryRun, out)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Fprintln(out, "Dry run: the backup can be restored.  Nothing was written.")
+	} else {
+		fmt.Fprintln(out, "Restore complete, counts and checksums match.")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPassphrase = "correct horse battery"
+
+func TestBackupArchive(t *testing.T) {
+	src := new(memory.DB)
+	require.Nil(t, src.Connect())
+	fillVault(t, src)
+
+	e, err := exportDB(src)
+	require.Nil(t, err)
+
+	assert.Equal(t, errBackupPassphrase, writeBackup(e, []byte("too short"), new(bytes.Buffer)))
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, writeBackup(e, []byte(testPassphrase), buf))
+	archive := buf.Bytes()
+	assert.False(t, bytes.Contains(archive, []byte("app/db")), "Names should be encrypted")
+
+	c, err := readBackup(bytes.NewReader(archive), []byte(testPassphrase))
+	assert.Nil(t, err)
+	assert.Equal(t, e.summary(), c.Summary)
+	assert.Equal(t, e.summary(), c.Vault.summary())
+
+	_, err = readBackup(bytes.NewReader(archive), []byte("wrong passphrase"))
+	assert.Equal(t, errBackupDecrypt, err)
+
+	damaged := append([]byte{}, archive...)
+	damaged[len(damaged)-10] ^= 1
+	_, err = readBackup(bytes.NewReader(damaged), []byte(testPassphrase))
+	assert.Equal(t, errBackupDecrypt, err)
+
+	_, err = readBackup(bytes.NewReader([]byte("not a backup at all")), []byte(testPassphrase))
+	assert.EqualError(t, err, "Not a nutcracker backup")
+}
+
+func TestRestore(t *testing.T) {
+	src := new(memory.DB)
+	require.Nil(t, src.Connect())
+	key := fillVault(t, src)
+
+	e, err := exportDB(src)
+	require.Nil(t, err)
+	buf := new(bytes.Buffer)
+	require.Nil(t, writeBackup(e, []byte(testPassphrase), buf))
+	archive := buf.Bytes()
+
+	dst, done := tempBolt(t)
+	defer done()
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, restore(bytes.NewReader(archive), []byte(testPassphrase), dst, true, out))
+	assert.Contains(t, out.String(), "Nothing was written")
+	assert.Nil(t, checkEmpty(dst), "Dry run should not write")
+
+	out.Reset()
+	assert.Nil(t, restore(bytes.NewReader(archive), []byte(testPassphrase), dst, false, out))
+	assert.Contains(t, out.String(), "Restore complete")
+
+	// The restored secret can be read with the key it was shared with
+	root := &secrets.Secret{Name: "app/db"}
+	shared := &secrets.Secret{Name: "app/db"}
+	assert.Nil(t, dst.GetRootSecret(root))
+	assert.Nil(t, dst.GetSharedSecret(shared, &secrets.Key{Name: "app"}))
+	message, err := root.Decrypt(shared, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(message))
+
+	// View stats survive too
+	assert.Len(t, e.Namespaces[0].Stats, 2)
+	for _, want := range e.Namespaces[0].Stats {
+		st := &secrets.Stats{Type: want.Type, Name: want.Name}
+		assert.Nil(t, dst.GetStats(st))
+		assert.Equal(t, want.Views, st.Views)
+		assert.Equal(t, want.LastPeer, st.LastPeer)
+		if assert.NotNil(t, st.LastViewed) {
+			assert.True(t, want.LastViewed.Equal(*st.LastViewed))
+		}
+	}
+
+	err = restore(bytes.NewReader(archive), []byte(testPassphrase), dst, false, out)
+	assert.EqualError(t, err, "The target database is not empty")
+}
+
+func TestBackup(t *testing.T) {
+	defer useDatabase(new(memory.DB))()
+	require.Nil(t, database.Connect())
+	defer database.Close()
+	keyLockout.Reset()
+
+	out := new(bytes.Buffer)
+	require.Nil(t, initDev(out))
+	creds := regexp.MustCompile(`X-Secret-ID: (\S+)\n\s+X-Secret-Key: (\S+)`).FindAllStringSubmatch(out.String(), -1)
+	require.Len(t, creds, 2)
+
+	backup := func(id, key, passphrase string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"Passphrase": passphrase})
+		r, _ := http.NewRequest("POST", "/secrets/backup", bytes.NewReader(body))
+		r.Header.Set("X-Secret-ID", id)
+		r.Header.Set("X-Secret-Key", key)
+		w := httptest.NewRecorder()
+		Backup(w, r)
+		return w
+	}
+
+	w := backup(creds[1][1], creds[1][2], testPassphrase)
+	assert.Equal(t, 403, w.Code, "Only the master key can take a backup")
+
+	w = backup(creds[0][1], creds[0][2], "short")
+	assert.Equal(t, 400, w.Code, "Short passphrases should be refused")
+
+	w = backup(creds[0][1], creds[0][2], testPassphrase)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+
+	dst := new(memory.DB)
+	require.Nil(t, dst.Connect())
+	out.Reset()
+	assert.Nil(t, restore(w.Body, []byte(testPassphrase), dst, false, out))
+
+	admin := &secrets.Key{Name: devAdminKey}
+	assert.Nil(t, dst.GetKey(admin), "The admin key should be restored")
+}
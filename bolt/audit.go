@@ -0,0 +1,57 @@
+package bolt
+
+import (
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// AddAuditEvent appends an event to the audit bucket.
+func (b *DB) AddAuditEvent(e *audit.Event) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return insert(tx, auditBucket, &e.ID, e)
+	})
+}
+
+// GetLastAuditEvent selects the most recent audit event.
+// The event is left empty if the bucket is empty.
+func (b *DB) GetLastAuditEvent(e *audit.Event) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		k, data := tx.Bucket([]byte(auditBucket)).Cursor().Last()
+		if k == nil {
+			return nil
+		}
+
+		last := new(audit.Event)
+		err := decode(data, last)
+		if err != nil {
+			return err
+		}
+
+		*e = *last
+		return nil
+	})
+}
+
+// ListAuditEvents returns an iterator function that walks through the audit events matching q, oldest first.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (b *DB) ListAuditEvents(q *audit.Query) func(int) ([]audit.Event, error) {
+	pos := q.Offset
+
+	return func(n int) (res []audit.Event, err error) {
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			found, err := findAuditEvents(tx, func(e *audit.Event) bool {
+				return (q.Namespace == "" || e.Namespace == q.Namespace) &&
+					(q.KeyID == "" || e.KeyID == q.KeyID) &&
+					(q.Target == "" || e.Target == q.Target) &&
+					(q.Operation == "" || e.Operation == q.Operation) &&
+					(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+					(q.Until.IsZero() || e.Time.Before(q.Until))
+			})
+			lo, hi := window(len(found), pos, n)
+			res = found[lo:hi]
+			return err
+		})
+		pos += len(res)
+		return
+	}
+}
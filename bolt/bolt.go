@@ -0,0 +1,562 @@
+// Package bolt stores the vault in a single bbolt file, so that nutcracker
+// can run without a database server.
+package bolt
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// DefaultTimeout is how long Connect waits for the lock on the file if
+// Timeout is not set.
+const DefaultTimeout = 5 * time.Second
+
+// DB is an implementation of the db.DB interface.  Each table is a bucket
+// of gob encoded records keyed by ID.  Lookups scan the bucket, which is
+// fast enough for the number of secrets a single file is meant for.
+type DB struct {
+	// Path is the database file.  It is created if it does not exist.
+	Path string
+	// Timeout is how long to wait for another process to release the file.
+	Timeout time.Duration
+
+	db *bbolt.DB
+}
+
+// Connect opens the database file, and creates any missing buckets.
+func (b *DB) Connect() (err error) {
+	if b.Path == "" {
+		return errors.New("No database file specified")
+	}
+
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	b.db, err = bbolt.Open(b.Path, 0600, &bbolt.Options{Timeout: timeout})
+	if err != nil {
+		return
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ns returns the namespace to use for a query.
+func ns(namespace string) string {
+	if namespace == "" {
+		return secrets.DefaultNamespace
+	}
+	return namespace
+}
+
+// Ping checks that the database file is open
+func (b *DB) Ping() error {
+	if b.db == nil {
+		return errors.New("Database is not open")
+	}
+	_, err := os.Stat(b.db.Path())
+	return err
+}
+
+// Close closes the database file.
+func (b *DB) Close() (err error) {
+	if b.db != nil {
+		err = b.db.Close()
+	}
+	return
+}
+
+// AddSecret inserts a new secret into the DB, and its key if it does not
+// exist yet.
+func (b *DB) AddSecret(s *secrets.Secret) error {
+	s.Namespace = ns(s.Namespace)
+	if s.Key.Namespace == "" {
+		s.Key.Namespace = s.Namespace
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if s.Root {
+			found, err := findSecrets(tx, func(e *secrets.Secret) bool {
+				return e.Root && e.Namespace == s.Namespace && e.Name == s.Name
+			})
+			if err != nil {
+				return err
+			}
+			if len(found) > 0 {
+				return errors.New("Secret already exists")
+			}
+		}
+
+		k := &secrets.Key{Namespace: s.Key.Namespace, Name: s.Key.Name}
+		err := getKey(tx, k)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			err = addKey(tx, &s.Key)
+			if err != nil {
+				return err
+			}
+
+		case nil:
+			s.Key.ID = k.ID
+
+		default:
+			return err
+
+		}
+
+		s.KeyID = s.Key.ID
+		return addSecret(tx, s)
+	})
+}
+
+// AddKey inserts a key into the DB
+func (b *DB) AddKey(k *secrets.Key) error {
+	k.Namespace = ns(k.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return addKey(tx, k)
+	})
+}
+
+// GetKey selects a key by ID or by name.
+func (b *DB) GetKey(k *secrets.Key) error {
+	k.Namespace = ns(k.Namespace)
+
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return getKey(tx, k)
+	})
+}
+
+// GetRootSecret returns the latest matching root secret
+func (b *DB) GetRootSecret(s *secrets.Secret) error {
+	s.Namespace = ns(s.Namespace)
+	s.Root = true
+
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return getSecret(tx, s)
+	})
+}
+
+// GetSharedSecret returns the shared cert linking s and k
+func (b *DB) GetSharedSecret(s *secrets.Secret, k *secrets.Key) error {
+	k.Namespace = ns(k.Namespace)
+
+	return b.db.View(func(tx *bbolt.Tx) error {
+		err := getKey(tx, k)
+		if err != nil {
+			return err
+		}
+
+		s.Namespace = k.Namespace
+		s.Root = false
+		s.KeyID = k.ID
+		return getSecret(tx, s)
+	})
+}
+
+// UpdateSecret updates a secret by adding a new copy of it to the db.
+func (b *DB) UpdateSecret(s *secrets.Secret) error {
+	if s.KeyID == 0 {
+		s.KeyID = s.Key.ID
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return addSecret(tx, s)
+	})
+}
+
+// ListSecrets returns an iterator function that walks through all secrets in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a key name is specified, the results are limited to secrets shared with that key.
+// If a prefix is specified, the results are limited to secrets whose names start with it.
+func (b *DB) ListSecrets(namespace string, key *string, prefix string) func(int) ([]secrets.Secret, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Secret, err error) {
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			ids := map[uint]bool{}
+			if key != nil {
+				keys, err := findKeys(tx, func(k *secrets.Key) bool {
+					return k.Name == *key
+				})
+				if err != nil {
+					return err
+				}
+				for _, k := range keys {
+					ids[k.ID] = true
+				}
+			}
+
+			found, err := findSecrets(tx, func(s *secrets.Secret) bool {
+				return s.Namespace == namespace && strings.HasPrefix(s.Name, prefix) && (key == nil || ids[s.KeyID])
+			})
+			if err != nil {
+				return err
+			}
+
+			lo, hi := window(len(found), pos, n)
+			res = found[lo:hi]
+			return nil
+		})
+		pos += len(res)
+		return
+	}
+}
+
+// ListKeys returns an iterator function that walks through all keys in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a secret name is specified, the results are limited to keys with access to that secret.
+func (b *DB) ListKeys(namespace string, secret *string) func(int) ([]secrets.Key, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Key, err error) {
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			ids := map[uint]bool{}
+			if secret != nil {
+				shares, err := findSecrets(tx, func(s *secrets.Secret) bool {
+					return s.Name == *secret
+				})
+				if err != nil {
+					return err
+				}
+				for _, s := range shares {
+					ids[s.KeyID] = true
+				}
+			}
+
+			found, err := findKeys(tx, func(k *secrets.Key) bool {
+				return k.Namespace == namespace && (secret == nil || ids[k.ID])
+			})
+			if err != nil {
+				return err
+			}
+
+			lo, hi := window(len(found), pos, n)
+			res = found[lo:hi]
+			return nil
+		})
+		pos += len(res)
+		return
+	}
+}
+
+// DeleteSecret removes a secret from the DB
+func (b *DB) DeleteSecret(s *secrets.Secret) (err error) {
+	if s == nil || s.Name == "" {
+		return errors.New("No secret specified")
+	}
+
+	if s.Name == "master" {
+		return errors.New("Cannot delete master")
+	}
+
+	s.Namespace = ns(s.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		groups, err := findGroups(tx, func(g *secrets.Group) bool {
+			return g.Namespace == s.Namespace
+		})
+		if err != nil {
+			return err
+		}
+		inNamespace := map[uint]bool{}
+		for _, g := range groups {
+			inNamespace[g.ID] = true
+		}
+
+		links, err := findGroupSecrets(tx, func(l *secrets.GroupSecret) bool {
+			return l.Name == s.Name && inNamespace[l.GroupID]
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			err = remove(tx, groupSecretsBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = deleteStats(tx, s.Namespace, secrets.SecretStats, s.Name)
+		if err != nil {
+			return err
+		}
+
+		found, err := findSecrets(tx, func(e *secrets.Secret) bool {
+			return e.Namespace == s.Namespace && e.Name == s.Name
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range found {
+			err = remove(tx, secretsBucket, e.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteSharedSecret removes every share linking s and k, leaving both in place.
+// It returns gorm.ErrRecordNotFound if the secret was not shared with the key.
+func (b *DB) DeleteSharedSecret(s *secrets.Secret, k *secrets.Key) (err error) {
+	if s == nil || s.Name == "" {
+		return errors.New("No secret specified")
+	}
+
+	k.Namespace = ns(k.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getKey(tx, k)
+		if err != nil {
+			return err
+		}
+
+		found, err := findSecrets(tx, func(e *secrets.Secret) bool {
+			return !e.Root && e.Namespace == k.Namespace && e.Name == s.Name && e.KeyID == k.ID
+		})
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		for _, e := range found {
+			err = remove(tx, secretsBucket, e.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteKey removes a key, its policy attachments, group memberships,
+// shares and stats from the DB
+func (b *DB) DeleteKey(k *secrets.Key) (err error) {
+	if k == nil || k.Name == "" {
+		return errors.New("No key specified")
+	}
+
+	if k.Name == "master" {
+		return errors.New("Cannot delete master")
+	}
+
+	k.Namespace = ns(k.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		found := &secrets.Key{Namespace: k.Namespace, Name: k.Name}
+		err := getKey(tx, found)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			return nil
+
+		case nil:
+			break
+
+		default:
+			return err
+
+		}
+
+		policies, err := findKeyPolicies(tx, func(l *acl.KeyPolicy) bool {
+			return l.KeyID == found.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range policies {
+			err = remove(tx, keyPoliciesBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		members, err := findGroupMembers(tx, func(l *secrets.GroupMember) bool {
+			return l.KeyID == found.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range members {
+			err = remove(tx, groupMembersBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = deleteStats(tx, k.Namespace, secrets.KeyStats, k.Name)
+		if err != nil {
+			return err
+		}
+
+		shared, err := findSecrets(tx, func(s *secrets.Secret) bool {
+			return !s.Root && s.KeyID == found.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range shared {
+			err = remove(tx, secretsBucket, s.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return remove(tx, keysBucket, found.ID)
+	})
+}
+
+// Namespaces lists every namespace holding a secret, key, policy or group.
+func (b *DB) Namespaces() (res []string, err error) {
+	seen := map[string]bool{}
+
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		found, err := findSecrets(tx, func(s *secrets.Secret) bool { return !seen[s.Namespace] })
+		for _, s := range found {
+			seen[s.Namespace] = true
+		}
+		if err != nil {
+			return err
+		}
+
+		keys, err := findKeys(tx, func(k *secrets.Key) bool { return !seen[k.Namespace] })
+		for _, k := range keys {
+			seen[k.Namespace] = true
+		}
+		if err != nil {
+			return err
+		}
+
+		policies, err := findPolicies(tx, func(p *acl.Policy) bool { return !seen[p.Namespace] })
+		for _, p := range policies {
+			seen[p.Namespace] = true
+		}
+		if err != nil {
+			return err
+		}
+
+		groups, err := findGroups(tx, func(g *secrets.Group) bool { return !seen[g.Namespace] })
+		for _, g := range groups {
+			seen[g.Namespace] = true
+		}
+		return err
+	})
+
+	for namespace := range seen {
+		res = append(res, namespace)
+	}
+	sort.Strings(res)
+	return
+}
+
+// Metrics returns data about the state of the database
+func (b *DB) Metrics() (map[string]interface{}, error) {
+	metrics := make(map[string]interface{})
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range []string{secretsBucket, keysBucket, policiesBucket, groupsBucket} {
+			metrics[name] = tx.Bucket([]byte(name)).Stats().KeyN
+		}
+		return nil
+	})
+	return metrics, err
+}
+
+func addSecret(tx *bbolt.Tx, s *secrets.Secret) error {
+	// The key is stored on its own, and stats are not stored at all.
+	stored := *s
+	stored.Key = secrets.Key{}
+	stored.Stats = nil
+
+	err := insert(tx, secretsBucket, &stored.ID, &stored)
+	s.ID = stored.ID
+	return err
+}
+
+func addKey(tx *bbolt.Tx, k *secrets.Key) error {
+	k.Namespace = ns(k.Namespace)
+
+	err := getKey(tx, &secrets.Key{Namespace: k.Namespace, Name: k.Name})
+	switch err {
+
+	case nil:
+		return errors.New("Key already exists")
+
+	case gorm.ErrRecordNotFound:
+		break
+
+	default:
+		return err
+
+	}
+
+	stored := *k
+	stored.Stats = nil
+
+	err = insert(tx, keysBucket, &stored.ID, &stored)
+	k.ID = stored.ID
+	return err
+}
+
+// getKey fills in k from the key matching its ID, namespace and name,
+// whichever are set.
+func getKey(tx *bbolt.Tx, k *secrets.Key) error {
+	found, err := findKeys(tx, func(e *secrets.Key) bool {
+		return (k.ID == 0 || e.ID == k.ID) &&
+			(k.Namespace == "" || e.Namespace == k.Namespace) &&
+			(k.Name == "" || e.Name == k.Name)
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	*k = found[0]
+	return nil
+}
+
+// getSecret fills in s from the latest secret matching its namespace,
+// name, root flag and key, along with its key.
+func getSecret(tx *bbolt.Tx, s *secrets.Secret) error {
+	found, err := findSecrets(tx, func(e *secrets.Secret) bool {
+		return e.Namespace == s.Namespace && e.Root == s.Root &&
+			(s.Name == "" || e.Name == s.Name) &&
+			(s.KeyID == 0 || e.KeyID == s.KeyID)
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	*s = found[len(found)-1]
+	s.Key.ID = s.KeyID
+	return getKey(tx, &s.Key)
+}
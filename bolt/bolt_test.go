@@ -0,0 +1,61 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/db/dbtest"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ db.DB = new(DB)
+
+func TestDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) (db.DB, func()) {
+		dir, err := ioutil.TempDir("", "nutcracker")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := &DB{Path: filepath.Join(dir, "nutcracker.db")}
+		err = d.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d, func() {
+			d.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nutcracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &DB{Path: filepath.Join(dir, "nutcracker.db")}
+	assert.Nil(t, d.Connect())
+	assert.Nil(t, d.AddKey(&secrets.Key{Name: "app", Public: []byte("public")}))
+	assert.Nil(t, d.Close())
+
+	d = &DB{Path: d.Path}
+	assert.Nil(t, d.Connect())
+	defer d.Close()
+
+	k := &secrets.Key{Name: "app"}
+	assert.Nil(t, d.GetKey(k))
+	assert.Equal(t, []byte("public"), k.Public)
+
+	// Another instance cannot open the file while it is in use
+	other := &DB{Path: d.Path, Timeout: 10 * time.Millisecond}
+	assert.NotNil(t, other.Connect())
+}
@@ -0,0 +1,307 @@
+package bolt
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// AddGroup inserts a new group into the DB
+func (b *DB) AddGroup(g *secrets.Group) error {
+	g.Namespace = ns(g.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getGroup(tx, &secrets.Group{Namespace: g.Namespace, Name: g.Name})
+		switch err {
+
+		case nil:
+			return errors.New("Group already exists")
+
+		case gorm.ErrRecordNotFound:
+			break
+
+		default:
+			return err
+
+		}
+
+		return insert(tx, groupsBucket, &g.ID, g)
+	})
+}
+
+// GetGroup selects a group by name.
+func (b *DB) GetGroup(g *secrets.Group) error {
+	g.Namespace = ns(g.Namespace)
+
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return getGroup(tx, g)
+	})
+}
+
+// ListGroups returns an iterator function that walks through all groups in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (b *DB) ListGroups(namespace string) func(int) ([]secrets.Group, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Group, err error) {
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			found, err := findGroups(tx, func(g *secrets.Group) bool {
+				return g.Namespace == namespace
+			})
+			lo, hi := window(len(found), pos, n)
+			res = found[lo:hi]
+			return err
+		})
+		pos += len(res)
+		return
+	}
+}
+
+// DeleteGroup removes a group, its members and every share made through it.
+func (b *DB) DeleteGroup(g *secrets.Group) (err error) {
+	if g == nil || g.Name == "" {
+		return errors.New("No group specified")
+	}
+
+	g.Namespace = ns(g.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getGroup(tx, g)
+		if err != nil {
+			return err
+		}
+
+		shares, err := findSecrets(tx, func(s *secrets.Secret) bool {
+			return !s.Root && s.GroupID == g.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range shares {
+			err = remove(tx, secretsBucket, s.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		members, err := findGroupMembers(tx, func(l *secrets.GroupMember) bool {
+			return l.GroupID == g.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range members {
+			err = remove(tx, groupMembersBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		links, err := findGroupSecrets(tx, func(l *secrets.GroupSecret) bool {
+			return l.GroupID == g.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			err = remove(tx, groupSecretsBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return remove(tx, groupsBucket, g.ID)
+	})
+}
+
+// AddGroupMember adds a key to a group.  It does not share any secrets,
+// the caller is responsible for sharing the group's secrets with the key.
+func (b *DB) AddGroupMember(g *secrets.Group, k *secrets.Key) (err error) {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getGroupAndKey(tx, g, k)
+		if err != nil {
+			return err
+		}
+
+		found, err := findGroupMembers(tx, func(l *secrets.GroupMember) bool {
+			return l.GroupID == g.ID && l.KeyID == k.ID
+		})
+		if err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			return errors.New("Key is already a member")
+		}
+
+		link := &secrets.GroupMember{GroupID: g.ID, KeyID: k.ID}
+		return insert(tx, groupMembersBucket, &link.ID, link)
+	})
+}
+
+// RemoveGroupMember removes a key from a group, along with every share
+// the key was given through the group.
+func (b *DB) RemoveGroupMember(g *secrets.Group, k *secrets.Key) (err error) {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getGroupAndKey(tx, g, k)
+		if err != nil {
+			return err
+		}
+
+		shares, err := findSecrets(tx, func(s *secrets.Secret) bool {
+			return !s.Root && s.GroupID == g.ID && s.KeyID == k.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range shares {
+			err = remove(tx, secretsBucket, s.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		members, err := findGroupMembers(tx, func(l *secrets.GroupMember) bool {
+			return l.GroupID == g.ID && l.KeyID == k.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range members {
+			err = remove(tx, groupMembersBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListGroupMembers returns an iterator function that walks through the keys in a group.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (b *DB) ListGroupMembers(g *secrets.Group) func(int) ([]secrets.Key, error) {
+	pos := 0
+
+	return func(n int) (res []secrets.Key, err error) {
+		g.Namespace = ns(g.Namespace)
+
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			err := getGroup(tx, g)
+			if err != nil {
+				return err
+			}
+
+			members, err := findGroupMembers(tx, func(l *secrets.GroupMember) bool {
+				return l.GroupID == g.ID
+			})
+			if err != nil {
+				return err
+			}
+			ids := map[uint]bool{}
+			for _, l := range members {
+				ids[l.KeyID] = true
+			}
+
+			found, err := findKeys(tx, func(k *secrets.Key) bool {
+				return ids[k.ID]
+			})
+			lo, hi := window(len(found), pos, n)
+			res = found[lo:hi]
+			return err
+		})
+		pos += len(res)
+		return
+	}
+}
+
+// AddGroupSecret records that a secret is shared with a group.  It does
+// not share the secret with the group's members.
+func (b *DB) AddGroupSecret(g *secrets.Group, s *secrets.Secret) (err error) {
+	g.Namespace = ns(g.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getGroup(tx, g)
+		if err != nil {
+			return err
+		}
+
+		found, err := findGroupSecrets(tx, func(l *secrets.GroupSecret) bool {
+			return l.GroupID == g.ID && l.Name == s.Name
+		})
+		if err != nil || len(found) > 0 {
+			return err
+		}
+
+		link := &secrets.GroupSecret{GroupID: g.ID, Name: s.Name}
+		return insert(tx, groupSecretsBucket, &link.ID, link)
+	})
+}
+
+// ListGroupSecrets returns an iterator function that walks through the secrets shared with a group.
+// Only the namespace and name of each secret are set.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (b *DB) ListGroupSecrets(g *secrets.Group) func(int) ([]secrets.Secret, error) {
+	pos := 0
+
+	return func(n int) (res []secrets.Secret, err error) {
+		g.Namespace = ns(g.Namespace)
+
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			err := getGroup(tx, g)
+			if err != nil {
+				return err
+			}
+
+			links, err := findGroupSecrets(tx, func(l *secrets.GroupSecret) bool {
+				return l.GroupID == g.ID
+			})
+			if err != nil {
+				return err
+			}
+
+			lo, hi := window(len(links), pos, n)
+			for _, l := range links[lo:hi] {
+				res = append(res, secrets.Secret{Namespace: g.Namespace, Name: l.Name})
+			}
+			return nil
+		})
+		pos += len(res)
+		return
+	}
+}
+
+func getGroup(tx *bbolt.Tx, g *secrets.Group) error {
+	found, err := findGroups(tx, func(e *secrets.Group) bool {
+		return e.Namespace == g.Namespace && e.Name == g.Name
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	*g = found[0]
+	return nil
+}
+
+func getGroupAndKey(tx *bbolt.Tx, g *secrets.Group, k *secrets.Key) error {
+	g.Namespace = ns(g.Namespace)
+	err := getGroup(tx, g)
+	if err != nil {
+		return err
+	}
+
+	k.Namespace = ns(k.Namespace)
+	err = getKey(tx, k)
+	if err != nil {
+		return err
+	}
+
+	if k.Namespace != g.Namespace {
+		return errors.New("Key and group are in different namespaces")
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package bolt
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// AddPolicy inserts a new policy and its rules into the DB
+func (b *DB) AddPolicy(pol *acl.Policy) error {
+	pol.Namespace = ns(pol.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getPolicy(tx, &acl.Policy{Namespace: pol.Namespace, Name: pol.Name})
+		switch err {
+
+		case nil:
+			return errors.New("Policy already exists")
+
+		case gorm.ErrRecordNotFound:
+			break
+
+		default:
+			return err
+
+		}
+
+		stored := *pol
+		stored.Rules = nil
+		err = insert(tx, policiesBucket, &stored.ID, &stored)
+		if err != nil {
+			return err
+		}
+		pol.ID = stored.ID
+
+		return addRules(tx, pol)
+	})
+}
+
+// GetPolicy selects a policy and its rules by name.
+func (b *DB) GetPolicy(pol *acl.Policy) error {
+	pol.Namespace = ns(pol.Namespace)
+
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return getPolicy(tx, pol)
+	})
+}
+
+// ListPolicies returns an iterator function that walks through all policies in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a key name is specified, the results are limited to policies attached to that key.
+func (b *DB) ListPolicies(namespace string, key *string) func(int) ([]acl.Policy, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []acl.Policy, err error) {
+		err = b.db.View(func(tx *bbolt.Tx) error {
+			ids := map[uint]bool{}
+			if key != nil {
+				k := &secrets.Key{Namespace: namespace, Name: *key}
+				err := getKey(tx, k)
+				if err != nil && err != gorm.ErrRecordNotFound {
+					return err
+				}
+
+				links, err := findKeyPolicies(tx, func(l *acl.KeyPolicy) bool {
+					return k.ID != 0 && l.KeyID == k.ID
+				})
+				if err != nil {
+					return err
+				}
+				for _, l := range links {
+					ids[l.PolicyID] = true
+				}
+			}
+
+			found, err := findPolicies(tx, func(p *acl.Policy) bool {
+				return p.Namespace == namespace && (key == nil || ids[p.ID])
+			})
+			if err != nil {
+				return err
+			}
+
+			lo, hi := window(len(found), pos, n)
+			res = found[lo:hi]
+			for i := range res {
+				res[i].Rules, err = getRules(tx, res[i].ID)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		pos += len(res)
+		return
+	}
+}
+
+// UpdatePolicy replaces the rules of an existing policy.  Keys it is
+// attached to keep it.
+func (b *DB) UpdatePolicy(pol *acl.Policy) (err error) {
+	if pol == nil || pol.Name == "" {
+		return errors.New("No policy specified")
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		existing := &acl.Policy{Namespace: ns(pol.Namespace), Name: pol.Name}
+		err := getPolicy(tx, existing)
+		if err != nil {
+			return err
+		}
+
+		err = deleteRules(tx, existing.ID)
+		if err != nil {
+			return err
+		}
+
+		pol.ID = existing.ID
+		pol.Namespace = existing.Namespace
+		return addRules(tx, pol)
+	})
+}
+
+// DeletePolicy removes a policy, its rules and any key attachments from the DB
+func (b *DB) DeletePolicy(pol *acl.Policy) (err error) {
+	if pol == nil || pol.Name == "" {
+		return errors.New("No policy specified")
+	}
+
+	pol.Namespace = ns(pol.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getPolicy(tx, pol)
+		if err != nil {
+			return err
+		}
+
+		links, err := findKeyPolicies(tx, func(l *acl.KeyPolicy) bool {
+			return l.PolicyID == pol.ID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			err = remove(tx, keyPoliciesBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = deleteRules(tx, pol.ID)
+		if err != nil {
+			return err
+		}
+
+		return remove(tx, policiesBucket, pol.ID)
+	})
+}
+
+// AttachPolicy grants the policy to a key
+func (b *DB) AttachPolicy(k *secrets.Key, pol *acl.Policy) (err error) {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		link, err := getKeyPolicy(tx, k, pol)
+		if err != nil {
+			return err
+		}
+
+		found, err := findKeyPolicies(tx, func(l *acl.KeyPolicy) bool {
+			return l.KeyID == link.KeyID && l.PolicyID == link.PolicyID
+		})
+		if err != nil || len(found) > 0 {
+			return err
+		}
+
+		return insert(tx, keyPoliciesBucket, &link.ID, link)
+	})
+}
+
+// DetachPolicy removes the policy from a key
+func (b *DB) DetachPolicy(k *secrets.Key, pol *acl.Policy) (err error) {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		link, err := getKeyPolicy(tx, k, pol)
+		if err != nil {
+			return err
+		}
+
+		found, err := findKeyPolicies(tx, func(l *acl.KeyPolicy) bool {
+			return l.KeyID == link.KeyID && l.PolicyID == link.PolicyID
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range found {
+			err = remove(tx, keyPoliciesBucket, l.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getKeyPolicy looks up k and pol, and returns the link between them.
+func getKeyPolicy(tx *bbolt.Tx, k *secrets.Key, pol *acl.Policy) (*acl.KeyPolicy, error) {
+	k.Namespace = ns(k.Namespace)
+	err := getKey(tx, k)
+	if err != nil {
+		return nil, err
+	}
+
+	pol.Namespace = ns(pol.Namespace)
+	err = getPolicy(tx, pol)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Namespace != pol.Namespace {
+		return nil, errors.New("Key and policy are in different namespaces")
+	}
+
+	return &acl.KeyPolicy{KeyID: k.ID, PolicyID: pol.ID}, nil
+}
+
+func getPolicy(tx *bbolt.Tx, pol *acl.Policy) error {
+	found, err := findPolicies(tx, func(p *acl.Policy) bool {
+		return p.Namespace == pol.Namespace && p.Name == pol.Name
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	*pol = found[0]
+	pol.Rules, err = getRules(tx, pol.ID)
+	return err
+}
+
+func getRules(tx *bbolt.Tx, policyID uint) ([]acl.Rule, error) {
+	return findRules(tx, func(r *acl.Rule) bool {
+		return r.PolicyID == policyID
+	})
+}
+
+// addRules stores the rules of pol, which must already have an ID.
+func addRules(tx *bbolt.Tx, pol *acl.Policy) error {
+	for i := range pol.Rules {
+		pol.Rules[i].PolicyID = pol.ID
+		err := insert(tx, rulesBucket, &pol.Rules[i].ID, &pol.Rules[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteRules(tx *bbolt.Tx, policyID uint) error {
+	rules, err := getRules(tx, policyID)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		err = remove(tx, rulesBucket, r.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// Bucket names, one per table of the postgres backend.
+const (
+	secretsBucket      = "secrets"
+	keysBucket         = "keys"
+	policiesBucket     = "policies"
+	rulesBucket        = "rules"
+	keyPoliciesBucket  = "key_policies"
+	groupsBucket       = "groups"
+	groupMembersBucket = "group_members"
+	groupSecretsBucket = "group_secrets"
+	statsBucket        = "stats"
+	auditBucket        = "audit_events"
+)
+
+var buckets = []string{
+	secretsBucket,
+	keysBucket,
+	policiesBucket,
+	rulesBucket,
+	keyPoliciesBucket,
+	groupsBucket,
+	groupMembersBucket,
+	groupSecretsBucket,
+	statsBucket,
+	auditBucket,
+}
+
+// itob encodes an ID so that records sort by ID.
+func itob(id uint) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// insert stores v under the next ID in the bucket, after setting id to it.
+func insert(tx *bbolt.Tx, bucket string, id *uint, v interface{}) error {
+	seq, err := tx.Bucket([]byte(bucket)).NextSequence()
+	if err != nil {
+		return err
+	}
+	*id = uint(seq)
+	return put(tx, bucket, *id, v)
+}
+
+// put stores v under id in the bucket, replacing any existing record.
+func put(tx *bbolt.Tx, bucket string, id uint, v interface{}) error {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(bucket)).Put(itob(id), buf.Bytes())
+}
+
+func decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func remove(tx *bbolt.Tx, bucket string, id uint) error {
+	return tx.Bucket([]byte(bucket)).Delete(itob(id))
+}
+
+// each decodes every record in the bucket in ID order, using v to get a
+// new value to decode into, and calls fn with it.
+func each(tx *bbolt.Tx, bucket string, v func() interface{}, fn func(interface{})) error {
+	return tx.Bucket([]byte(bucket)).ForEach(func(k, data []byte) error {
+		out := v()
+		err := decode(data, out)
+		if err != nil {
+			return err
+		}
+		fn(out)
+		return nil
+	})
+}
+
+// window returns the bounds of the page of n results starting at pos.
+func window(total, pos, n int) (lo, hi int) {
+	if pos > total {
+		pos = total
+	}
+	hi = total
+	if n >= 0 && pos+n < total {
+		hi = pos + n
+	}
+	return pos, hi
+}
+
+func findSecrets(tx *bbolt.Tx, match func(*secrets.Secret) bool) (res []secrets.Secret, err error) {
+	err = each(tx, secretsBucket, func() interface{} { return new(secrets.Secret) }, func(v interface{}) {
+		if s := v.(*secrets.Secret); match(s) {
+			res = append(res, *s)
+		}
+	})
+	return
+}
+
+func findKeys(tx *bbolt.Tx, match func(*secrets.Key) bool) (res []secrets.Key, err error) {
+	err = each(tx, keysBucket, func() interface{} { return new(secrets.Key) }, func(v interface{}) {
+		if k := v.(*secrets.Key); match(k) {
+			res = append(res, *k)
+		}
+	})
+	return
+}
+
+func findPolicies(tx *bbolt.Tx, match func(*acl.Policy) bool) (res []acl.Policy, err error) {
+	err = each(tx, policiesBucket, func() interface{} { return new(acl.Policy) }, func(v interface{}) {
+		if p := v.(*acl.Policy); match(p) {
+			res = append(res, *p)
+		}
+	})
+	return
+}
+
+func findRules(tx *bbolt.Tx, match func(*acl.Rule) bool) (res []acl.Rule, err error) {
+	err = each(tx, rulesBucket, func() interface{} { return new(acl.Rule) }, func(v interface{}) {
+		if r := v.(*acl.Rule); match(r) {
+			res = append(res, *r)
+		}
+	})
+	return
+}
+
+func findKeyPolicies(tx *bbolt.Tx, match func(*acl.KeyPolicy) bool) (res []acl.KeyPolicy, err error) {
+	err = each(tx, keyPoliciesBucket, func() interface{} { return new(acl.KeyPolicy) }, func(v interface{}) {
+		if l := v.(*acl.KeyPolicy); match(l) {
+			res = append(res, *l)
+		}
+	})
+	return
+}
+
+func findGroups(tx *bbolt.Tx, match func(*secrets.Group) bool) (res []secrets.Group, err error) {
+	err = each(tx, groupsBucket, func() interface{} { return new(secrets.Group) }, func(v interface{}) {
+		if g := v.(*secrets.Group); match(g) {
+			res = append(res, *g)
+		}
+	})
+	return
+}
+
+func findGroupMembers(tx *bbolt.Tx, match func(*secrets.GroupMember) bool) (res []secrets.GroupMember, err error) {
+	err = each(tx, groupMembersBucket, func() interface{} { return new(secrets.GroupMember) }, func(v interface{}) {
+		if l := v.(*secrets.GroupMember); match(l) {
+			res = append(res, *l)
+		}
+	})
+	return
+}
+
+func findGroupSecrets(tx *bbolt.Tx, match func(*secrets.GroupSecret) bool) (res []secrets.GroupSecret, err error) {
+	err = each(tx, groupSecretsBucket, func() interface{} { return new(secrets.GroupSecret) }, func(v interface{}) {
+		if l := v.(*secrets.GroupSecret); match(l) {
+			res = append(res, *l)
+		}
+	})
+	return
+}
+
+func findStats(tx *bbolt.Tx, match func(*secrets.Stats) bool) (res []secrets.Stats, err error) {
+	err = each(tx, statsBucket, func() interface{} { return new(secrets.Stats) }, func(v interface{}) {
+		if st := v.(*secrets.Stats); match(st) {
+			res = append(res, *st)
+		}
+	})
+	return
+}
+
+func findAuditEvents(tx *bbolt.Tx, match func(*audit.Event) bool) (res []audit.Event, err error) {
+	err = each(tx, auditBucket, func() interface{} { return new(audit.Event) }, func(v interface{}) {
+		if e := v.(*audit.Event); match(e) {
+			res = append(res, *e)
+		}
+	})
+	return
+}
@@ -0,0 +1,126 @@
+package bolt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// RecordView counts a view of s by k in the stats for both.
+func (b *DB) RecordView(s *secrets.Secret, k *secrets.Key) (err error) {
+	now := time.Now().UTC()
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := addView(tx, &secrets.Stats{
+			Namespace: ns(s.Namespace), Type: secrets.SecretStats, Name: s.Name}, k.Name, now)
+		if err != nil {
+			return err
+		}
+
+		return addView(tx, &secrets.Stats{
+			Namespace: ns(k.Namespace), Type: secrets.KeyStats, Name: k.Name}, s.Name, now)
+	})
+}
+
+func addView(tx *bbolt.Tx, st *secrets.Stats, peer string, now time.Time) error {
+	err := getStats(tx, st)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	st.Views++
+	st.LastViewed = &now
+	st.LastPeer = peer
+
+	if st.ID == 0 {
+		return insert(tx, statsBucket, &st.ID, st)
+	}
+	return put(tx, statsBucket, st.ID, st)
+}
+
+// GetStats selects the stats for a secret or key by type and name.
+// It returns gorm.ErrRecordNotFound if it has never been viewed.
+func (b *DB) GetStats(st *secrets.Stats) error {
+	st.Namespace = ns(st.Namespace)
+
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return getStats(tx, st)
+	})
+}
+
+// ListStats selects the stats for the secrets or keys of one type with
+// the given names.  Names which have never been viewed are left out.
+func (b *DB) ListStats(namespace, typ string, names []string) (res []secrets.Stats, err error) {
+	namespace = ns(namespace)
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		res, err = findStats(tx, func(e *secrets.Stats) bool {
+			return e.Namespace == namespace && e.Type == typ && wanted[e.Name]
+		})
+		return err
+	})
+	return
+}
+
+// AddStats inserts stats as they are, rather than counting a view.
+func (b *DB) AddStats(st *secrets.Stats) error {
+	st.Namespace = ns(st.Namespace)
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := getStats(tx, &secrets.Stats{Namespace: st.Namespace, Type: st.Type, Name: st.Name})
+		switch err {
+
+		case nil:
+			return errors.New("Stats already exist")
+
+		case gorm.ErrRecordNotFound:
+			break
+
+		default:
+			return err
+
+		}
+
+		st.ID = 0
+		return insert(tx, statsBucket, &st.ID, st)
+	})
+}
+
+func getStats(tx *bbolt.Tx, st *secrets.Stats) error {
+	found, err := findStats(tx, func(e *secrets.Stats) bool {
+		return e.Namespace == st.Namespace && e.Type == st.Type && e.Name == st.Name
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	*st = found[0]
+	return nil
+}
+
+func deleteStats(tx *bbolt.Tx, namespace, typ, name string) error {
+	st := &secrets.Stats{Namespace: namespace, Type: typ, Name: name}
+	err := getStats(tx, st)
+	switch err {
+
+	case nil:
+		return remove(tx, statsBucket, st.ID)
+
+	case gorm.ErrRecordNotFound:
+		return nil
+
+	default:
+		return err
+
+	}
+}
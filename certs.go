@@ -0,0 +1,196 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nutmegdevelopment/nutcracker/client"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// serverCerts holds the certificate served by the HTTPS listener.
+var serverCerts = new(certStore)
+
+// certStore holds the certificate served to clients, so that it can be
+// replaced without restarting the listener.  When the certificate comes
+// from the vault it can be re-read, and a replacement is only used if it
+// passes verifyCert.
+type certStore struct {
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	source TLSConfig
+	// The config the listener started with.  Every certificate must
+	// suit its policy.
+	config TLSConfig
+
+	// Serialises loads
+	loading sync.Mutex
+}
+
+// Get returns the current certificate.
+func (s *certStore) Get() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// Set replaces the certificate for new connections.
+func (s *certStore) Set(cert *tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.Get()
+	if cert == nil {
+		return nil, errors.New("No certificate loaded")
+	}
+	return cert, nil
+}
+
+// watches reports whether a change to the named secret is a change to the
+// certificate.
+func (s *certStore) watches(namespace, name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if namespace == "" {
+		namespace = secrets.DefaultNamespace
+	}
+	return s.source.CertName != "" && name == s.source.CertName &&
+		namespace == secrets.DefaultNamespace
+}
+
+// current returns where the certificate being served came from.
+func (s *certStore) current() TLSConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.source
+}
+
+// load reads the certificate described by src, a new self-signed one if
+// it does not name a vault secret, and uses it if it is valid.  Otherwise
+// the current certificate is kept.
+func (s *certStore) load(src TLSConfig) error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+
+	cert, err := loadCert(src)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	policy, current := s.config, s.cert
+	s.mu.RUnlock()
+
+	leaf, err := verifyCert(&cert, policy, time.Now())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.source = src
+	s.mu.Unlock()
+
+	if current == nil || !bytes.Equal(current.Certificate[0], cert.Certificate[0]) {
+		log.Infof("Serving TLS certificate %s, valid until %s, SHA-256 fingerprint %s",
+			leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339), client.Fingerprint(leaf.Raw))
+	}
+
+	// Every load parses a new copy of the key, so nothing else holds the
+	// old one.
+	if current != nil {
+		zeroPrivateKey(current.PrivateKey)
+	}
+	return nil
+}
+
+// Reload re-reads the certificate from the vault or files.  It does
+// nothing for a generated certificate.
+func (s *certStore) Reload() error {
+	src := s.current()
+	if !src.configured() {
+		return nil
+	}
+	return s.load(src)
+}
+
+// reloadEvery calls Reload every interval, until stop is closed.
+func (s *certStore) reloadEvery(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+
+		case <-t.C:
+			err := s.Reload()
+			if err != nil {
+				log.Error("TLS certificate not reloaded: ", err)
+			}
+
+		case <-stop:
+			return
+
+		}
+	}
+}
+
+// certExpiryWarning is how long before a certificate expires to start
+// warning about it.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// verifyCert checks that a certificate can be served under the policy:
+// the private key must match the leaf, and every certificate in the chain
+// must be valid now and signed by the next.  It returns the leaf.
+func verifyCert(cert *tls.Certificate, policy TLSConfig, now time.Time) (*x509.Certificate, error) {
+	err := policy.checkCert(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := make([]*x509.Certificate, len(cert.Certificate))
+	for i := range cert.Certificate {
+		chain[i], err = x509.ParseCertificate(cert.Certificate[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TLS cert: %s", err)
+		}
+	}
+	leaf := chain[0]
+
+	if !keyMatches(leaf, cert.PrivateKey) {
+		return nil, errors.New("TLS private key does not match the certificate")
+	}
+
+	for i, c := range chain {
+		if now.After(c.NotAfter) {
+			return nil, fmt.Errorf("TLS cert %q expired at %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(c.NotBefore) {
+			return nil, fmt.Errorf("TLS cert %q is not valid until %s", c.Subject.CommonName, c.NotBefore.Format(time.RFC3339))
+		}
+		if i+1 < len(chain) {
+			if err := c.CheckSignatureFrom(chain[i+1]); err != nil {
+				return nil, fmt.Errorf("TLS cert %q is not signed by %q: %s",
+					c.Subject.CommonName, chain[i+1].Subject.CommonName, err)
+			}
+		}
+	}
+
+	if leaf.NotAfter.Sub(now) < certExpiryWarning {
+		log.Warnf("TLS cert %q expires at %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	cert.Leaf = leaf
+	return leaf, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nutmegdevelopment/nutcracker/db/mocks"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// certSecret returns a cert and key as stored in the vault.
+func certSecret(t *testing.T, cn string, notAfter time.Time) []byte {
+	key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+
+	return []byte(base64.StdEncoding.EncodeToString(data))
+}
+
+// vaultCert stores a cert secret in testDb, shared with a new key, and
+// returns the TLS config to read it with.
+func vaultCert(t *testing.T, testDb *mocks.DB, message []byte) (TLSConfig, *secrets.Secret) {
+	master, err := secrets.Initialise()
+	assert.Nil(t, err, "Should not return error")
+	assert.Nil(t, secrets.Unseal(master, master.Key.Display()), "Should unseal")
+
+	root, err := secrets.New("nutcracker-cert", message)
+	assert.Nil(t, err, "Should not return error")
+
+	key := new(secrets.Key)
+	assert.Nil(t, key.New("cert-key"))
+	priv := base64.StdEncoding.EncodeToString(key.Display())
+
+	shared, err := root.Share(key)
+	assert.Nil(t, err, "Should not return error")
+
+	testDb.On("GetSharedSecret", mock.AnythingOfType("*secrets.Secret"), mock.AnythingOfType("*secrets.Key")).Run(
+		func(args mock.Arguments) {
+			*args.Get(0).(*secrets.Secret) = *shared
+		}).Return(nil)
+
+	testDb.On("GetRootSecret", mock.AnythingOfType("*secrets.Secret")).Run(func(args mock.Arguments) {
+		*args.Get(0).(*secrets.Secret) = *root
+	}).Return(nil)
+
+	c := defaultTLSConfig()
+	c.CertName, c.CertID, c.CertKey = "nutcracker-cert", "cert-key", priv
+	return c, root
+}
+
+func servedCN(s *certStore) string {
+	cert, err := s.GetCertificate(nil)
+	if err != nil {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	testDb := new(mocks.DB)
+	defer useDatabase(testDb)()
+
+	src, root := vaultCert(t, testDb, certSecret(t, "first", time.Now().Add(time.Hour)))
+
+	s := &certStore{config: defaultTLSConfig()}
+	assert.Nil(t, s.load(src))
+	assert.Equal(t, "first", servedCN(s))
+	assert.True(t, s.watches("", "nutcracker-cert"))
+	assert.False(t, s.watches("other", "nutcracker-cert"))
+	assert.False(t, s.watches("default", "other"))
+
+	first := s.Get()
+	assert.Nil(t, root.Update(certSecret(t, "second", time.Now().Add(time.Hour))))
+	assert.Nil(t, s.Reload())
+	assert.Equal(t, "second", servedCN(s))
+	assert.Equal(t, 0, first.PrivateKey.(*ecdsa.PrivateKey).D.Sign(), "The old key should be wiped")
+
+	// Bad certs are rejected, and the previous one kept
+	for name, message := range map[string][]byte{
+		"expired": certSecret(t, "expired", time.Now().Add(-time.Minute)),
+		"garbage": []byte("bm90IGEgY2VydA=="),
+	} {
+		assert.Nil(t, root.Update(message))
+		assert.NotNil(t, s.Reload(), name)
+		assert.Equal(t, "second", servedCN(s), name)
+	}
+
+	// Self-signed certs are never reloaded
+	s = &certStore{config: defaultTLSConfig()}
+	assert.Nil(t, s.load(defaultTLSConfig()))
+	cert := s.Get()
+	assert.Nil(t, s.Reload())
+	assert.Equal(t, cert, s.Get())
+	assert.False(t, s.watches("", "nutcracker-cert"))
+}
+
+func TestLegacyVaultCert(t *testing.T) {
+	defer useDatabase(database)()
+
+	// Older releases skipped a header in front of the base64 encoded cert
+	for name, header := range map[string]string{"binary": "\x00\x01\x02\x03\x04\x05\x06\x07", "base64": "legacy01"} {
+		testDb := new(mocks.DB)
+		database = testDb
+
+		message := append([]byte(header), certSecret(t, "legacy", time.Now().Add(time.Hour))...)
+		src, _ := vaultCert(t, testDb, message)
+
+		cert, err := GetNutcrackerCert(src)
+		assert.Nil(t, err, name)
+		s := &certStore{}
+		s.Set(&cert)
+		assert.Equal(t, "legacy", servedCN(s), name)
+	}
+
+	// Anything else is still refused
+	testDb := new(mocks.DB)
+	database = testDb
+	src, _ := vaultCert(t, testDb, []byte("bm90IGEgY2VydA=="))
+	_, err := GetNutcrackerCert(src)
+	assert.EqualError(t, err, "TLS cert nutcracker-cert is neither PEM nor base64 encoded PEM: No PEM data found")
+}
+
+func TestUpdateCert(t *testing.T) {
+	testDb := new(mocks.DB)
+	defer useDatabase(testDb)()
+
+	src, root := vaultCert(t, testDb, certSecret(t, "first", time.Now().Add(time.Hour)))
+
+	old := serverCerts
+	defer func() { serverCerts = old }()
+	serverCerts = &certStore{config: defaultTLSConfig()}
+	assert.Nil(t, serverCerts.load(src))
+
+	testDb.On("UpdateSecret", mock.AnythingOfType("*secrets.Secret")).Run(func(args mock.Arguments) {
+		*root = *args.Get(0).(*secrets.Secret)
+	}).Return(nil)
+
+	data, err := json.Marshal(request{
+		Name:    "nutcracker-cert",
+		Message: string(certSecret(t, "rotated", time.Now().Add(time.Hour))),
+	})
+	assert.Nil(t, err, "Should not return error")
+
+	r, err := http.NewRequest("POST", "/secrets/update", bytes.NewReader(data))
+	assert.Nil(t, err, "Should not return error")
+	authSetup(testDb, r, nil)
+
+	w := httptest.NewRecorder()
+	Update(w, r)
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, "rotated", servedCN(serverCerts))
+}
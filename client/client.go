@@ -0,0 +1,225 @@
+// Package client is a Go client for the nutcracker API.
+//
+// Servers using a self-signed certificate can be pinned by its SHA-256
+// fingerprint, which the server logs at startup and serves on
+// /fingerprint:
+//
+//	c := client.New("https://nutcracker:8443", id, key)
+//	err := c.Pin("AB:CD:...")
+//	message, err := c.View("app/db-password")
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrFingerprint is returned when the server certificate does not match
+// the pinned fingerprint.
+var ErrFingerprint = errors.New("Server certificate does not match the pinned fingerprint")
+
+// Error is a response from the server with an error status.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nutcracker: %d %s", e.Status, e.Message)
+}
+
+// Client makes authenticated requests to a nutcracker server.
+type Client struct {
+	// URL of the server, such as https://nutcracker:8443
+	URL string
+	// ID and Key are the credentials sent with each request.
+	ID  string
+	Key string
+	// Namespace to use.  The server default is used if it is empty.
+	Namespace string
+	HTTP      *http.Client
+}
+
+// New returns a client which verifies the server certificate against the
+// system roots.  Use Pin for a self-signed server.
+func New(server, id, key string) *Client {
+	return &Client{
+		URL:  strings.TrimRight(server, "/"),
+		ID:   id,
+		Key:  key,
+		HTTP: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Pin makes the client trust only a server whose certificate has the given
+// SHA-256 fingerprint, in place of checking it against the system roots.
+func (c *Client) Pin(fingerprint string) error {
+	cfg, err := PinnedConfig(fingerprint)
+	if err != nil {
+		return err
+	}
+	c.HTTP.Transport = &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   cfg,
+		ForceAttemptHTTP2: true,
+	}
+	return nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER certificate, in
+// the colon separated hex form used by the server and openssl.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return formatFingerprint(sum[:])
+}
+
+func formatFingerprint(sum []byte) string {
+	h := strings.ToUpper(hex.EncodeToString(sum))
+
+	parts := make([]string, len(sum))
+	for i := range parts {
+		parts[i] = h[2*i : 2*i+2]
+	}
+	return strings.Join(parts, ":")
+}
+
+// ParseFingerprint decodes a SHA-256 fingerprint in hex, with or without
+// colons.
+func ParseFingerprint(s string) ([]byte, error) {
+	s = strings.Replace(strings.TrimSpace(s), ":", "", -1)
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return nil, errors.New("Fingerprint must be a hex SHA-256 hash")
+	}
+	return b, nil
+}
+
+// PinnedConfig returns a TLS config which only accepts a server whose leaf
+// certificate has the given fingerprint.
+func PinnedConfig(fingerprint string) (*tls.Config, error) {
+	b, err := ParseFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	want := []byte(formatFingerprint(b))
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The chain is not checked, the fingerprint is instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return ErrFingerprint
+			}
+			got := []byte(Fingerprint(raw[0]))
+			if subtle.ConstantTimeCompare(got, want) != 1 {
+				return ErrFingerprint
+			}
+			return nil
+		},
+	}, nil
+}
+
+// ServerFingerprint asks the server for its certificate fingerprint.
+// Over an unpinned connection this is only trust on first use.
+func (c *Client) ServerFingerprint() (string, error) {
+	var res struct {
+		SHA256 string `json:"sha256"`
+	}
+	err := c.do("GET", "/fingerprint", nil, &res)
+	return res.SHA256, err
+}
+
+// View returns the decrypted contents of a secret shared with the key.
+func (c *Client) View(name string) ([]byte, error) {
+	var res []byte
+	err := c.do("POST", "/secrets/view", map[string]string{"Name": name}, &res)
+	return res, err
+}
+
+// Message stores a new secret.
+func (c *Client) Message(name, message string) error {
+	return c.do("POST", "/secrets/message", map[string]string{"Name": name, "Message": message}, nil)
+}
+
+// Update replaces the contents of a secret.
+func (c *Client) Update(name, message string) error {
+	return c.do("POST", "/secrets/update", map[string]string{"Name": name, "Message": message}, nil)
+}
+
+// Share shares a secret with another key.
+func (c *Client) Share(name, keyID string) error {
+	return c.do("POST", "/secrets/share", map[string]string{"Name": name, "KeyID": keyID}, nil)
+}
+
+// do sends a request, and decodes a JSON response into res.  A *[]byte
+// gets the body as it is.
+func (c *Client) do(method, path string, body interface{}, res interface{}) error {
+	u := c.URL + path
+	if c.Namespace != "" {
+		u += "?namespace=" + url.QueryEscape(c.Namespace)
+	}
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Secret-ID", c.ID)
+	req.Header.Set("X-Secret-Key", c.Key)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct{ Error string }
+		json.Unmarshal(out, &e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{Status: resp.StatusCode, Message: e.Error}
+	}
+
+	switch v := res.(type) {
+
+	case nil:
+		return nil
+
+	case *[]byte:
+		*v = out
+		return nil
+
+	default:
+		return json.Unmarshal(out, res)
+
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	fp := Fingerprint([]byte("cert"))
+	assert.Len(t, fp, 32*3-1)
+
+	b, err := ParseFingerprint(fp)
+	assert.Nil(t, err, "Should not return error")
+	assert.Len(t, b, 32)
+
+	// openssl style and bare lower case hex are the same
+	b2, err := ParseFingerprint(strings.ToLower(strings.Replace(fp, ":", "", -1)) + "\n")
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, b, b2)
+
+	_, err = ParseFingerprint("AB:CD")
+	assert.NotNil(t, err, "Short fingerprints should be rejected")
+}
+
+func TestPin(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Secret-ID") != "app" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"error": "Unauthorized"}`))
+			return
+		}
+
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Write([]byte(req["Name"] + " in " + r.URL.Query().Get("namespace")))
+	}))
+	defer server.Close()
+
+	fp := Fingerprint(server.Certificate().Raw)
+
+	c := New(server.URL+"/", "app", "key")
+	assert.Nil(t, c.Pin(fp))
+	c.Namespace = "team a"
+
+	res, err := c.View("db-password")
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, "db-password in team a", string(res))
+
+	c.ID = "other"
+	_, err = c.View("db-password")
+	assert.Equal(t, &Error{Status: 401, Message: "Unauthorized"}, err)
+
+	// A different certificate is refused
+	c = New(server.URL, "app", "key")
+	assert.Nil(t, c.Pin(Fingerprint([]byte("other"))))
+
+	_, err = c.View("db-password")
+	if assert.IsType(t, &url.Error{}, err) {
+		assert.Contains(t, err.Error(), ErrFingerprint.Error())
+	}
+
+	// Without a pin, the self-signed certificate is not trusted
+	c = New(server.URL, "app", "key")
+	_, err = c.View("db-password")
+	assert.NotNil(t, err, "Should return error")
+}
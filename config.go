@@ -0,0 +1,586 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/bolt"
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/lockout"
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/mysql"
+	"github.com/nutmegdevelopment/nutcracker/postgres"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// maxPageSize caps page_size, as each page is held in memory.
+const maxPageSize = 1000
+
+var (
+	configPath   string
+	flagCertID   string
+	flagKey      string
+	flagCert     string
+	flagCertFile string
+	flagKeyFile  string
+	flagDev      bool
+)
+
+func init() {
+	flag.StringVar(&configPath, "config", os.Getenv("CONFIG"), "Path of a YAML or JSON config file")
+	flag.StringVar(&flagCertID, "id", "", "ID to decrypt TLS cert")
+	flag.StringVar(&flagKey, "key", "", "Key to decrypt TLS cert")
+	flag.StringVar(&flagCert, "cert", "", "Name of TLS cert.  Will use a selfsigned cert if empty")
+	flag.StringVar(&flagCertFile, "cert-file", "", "Path of a PEM TLS cert chain, instead of one from the vault")
+	flag.StringVar(&flagKeyFile, "key-file", "", "Path of the PEM private key for -cert-file, if it is not in that file")
+	flag.BoolVar(&flagDev, "dev", false, "Run with an initialised and unsealed vault in memory, for development")
+}
+
+// Config is the server configuration.  It is built from the defaults, an
+// optional YAML or JSON file, the environment and the command line flags,
+// each overriding the one before.
+type Config struct {
+	Listen          string         `yaml:"listen"`
+	ListenHTTP      string         `yaml:"listen_http"`
+	LogLevel        string         `yaml:"log_level"`
+	ShutdownTimeout time.Duration  `yaml:"shutdown_timeout"`
+	PageSize        int            `yaml:"page_size"`
+	TLS             TLSConfig      `yaml:"tls"`
+	Database        DatabaseConfig `yaml:"database"`
+	Audit           AuditConfig    `yaml:"audit"`
+	Lockout         LockoutConfig  `yaml:"lockout"`
+	Policies        []PolicyConfig `yaml:"policies"`
+}
+
+// TLSConfig selects the certificate and the TLS policy.  If CertName is
+// empty a self-signed certificate is generated.
+type TLSConfig struct {
+	CertName string `yaml:"cert"`
+	CertID   string `yaml:"id"`
+	CertKey  string `yaml:"key"`
+	// A cert and key read from files instead of the vault.  The key may
+	// be in the cert file.
+	CertFile   string   `yaml:"cert_file"`
+	KeyFile    string   `yaml:"key_file"`
+	MinVersion string   `yaml:"min_version"`
+	MaxVersion string   `yaml:"max_version"`
+	Ciphers    []string `yaml:"ciphers"`
+	Curves     []string `yaml:"curves"`
+	HTTP2      bool     `yaml:"http2"`
+	// How often to re-read a cert from the vault.  0 turns it off.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	// Holds the key to the self-signed cert persisted in the vault.
+	SelfSignedKeyFile string `yaml:"self_signed_key_file"`
+}
+
+// DatabaseConfig selects the database backend.  For postgres, if URL is
+// empty the libpq env vars are used.  For mysql, URL is a DSN.  For bolt,
+// Path is the database file.
+type DatabaseConfig struct {
+	Driver         string `yaml:"driver"`
+	URL            string `yaml:"url"`
+	MaxConnections int    `yaml:"max_connections"`
+	Path           string `yaml:"path"`
+}
+
+// AuditConfig selects the audit sinks.
+type AuditConfig struct {
+	DB     bool   `yaml:"db"`
+	File   string `yaml:"file"`
+	Syslog bool   `yaml:"syslog"`
+}
+
+// LockoutConfig sets the limits on authentication failures.
+type LockoutConfig struct {
+	IP  LimitConfig `yaml:"ip"`
+	Key LimitConfig `yaml:"key"`
+}
+
+// LimitConfig locks out after Threshold failures, for Base doubling up to
+// Max.
+type LimitConfig struct {
+	Threshold int           `yaml:"threshold"`
+	Base      time.Duration `yaml:"base"`
+	Max       time.Duration `yaml:"max"`
+}
+
+// PolicyConfig is a policy kept in sync with the config file.
+type PolicyConfig struct {
+	Namespace string       `yaml:"namespace"`
+	Name      string       `yaml:"name"`
+	Rules     []RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig is a rule of a PolicyConfig.
+type RuleConfig struct {
+	Pattern      string           `yaml:"pattern"`
+	Capabilities acl.Capabilities `yaml:"capabilities"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:          "0.0.0.0:8443",
+		ListenHTTP:      "0.0.0.0:8080",
+		LogLevel:        "info",
+		ShutdownTimeout: 30 * time.Second,
+		PageSize:        10,
+		TLS:             defaultTLSConfig(),
+		Database: DatabaseConfig{
+			Driver:         "postgres",
+			MaxConnections: postgres.DefaultMaxConnections,
+		},
+		Audit: AuditConfig{DB: true},
+		// Sources are allowed more failures than keys, as many clients may
+		// share an address behind NAT.
+		Lockout: LockoutConfig{
+			IP:  LimitConfig{Threshold: 20, Base: time.Second, Max: 15 * time.Minute},
+			Key: LimitConfig{Threshold: 5, Base: time.Second, Max: 15 * time.Minute},
+		},
+	}
+}
+
+// readConfig builds and validates the configuration.
+func readConfig() (*Config, error) {
+	c := defaultConfig()
+
+	if configPath != "" {
+		err := c.loadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.loadEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	c.loadFlags()
+
+	return c, c.Validate()
+}
+
+// loadFile reads a YAML or JSON config file.  Unknown fields are an error,
+// so that typos are not silently ignored.
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	err = dec.Decode(c)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides the config with any env vars which are set.
+func (c *Config) loadEnv(getenv func(string) string) (err error) {
+	str := func(name string, v *string) {
+		if s := getenv(name); s != "" {
+			*v = s
+		}
+	}
+
+	list := func(name string, v *[]string) {
+		if s := getenv(name); s != "" {
+			*v = strings.Split(s, ",")
+		}
+	}
+
+	boolean := func(name string, v *bool) {
+		if s := getenv(name); s != "" && err == nil {
+			*v, err = strconv.ParseBool(s)
+			if err != nil {
+				err = fmt.Errorf("Invalid %s: %s", name, s)
+			}
+		}
+	}
+
+	integer := func(name string, v *int) {
+		if s := getenv(name); s != "" && err == nil {
+			*v, err = strconv.Atoi(s)
+			if err != nil {
+				err = fmt.Errorf("Invalid %s: %s", name, s)
+			}
+		}
+	}
+
+	duration := func(name string, v *time.Duration) {
+		if s := getenv(name); s != "" && err == nil {
+			*v, err = time.ParseDuration(s)
+			if err != nil {
+				err = fmt.Errorf("Invalid %s: %s", name, s)
+			}
+		}
+	}
+
+	str("LISTEN", &c.Listen)
+	str("LISTEN_HTTP", &c.ListenHTTP)
+	str("LOG_LEVEL", &c.LogLevel)
+	if getenv("DEBUG") == "true" {
+		c.LogLevel = "debug"
+	}
+	duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	integer("PAGE_SIZE", &c.PageSize)
+
+	str("CERT_NAME", &c.TLS.CertName)
+	str("CERT_ID", &c.TLS.CertID)
+	str("CERT_KEY", &c.TLS.CertKey)
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	str("TLS_MIN_VERSION", &c.TLS.MinVersion)
+	str("TLS_MAX_VERSION", &c.TLS.MaxVersion)
+	list("TLS_CIPHERS", &c.TLS.Ciphers)
+	list("TLS_CURVES", &c.TLS.Curves)
+	boolean("TLS_HTTP2", &c.TLS.HTTP2)
+	duration("TLS_RELOAD_INTERVAL", &c.TLS.ReloadInterval)
+	str("TLS_SELF_SIGNED_KEY_FILE", &c.TLS.SelfSignedKeyFile)
+
+	str("DB_DRIVER", &c.Database.Driver)
+	str("DATABASE_URL", &c.Database.URL)
+	integer("DB_MAX_CONNECTIONS", &c.Database.MaxConnections)
+	str("DB_PATH", &c.Database.Path)
+
+	boolean("AUDIT_DB", &c.Audit.DB)
+	str("AUDIT_FILE", &c.Audit.File)
+	boolean("AUDIT_SYSLOG", &c.Audit.Syslog)
+
+	return
+}
+
+// loadFlags overrides the config with any flags which are set.
+func (c *Config) loadFlags() {
+	if flagCert != "" {
+		c.TLS.CertName = flagCert
+	}
+	if flagCertID != "" {
+		c.TLS.CertID = flagCertID
+	}
+	if flagKey != "" {
+		c.TLS.CertKey = flagKey
+	}
+	if flagCertFile != "" {
+		c.TLS.CertFile = flagCertFile
+	}
+	if flagKeyFile != "" {
+		c.TLS.KeyFile = flagKeyFile
+	}
+	if flagDev {
+		// Nothing from a dev vault should outlive it.
+		c.Database.Driver = "memory"
+		c.TLS.SelfSignedKeyFile = ""
+	}
+}
+
+// Validate checks that the config is usable.
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("Invalid listen address: %s", c.Listen)
+	}
+	if _, _, err := net.SplitHostPort(c.ListenHTTP); err != nil {
+		return fmt.Errorf("Invalid listen_http address: %s", c.ListenHTTP)
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("Invalid log_level: %s", c.LogLevel)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if c.PageSize < 1 || c.PageSize > maxPageSize {
+		return fmt.Errorf("page_size must be between 1 and %d", maxPageSize)
+	}
+	if err := c.Database.validate(); err != nil {
+		return err
+	}
+
+	if _, err := c.TLS.config(); err != nil {
+		return err
+	}
+	if c.TLS.ReloadInterval < 0 {
+		return errors.New("tls.reload_interval must not be negative")
+	}
+	if c.TLS.CertName != "" && c.TLS.CertFile != "" {
+		return errors.New("Use either a TLS cert from the vault or cert_file, not both")
+	}
+	if c.TLS.KeyFile != "" && c.TLS.CertFile == "" {
+		return errors.New("tls.key_file needs tls.cert_file")
+	}
+	if c.TLS.CertName != "" {
+		if c.TLS.CertID == "" || c.TLS.CertKey == "" {
+			return errors.New("A TLS cert from the vault needs an id and key")
+		}
+		if _, err := base64.StdEncoding.DecodeString(c.TLS.CertKey); err != nil {
+			return errors.New("TLS cert key must be base64 encoded")
+		}
+	}
+
+	for name, l := range map[string]LimitConfig{"ip": c.Lockout.IP, "key": c.Lockout.Key} {
+		if l.Threshold < 1 || l.Base <= 0 || l.Max < l.Base {
+			return fmt.Errorf("Invalid %s lockout: threshold must be at least 1 and 0 < base <= max", name)
+		}
+	}
+
+	for _, p := range c.Policies {
+		if err := p.policy().Validate(); err != nil {
+			return fmt.Errorf("Policy %s: %s", p.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (d DatabaseConfig) validate() error {
+	switch d.Driver {
+
+	case "postgres", "mysql":
+		if d.MaxConnections < 1 {
+			return errors.New("max_connections must be at least 1")
+		}
+		if d.Driver == "mysql" && d.URL == "" {
+			return errors.New("The mysql database needs a url")
+		}
+
+	case "bolt":
+		if d.Path == "" {
+			return errors.New("The bolt database needs a path")
+		}
+
+	case "memory":
+		break
+
+	default:
+		return fmt.Errorf("Unknown database driver: %s", d.Driver)
+
+	}
+	return nil
+}
+
+func (d DatabaseConfig) open() db.DB {
+	switch d.Driver {
+
+	case "bolt":
+		return &bolt.DB{Path: d.Path}
+
+	case "memory":
+		return new(memory.DB)
+
+	case "mysql":
+		return &mysql.DB{URL: d.URL, MaxConnections: d.MaxConnections}
+
+	default:
+		return &postgres.DB{URL: d.URL, MaxConnections: d.MaxConnections}
+
+	}
+}
+
+func (l LimitConfig) tracker() *lockout.Tracker {
+	return lockout.New(l.Threshold, l.Base, l.Max)
+}
+
+func (l LimitConfig) apply(t *lockout.Tracker) {
+	t.Configure(l.Threshold, l.Base, l.Max)
+}
+
+func (p PolicyConfig) policy() *acl.Policy {
+	pol := &acl.Policy{Namespace: p.Namespace, Name: p.Name}
+	if pol.Namespace == "" {
+		pol.Namespace = secrets.DefaultNamespace
+	}
+	for _, r := range p.Rules {
+		pol.Rules = append(pol.Rules, acl.Rule{Pattern: r.Pattern, Capabilities: r.Capabilities})
+	}
+	return pol
+}
+
+// apply sets the parts of the config which are held in globals and can
+// change while the server is running.
+func (c *Config) apply() {
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+
+	c.Lockout.IP.apply(ipLockout)
+	c.Lockout.Key.apply(keyLockout)
+}
+
+// restartField is a setting which can only change on a restart.  New and
+// old hold pointers to its parts in two configs.
+type restartField struct {
+	name     string
+	new, old []interface{}
+}
+
+// restartFields pairs up the settings in c and old which can only change
+// on a restart.
+func (c *Config) restartFields(old *Config) []restartField {
+	return []restartField{
+		{"listen", []interface{}{&c.Listen}, []interface{}{&old.Listen}},
+		{"listen_http", []interface{}{&c.ListenHTTP}, []interface{}{&old.ListenHTTP}},
+		{"page_size", []interface{}{&c.PageSize}, []interface{}{&old.PageSize}},
+		{"tls policy", []interface{}{&c.TLS.MinVersion, &c.TLS.MaxVersion, &c.TLS.Ciphers, &c.TLS.Curves, &c.TLS.HTTP2},
+			[]interface{}{&old.TLS.MinVersion, &old.TLS.MaxVersion, &old.TLS.Ciphers, &old.TLS.Curves, &old.TLS.HTTP2}},
+		{"tls.reload_interval", []interface{}{&c.TLS.ReloadInterval}, []interface{}{&old.TLS.ReloadInterval}},
+		{"tls.self_signed_key_file", []interface{}{&c.TLS.SelfSignedKeyFile}, []interface{}{&old.TLS.SelfSignedKeyFile}},
+		{"database", []interface{}{&c.Database}, []interface{}{&old.Database}},
+		{"audit", []interface{}{&c.Audit}, []interface{}{&old.Audit}},
+	}
+}
+
+// restartNeeded lists the settings which differ from old but can only
+// change on a restart.
+func (c *Config) restartNeeded(old *Config) (names []string) {
+	for _, f := range c.restartFields(old) {
+		if !reflect.DeepEqual(f.new, f.old) {
+			names = append(names, f.name)
+		}
+	}
+	return
+}
+
+// keepRunning sets the settings which can only change on a restart back
+// to their values in old, so that c describes the running server and the
+// next reload still warns about them.
+func (c *Config) keepRunning(old *Config) {
+	for _, f := range c.restartFields(old) {
+		for i := range f.new {
+			reflect.ValueOf(f.new[i]).Elem().Set(reflect.ValueOf(f.old[i]).Elem())
+		}
+	}
+}
+
+// syncPolicies creates the policies in the config, and updates the rules
+// of any which have changed.  Policies removed from the config are left in
+// the database.  If it fails, the policies are put back as they were, and
+// otherwise undo does so.
+func syncPolicies(policies []PolicyConfig) (undo func() error, err error) {
+	var undos []func() error
+	undo = func() (err error) {
+		for i := len(undos) - 1; i >= 0; i-- {
+			if e := undos[i](); e != nil && err == nil {
+				err = e
+			}
+		}
+		return
+	}
+
+	for _, pc := range policies {
+		p := pc.policy()
+		existing := &acl.Policy{Namespace: p.Namespace, Name: p.Name}
+
+		err := database.GetPolicy(existing)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			err = database.AddPolicy(p)
+			if err == nil {
+				log.Info("Policy added from config: ", p.Name)
+				undos = append(undos, func() error {
+					return database.DeletePolicy(&acl.Policy{Namespace: p.Namespace, Name: p.Name})
+				})
+			}
+
+		case nil:
+			if sameRules(existing.Rules, p.Rules) {
+				continue
+			}
+			err = database.UpdatePolicy(p)
+			if err == nil {
+				log.Info("Policy updated from config: ", p.Name)
+				undos = append(undos, func() error {
+					return database.UpdatePolicy(existing)
+				})
+			}
+
+		}
+
+		if err != nil {
+			if err := undo(); err != nil {
+				log.Error("Cannot restore the previous policies: ", err)
+			}
+			return nil, fmt.Errorf("Policy %s: %s", p.Name, err)
+		}
+	}
+	return undo, nil
+}
+
+func sameRules(a, b []acl.Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Pattern != b[i].Pattern || !reflect.DeepEqual(a[i].Capabilities, b[i].Capabilities) {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyReload returns a channel which receives SIGHUP.
+func notifyReload() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch
+}
+
+// reload re-reads the config and applies the settings which can change
+// without a restart: the log level, lockout limits, TLS certificate and
+// policies.  If the new config is invalid, or the certificate cannot be
+// loaded, nothing changes and the old config is returned.  Otherwise the
+// new config is returned, with the settings which need a restart left as
+// they are running.
+func reload(old *Config, certs *certStore) (*Config, error) {
+	c, err := readConfig()
+	if err != nil {
+		return old, err
+	}
+
+	// Policies are synced before anything else changes, so that a failure
+	// leaves the old settings in place.
+	undo, err := syncPolicies(c.Policies)
+	if err != nil {
+		return old, err
+	}
+
+	if c.TLS.configured() {
+		err = certs.load(c.TLS)
+		if err != nil {
+			if err := undo(); err != nil {
+				log.Error("Cannot restore the previous policies: ", err)
+			}
+			return old, err
+		}
+	} else if old.TLS.configured() {
+		log.Warn("Keeping the configured certificate until the next restart")
+		c.TLS.CertName, c.TLS.CertID, c.TLS.CertKey = old.TLS.CertName, old.TLS.CertID, old.TLS.CertKey
+		c.TLS.CertFile, c.TLS.KeyFile = old.TLS.CertFile, old.TLS.KeyFile
+	}
+
+	for _, name := range c.restartNeeded(old) {
+		log.Warnf("Changing %s needs a restart", name)
+	}
+	c.keepRunning(old)
+
+	c.apply()
+	return c, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/db/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func writeConfig(t *testing.T, data string) func() {
+	dir, err := ioutil.TempDir("", "nutcracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath = filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(configPath, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		configPath = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer writeConfig(t, `
+listen: 127.0.0.1:9443
+log_level: warn
+page_size: 50
+tls:
+  cert: nutcracker-cert
+  id: cert-key
+  key: Zm9v
+database:
+  max_connections: 5
+lockout:
+  key:
+    threshold: 3
+    base: 2s
+    max: 1m
+`)()
+
+	c, err := readConfig()
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, "127.0.0.1:9443", c.Listen)
+	assert.Equal(t, "0.0.0.0:8080", c.ListenHTTP, "Defaults should be kept")
+	assert.Equal(t, 50, c.PageSize)
+	assert.Equal(t, "nutcracker-cert", c.TLS.CertName)
+	assert.Equal(t, 5, c.Database.MaxConnections)
+	assert.Equal(t, LimitConfig{3, 2 * time.Second, time.Minute}, c.Lockout.Key)
+	assert.Equal(t, 20, c.Lockout.IP.Threshold, "Defaults should be kept")
+
+	// The environment overrides the file, and flags override both
+	env := map[string]string{
+		"LISTEN":    "127.0.0.1:10443",
+		"DEBUG":     "true",
+		"AUDIT_DB":  "false",
+		"CERT_NAME": "other-cert",
+	}
+	assert.Nil(t, c.loadEnv(func(k string) string { return env[k] }))
+	assert.Equal(t, "127.0.0.1:10443", c.Listen)
+	assert.Equal(t, "debug", c.LogLevel)
+	assert.False(t, c.Audit.DB)
+	assert.Equal(t, "other-cert", c.TLS.CertName)
+
+	flagCert = "flag-cert"
+	c.loadFlags()
+	flagCert = ""
+	assert.Equal(t, "flag-cert", c.TLS.CertName)
+
+	env = map[string]string{"PAGE_SIZE": "lots"}
+	assert.EqualError(t, c.loadEnv(func(k string) string { return env[k] }), "Invalid PAGE_SIZE: lots")
+
+	// JSON works too, but unknown fields do not
+	defer writeConfig(t, `{"listen": "127.0.0.1:9443", "page_size": 20}`)()
+	c, err = readConfig()
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, 20, c.PageSize)
+
+	defer writeConfig(t, `pagesize: 20`)()
+	_, err = readConfig()
+	assert.NotNil(t, err, "Unknown fields should be rejected")
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, edit := range map[string]func(*Config){
+		"listen":    func(c *Config) { c.Listen = "nowhere" },
+		"log level": func(c *Config) { c.LogLevel = "loud" },
+		"page size": func(c *Config) { c.PageSize = 0 },
+		"pool":      func(c *Config) { c.Database.MaxConnections = 0 },
+		"driver":    func(c *Config) { c.Database.Driver = "sqlite" },
+		"bolt path": func(c *Config) { c.Database.Driver = "bolt" },
+		"mysql url": func(c *Config) { c.Database.Driver = "mysql" },
+		"cipher":    func(c *Config) { c.TLS.Ciphers = []string{"TLS_RSA_WITH_RC4_128_SHA"} },
+		"cert key":  func(c *Config) { c.TLS.CertName = "cert" },
+		"cert both": func(c *Config) { c.TLS.CertName, c.TLS.CertKey, c.TLS.CertFile = "cert", "key", "cert.pem" },
+		"key file":  func(c *Config) { c.TLS.KeyFile = "key.pem" },
+		"lockout":   func(c *Config) { c.Lockout.IP.Max = 0 },
+		"policy":    func(c *Config) { c.Policies = []PolicyConfig{{Name: "empty"}} },
+	} {
+		c := defaultConfig()
+		assert.Nil(t, c.Validate(), "Defaults should be valid")
+		edit(c)
+		assert.NotNil(t, c.Validate(), name)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	policies := []PolicyConfig{
+		{Name: "new", Rules: []RuleConfig{{Pattern: "app/*", Capabilities: acl.Capabilities{acl.Read}}}},
+		{Name: "same", Rules: []RuleConfig{{Pattern: "*", Capabilities: acl.Capabilities{acl.List}}}},
+		{Name: "changed", Rules: []RuleConfig{{Pattern: "*", Capabilities: acl.Capabilities{acl.Read}}}},
+	}
+
+	testDb := new(mocks.DB)
+	testDb.On("GetPolicy", &acl.Policy{Namespace: "default", Name: "new"}).Return(gorm.ErrRecordNotFound)
+	testDb.On("GetPolicy", &acl.Policy{Namespace: "default", Name: "same"}).Return(func(p *acl.Policy) error {
+		p.Rules = []acl.Rule{{ID: 1, Pattern: "*", Capabilities: acl.Capabilities{acl.List}}}
+		return nil
+	})
+	testDb.On("GetPolicy", &acl.Policy{Namespace: "default", Name: "changed"}).Return(func(p *acl.Policy) error {
+		p.Rules = []acl.Rule{{ID: 2, Pattern: "*", Capabilities: acl.Capabilities{acl.List}}}
+		return nil
+	})
+	testDb.On("AddPolicy", mock.AnythingOfType("*acl.Policy")).Return(nil)
+	testDb.On("UpdatePolicy", mock.AnythingOfType("*acl.Policy")).Return(nil).Once()
+	defer useDatabase(testDb)()
+
+	undo, err := syncPolicies(policies)
+	assert.Nil(t, err)
+
+	testDb.AssertNumberOfCalls(t, "AddPolicy", 1)
+	testDb.AssertNumberOfCalls(t, "UpdatePolicy", 1)
+	assert.Equal(t, "new", testDb.Calls[1].Arguments.Get(0).(*acl.Policy).Name)
+
+	// Undoing removes the new policy and puts back the old rules
+	testDb.On("DeletePolicy", &acl.Policy{Namespace: "default", Name: "new"}).Return(nil)
+	testDb.On("UpdatePolicy", mock.AnythingOfType("*acl.Policy")).Return(nil).Once()
+	assert.Nil(t, undo())
+
+	testDb.AssertCalled(t, "DeletePolicy", &acl.Policy{Namespace: "default", Name: "new"})
+	restored := testDb.Calls[len(testDb.Calls)-2].Arguments.Get(0).(*acl.Policy)
+	assert.Equal(t, "changed", restored.Name)
+	assert.Equal(t, acl.Capabilities{acl.List}, restored.Rules[0].Capabilities)
+
+	// A failure part way through undoes what was done before it
+	testDb.On("UpdatePolicy", mock.AnythingOfType("*acl.Policy")).Return(errors.New("connection lost")).Once()
+	_, err = syncPolicies(policies)
+	assert.EqualError(t, err, "Policy changed: connection lost")
+	testDb.AssertNumberOfCalls(t, "DeletePolicy", 2)
+}
+
+func TestReload(t *testing.T) {
+	defer writeConfig(t, `
+listen: 127.0.0.1:9443
+log_level: info
+`)()
+	defer defaultConfig().apply()
+
+	old, err := readConfig()
+	assert.Nil(t, err, "Should not return error")
+
+	cert, err := GenCert()
+	assert.Nil(t, err, "Should not return error")
+	certs := new(certStore)
+	certs.Set(&cert)
+
+	ioutil.WriteFile(configPath, []byte(`
+listen: 127.0.0.1:9443
+log_level: error
+lockout:
+  ip:
+    threshold: 2
+    base: 1s
+    max: 1m
+`), 0600)
+
+	c, err := reload(old, certs)
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, "error", c.LogLevel)
+	assert.Equal(t, log.ErrorLevel, log.GetLevel())
+	assert.Equal(t, 2, ipLockout.Threshold)
+	assert.Equal(t, &cert, certs.Get(), "Self-signed cert should be kept")
+
+	// Settings which need a restart keep their running values, so that
+	// the next reload still warns about them
+	ioutil.WriteFile(configPath, []byte(`
+listen: 127.0.0.1:9444
+log_level: error
+`), 0600)
+
+	c, err = reload(c, certs)
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, "127.0.0.1:9443", c.Listen)
+	next, err := readConfig()
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, []string{"listen"}, next.restartNeeded(c))
+
+	// A bad config changes nothing
+	ioutil.WriteFile(configPath, []byte(`log_level: loud`), 0600)
+
+	c, err = reload(c, certs)
+	assert.NotNil(t, err, "Should return error")
+	assert.Equal(t, "error", c.LogLevel)
+	assert.Equal(t, log.ErrorLevel, log.GetLevel())
+
+	// Neither does a policy which cannot be stored
+	testDb := new(mocks.DB)
+	testDb.On("GetPolicy", mock.AnythingOfType("*acl.Policy")).Return(errors.New("connection lost"))
+	defer useDatabase(testDb)()
+
+	ioutil.WriteFile(configPath, []byte(`
+listen: 127.0.0.1:9443
+log_level: debug
+policies:
+  - name: readers
+    rules:
+      - pattern: "*"
+        capabilities: [read]
+`), 0600)
+
+	prev := c
+	c, err = reload(c, certs)
+	assert.NotNil(t, err, "Should return error")
+	assert.Equal(t, prev, c, "The previous config should be returned")
+	assert.Equal(t, log.ErrorLevel, log.GetLevel())
+
+	// A cert which cannot be loaded removes the policies it added
+	testDb = new(mocks.DB)
+	testDb.On("GetPolicy", mock.AnythingOfType("*acl.Policy")).Return(gorm.ErrRecordNotFound)
+	testDb.On("AddPolicy", mock.AnythingOfType("*acl.Policy")).Return(nil)
+	testDb.On("DeletePolicy", &acl.Policy{Namespace: "default", Name: "readers"}).Return(nil)
+	database = testDb
+
+	ioutil.WriteFile(configPath, []byte(`
+listen: 127.0.0.1:9443
+log_level: debug
+tls:
+  cert_file: /nonexistent/cert.pem
+policies:
+  - name: readers
+    rules:
+      - pattern: "*"
+        capabilities: [read]
+`), 0600)
+
+	c, err = reload(c, certs)
+	assert.NotNil(t, err, "Should return error")
+	assert.Equal(t, prev, c, "The previous config should be returned")
+	assert.Equal(t, &cert, certs.Get(), "The cert should be kept")
+	testDb.AssertExpectations(t)
+}
@@ -1,10 +1,23 @@
 package db
 
 import (
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
 	"github.com/nutmegdevelopment/nutcracker/secrets"
 )
 
 // DB is a generic database interface.
+// Secrets, keys and policies belong to a namespace, and names are only
+// unique within it.  Implementations treat an empty namespace as
+// secrets.DefaultNamespace.
+// RecordView updates the stats for both the secret and the key.
+// ListStats returns the stats for several secrets or keys of one type at
+// once, leaving out those which have never been viewed.  AddStats stores
+// stats as they are, for loading an export.
+// Namespaces lists every namespace holding a secret, key, policy or
+// group, in order.
+// Audit events are append only.  GetLastAuditEvent leaves the event
+// empty, without an error, if none have been stored.
 type DB interface {
 	Connect() error
 	AddSecret(*secrets.Secret) error
@@ -12,11 +25,44 @@ type DB interface {
 	GetKey(*secrets.Key) error
 	GetRootSecret(*secrets.Secret) error
 	GetSharedSecret(*secrets.Secret, *secrets.Key) error
-	ListSecrets(*string) func(int) ([]secrets.Secret, error)
-	ListKeys(*string) func(int) ([]secrets.Key, error)
+	ListSecrets(string, *string, string) func(int) ([]secrets.Secret, error)
+	ListKeys(string, *string) func(int) ([]secrets.Key, error)
 	DeleteSecret(*secrets.Secret) error
+	DeleteSharedSecret(*secrets.Secret, *secrets.Key) error
 	DeleteKey(*secrets.Key) error
 	UpdateSecret(*secrets.Secret) error
+	AddPolicy(*acl.Policy) error
+	GetPolicy(*acl.Policy) error
+	UpdatePolicy(*acl.Policy) error
+	ListPolicies(string, *string) func(int) ([]acl.Policy, error)
+	DeletePolicy(*acl.Policy) error
+	AttachPolicy(*secrets.Key, *acl.Policy) error
+	DetachPolicy(*secrets.Key, *acl.Policy) error
+	AddGroup(*secrets.Group) error
+	GetGroup(*secrets.Group) error
+	ListGroups(string) func(int) ([]secrets.Group, error)
+	DeleteGroup(*secrets.Group) error
+	AddGroupMember(*secrets.Group, *secrets.Key) error
+	RemoveGroupMember(*secrets.Group, *secrets.Key) error
+	ListGroupMembers(*secrets.Group) func(int) ([]secrets.Key, error)
+	AddGroupSecret(*secrets.Group, *secrets.Secret) error
+	ListGroupSecrets(*secrets.Group) func(int) ([]secrets.Secret, error)
+	RecordView(*secrets.Secret, *secrets.Key) error
+	GetStats(*secrets.Stats) error
+	ListStats(string, string, []string) ([]secrets.Stats, error)
+	AddStats(*secrets.Stats) error
+	AddAuditEvent(*audit.Event) error
+	GetLastAuditEvent(*audit.Event) error
+	ListAuditEvents(*audit.Query) func(int) ([]audit.Event, error)
+	Namespaces() ([]string, error)
 	Ping() error
+	Close() error
 	Metrics() (map[string]interface{}, error)
 }
+
+// Transactor is implemented by backends which can make several changes in
+// one transaction.  Transaction calls f with a DB whose changes are
+// committed if f returns nil, and rolled back otherwise.
+type Transactor interface {
+	Transaction(f func(DB) error) error
+}
@@ -0,0 +1,450 @@
+// Package dbtest checks that an implementation of db.DB behaves like the
+// others, so that backends can be swapped without changing the API.
+package dbtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Open returns a new, empty and connected database, and a function to
+// remove it afterwards.
+type Open func(t *testing.T) (db.DB, func())
+
+// Run runs every test against databases from open.
+func Run(t *testing.T, open Open) {
+	for name, test := range map[string]func(*testing.T, db.DB){
+		"Keys":        testKeys,
+		"Secrets":     testSecrets,
+		"Delete":      testDelete,
+		"Policies":    testPolicies,
+		"Groups":      testGroups,
+		"Stats":       testStats,
+		"Audit":       testAudit,
+		"Metrics":     testMetrics,
+		"Transaction": testTransaction,
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, done := open(t)
+			defer done()
+			test(t, d)
+		})
+	}
+}
+
+func names(list interface{}) (res []string) {
+	switch l := list.(type) {
+	case []secrets.Secret:
+		for _, s := range l {
+			res = append(res, s.Name)
+		}
+	case []secrets.Key:
+		for _, k := range l {
+			res = append(res, k.Name)
+		}
+	case []acl.Policy:
+		for _, p := range l {
+			res = append(res, p.Name)
+		}
+	case []secrets.Group:
+		for _, g := range l {
+			res = append(res, g.Name)
+		}
+	}
+	return
+}
+
+func testKeys(t *testing.T, d db.DB) {
+	require.Nil(t, d.Ping())
+
+	k := &secrets.Key{Name: "app", Key: []byte("key"), Nonce: []byte("nonce"), Public: []byte("public"), ReadOnly: true}
+	require.Nil(t, d.AddKey(k))
+	assert.NotZero(t, k.ID)
+	assert.Equal(t, secrets.DefaultNamespace, k.Namespace)
+
+	assert.NotNil(t, d.AddKey(&secrets.Key{Name: "app"}), "Names are unique in a namespace")
+	require.Nil(t, d.AddKey(&secrets.Key{Namespace: "other", Name: "app"}))
+
+	found := &secrets.Key{Name: "app"}
+	require.Nil(t, d.GetKey(found))
+	assert.Equal(t, k.ID, found.ID)
+	assert.Equal(t, []byte("public"), found.Public)
+	assert.True(t, found.ReadOnly)
+
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetKey(&secrets.Key{Name: "missing"}))
+
+	require.Nil(t, d.AddKey(&secrets.Key{Name: "web"}))
+	require.Nil(t, d.AddKey(&secrets.Key{Name: "db"}))
+
+	next := d.ListKeys("", nil)
+	page, err := next(2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"app", "web"}, names(page))
+	page, err = next(2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"db"}, names(page))
+	page, err = next(2)
+	require.Nil(t, err)
+	assert.Empty(t, page)
+}
+
+func testSecrets(t *testing.T, d db.DB) {
+	root := &secrets.Secret{Name: "db/password", Message: []byte("v1"), Root: true, Key: secrets.Key{Name: "db/password"}}
+	require.Nil(t, d.AddSecret(root))
+	assert.NotZero(t, root.ID)
+	assert.NotZero(t, root.KeyID, "The key is created with the secret")
+
+	dup := &secrets.Secret{Name: "db/password", Root: true, Key: secrets.Key{Name: "db/password"}}
+	assert.NotNil(t, d.AddSecret(dup), "Root names are unique")
+
+	found := &secrets.Secret{Name: "db/password"}
+	require.Nil(t, d.GetRootSecret(found))
+	assert.Equal(t, []byte("v1"), found.Message)
+	assert.Equal(t, "db/password", found.Key.Name)
+
+	found.Message = []byte("v2")
+	require.Nil(t, d.UpdateSecret(found))
+	latest := &secrets.Secret{Name: "db/password"}
+	require.Nil(t, d.GetRootSecret(latest))
+	assert.Equal(t, []byte("v2"), latest.Message, "The latest version is returned")
+
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetRootSecret(&secrets.Secret{Name: "missing"}))
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetRootSecret(&secrets.Secret{Namespace: "other", Name: "db/password"}))
+
+	app := &secrets.Key{Name: "app"}
+	require.Nil(t, d.AddKey(app))
+	shared := &secrets.Secret{Name: "db/password", Message: []byte("shared"), Key: *app}
+	require.Nil(t, d.AddSecret(shared))
+	assert.Equal(t, app.ID, shared.KeyID)
+
+	other := &secrets.Secret{Name: "web/token", Root: true, Key: secrets.Key{Name: "web/token"}}
+	require.Nil(t, d.AddSecret(other))
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "web/token", Key: *app}))
+
+	found = &secrets.Secret{Name: "db/password"}
+	require.Nil(t, d.GetSharedSecret(found, &secrets.Key{Name: "app"}))
+	assert.Equal(t, []byte("shared"), found.Message)
+	assert.False(t, found.Root)
+	assert.Equal(t, "app", found.Key.Name)
+
+	assert.Equal(t, gorm.ErrRecordNotFound,
+		d.GetSharedSecret(&secrets.Secret{Name: "db/password"}, &secrets.Key{Name: "db/password"}))
+
+	key := "app"
+	list, err := d.ListSecrets("", &key, "")(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"db/password", "web/token"}, names(list))
+
+	list, err = d.ListSecrets("", nil, "web/")(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"web/token", "web/token"}, names(list))
+
+	list, err = d.ListSecrets("", nil, "db_")(10)
+	require.Nil(t, err)
+	assert.Empty(t, list, "Wildcards in the prefix are literal")
+
+	secret := "web/token"
+	keys, err := d.ListKeys("", &secret)(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"app", "web/token"}, names(keys))
+}
+
+func testDelete(t *testing.T, d db.DB) {
+	app := &secrets.Key{Name: "app"}
+	require.Nil(t, d.AddKey(app))
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "token", Root: true, Key: secrets.Key{Name: "token"}}))
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "token", Key: *app}))
+	require.Nil(t, d.RecordView(&secrets.Secret{Name: "token"}, app))
+
+	assert.NotNil(t, d.DeleteSecret(&secrets.Secret{Name: "master"}))
+	assert.NotNil(t, d.DeleteKey(&secrets.Key{Name: "master"}))
+
+	require.Nil(t, d.DeleteSharedSecret(&secrets.Secret{Name: "token"}, &secrets.Key{Name: "app"}))
+	assert.Equal(t, gorm.ErrRecordNotFound,
+		d.DeleteSharedSecret(&secrets.Secret{Name: "token"}, &secrets.Key{Name: "app"}))
+	assert.Nil(t, d.GetRootSecret(&secrets.Secret{Name: "token"}), "The root is kept")
+
+	require.Nil(t, d.DeleteSecret(&secrets.Secret{Name: "token"}))
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetRootSecret(&secrets.Secret{Name: "token"}))
+	assert.Equal(t, gorm.ErrRecordNotFound,
+		d.GetStats(&secrets.Stats{Type: secrets.SecretStats, Name: "token"}))
+
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "cert", Root: true, Key: secrets.Key{Name: "cert"}}))
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "cert", Key: *app}))
+
+	require.Nil(t, d.DeleteKey(&secrets.Key{Name: "app"}))
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetKey(&secrets.Key{Name: "app"}))
+	assert.Equal(t, gorm.ErrRecordNotFound,
+		d.GetStats(&secrets.Stats{Type: secrets.KeyStats, Name: "app"}))
+
+	list, err := d.ListSecrets("", nil, "cert")(10)
+	require.Nil(t, err)
+	if assert.Len(t, list, 1, "Shares with the key are deleted") {
+		assert.True(t, list[0].Root, "The root is kept")
+	}
+}
+
+func testPolicies(t *testing.T, d db.DB) {
+	pol := &acl.Policy{Name: "read", Rules: []acl.Rule{
+		{Pattern: "app/*", Capabilities: acl.Capabilities{acl.Read}},
+		{Pattern: "*", Capabilities: acl.Capabilities{acl.List}},
+	}}
+	require.Nil(t, d.AddPolicy(pol))
+	assert.NotZero(t, pol.ID)
+	assert.NotNil(t, d.AddPolicy(&acl.Policy{Name: "read"}), "Names are unique in a namespace")
+
+	found := &acl.Policy{Name: "read"}
+	require.Nil(t, d.GetPolicy(found))
+	require.Len(t, found.Rules, 2)
+	assert.Equal(t, "app/*", found.Rules[0].Pattern)
+	assert.Equal(t, acl.Capabilities{acl.Read}, found.Rules[0].Capabilities)
+
+	update := &acl.Policy{Name: "read", Rules: []acl.Rule{{Pattern: "*", Capabilities: acl.Capabilities{acl.Read}}}}
+	require.Nil(t, d.UpdatePolicy(update))
+	found = &acl.Policy{Name: "read"}
+	require.Nil(t, d.GetPolicy(found))
+	assert.Equal(t, pol.ID, found.ID)
+	require.Len(t, found.Rules, 1)
+	assert.Equal(t, "*", found.Rules[0].Pattern)
+
+	assert.Equal(t, gorm.ErrRecordNotFound, d.UpdatePolicy(&acl.Policy{Name: "missing"}))
+
+	require.Nil(t, d.AddPolicy(&acl.Policy{Name: "write"}))
+	require.Nil(t, d.AddKey(&secrets.Key{Name: "app"}))
+	require.Nil(t, d.AttachPolicy(&secrets.Key{Name: "app"}, &acl.Policy{Name: "read"}))
+	require.Nil(t, d.AttachPolicy(&secrets.Key{Name: "app"}, &acl.Policy{Name: "read"}), "Attaching twice is a no-op")
+
+	require.Nil(t, d.AddKey(&secrets.Key{Namespace: "other", Name: "app"}))
+	assert.NotNil(t, d.AttachPolicy(&secrets.Key{Namespace: "other", Name: "app"}, &acl.Policy{Name: "read"}))
+
+	key := "app"
+	list, err := d.ListPolicies("", &key)(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"read"}, names(list))
+	require.Len(t, list[0].Rules, 1)
+
+	list, err = d.ListPolicies("", nil)(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"read", "write"}, names(list))
+
+	require.Nil(t, d.DetachPolicy(&secrets.Key{Name: "app"}, &acl.Policy{Name: "read"}))
+	list, err = d.ListPolicies("", &key)(10)
+	require.Nil(t, err)
+	assert.Empty(t, list)
+
+	require.Nil(t, d.AttachPolicy(&secrets.Key{Name: "app"}, &acl.Policy{Name: "read"}))
+	require.Nil(t, d.DeletePolicy(&acl.Policy{Name: "read"}))
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetPolicy(&acl.Policy{Name: "read"}))
+	list, err = d.ListPolicies("", &key)(10)
+	require.Nil(t, err)
+	assert.Empty(t, list)
+}
+
+func testGroups(t *testing.T, d db.DB) {
+	g := &secrets.Group{Name: "ops"}
+	require.Nil(t, d.AddGroup(g))
+	assert.NotZero(t, g.ID)
+	assert.NotNil(t, d.AddGroup(&secrets.Group{Name: "ops"}), "Names are unique in a namespace")
+	require.Nil(t, d.AddGroup(&secrets.Group{Name: "dev"}))
+
+	groups, err := d.ListGroups("")(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"ops", "dev"}, names(groups))
+
+	alice := &secrets.Key{Name: "alice"}
+	require.Nil(t, d.AddKey(alice))
+	require.Nil(t, d.AddKey(&secrets.Key{Name: "bob"}))
+	require.Nil(t, d.AddGroupMember(&secrets.Group{Name: "ops"}, &secrets.Key{Name: "alice"}))
+	require.Nil(t, d.AddGroupMember(&secrets.Group{Name: "ops"}, &secrets.Key{Name: "bob"}))
+	assert.NotNil(t, d.AddGroupMember(&secrets.Group{Name: "ops"}, &secrets.Key{Name: "bob"}))
+
+	require.Nil(t, d.AddKey(&secrets.Key{Namespace: "other", Name: "carol"}))
+	assert.NotNil(t, d.AddGroupMember(&secrets.Group{Name: "ops"}, &secrets.Key{Namespace: "other", Name: "carol"}))
+
+	members, err := d.ListGroupMembers(&secrets.Group{Name: "ops"})(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, names(members))
+
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "token", Root: true, Key: secrets.Key{Name: "token"}}))
+	require.Nil(t, d.AddGroupSecret(g, &secrets.Secret{Name: "token"}))
+	require.Nil(t, d.AddGroupSecret(g, &secrets.Secret{Name: "token"}), "Adding twice is a no-op")
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "token", Key: *alice, GroupID: g.ID}))
+
+	key := "alice"
+	shares, err := d.ListSecrets("", &key, "")(10)
+	require.Nil(t, err)
+	require.Len(t, shares, 1)
+	assert.Equal(t, g.ID, shares[0].GroupID)
+
+	list, err := d.ListGroupSecrets(&secrets.Group{Name: "ops"})(10)
+	require.Nil(t, err)
+	assert.Equal(t, []secrets.Secret{{Namespace: secrets.DefaultNamespace, Name: "token"}}, list)
+
+	require.Nil(t, d.RemoveGroupMember(&secrets.Group{Name: "ops"}, &secrets.Key{Name: "alice"}))
+	assert.Equal(t, gorm.ErrRecordNotFound,
+		d.GetSharedSecret(&secrets.Secret{Name: "token"}, &secrets.Key{Name: "alice"}),
+		"Shares made through the group are removed")
+	members, err = d.ListGroupMembers(&secrets.Group{Name: "ops"})(10)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"bob"}, names(members))
+
+	bob := &secrets.Key{Name: "bob"}
+	require.Nil(t, d.GetKey(bob))
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "token", Key: *bob, GroupID: g.ID}))
+	require.Nil(t, d.DeleteGroup(&secrets.Group{Name: "ops"}))
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetGroup(&secrets.Group{Name: "ops"}))
+	assert.Equal(t, gorm.ErrRecordNotFound,
+		d.GetSharedSecret(&secrets.Secret{Name: "token"}, &secrets.Key{Name: "bob"}))
+	assert.Nil(t, d.GetKey(&secrets.Key{Name: "bob"}), "Members are kept")
+}
+
+func testStats(t *testing.T, d db.DB) {
+	s := &secrets.Secret{Name: "token"}
+	k := &secrets.Key{Name: "app"}
+
+	assert.Equal(t, gorm.ErrRecordNotFound, d.GetStats(&secrets.Stats{Type: secrets.SecretStats, Name: "token"}))
+
+	require.Nil(t, d.RecordView(s, k))
+	require.Nil(t, d.RecordView(s, k))
+
+	st := &secrets.Stats{Type: secrets.SecretStats, Name: "token"}
+	require.Nil(t, d.GetStats(st))
+	assert.Equal(t, int64(2), st.Views)
+	assert.Equal(t, "app", st.LastPeer)
+	require.NotNil(t, st.LastViewed)
+	assert.WithinDuration(t, time.Now(), *st.LastViewed, time.Minute)
+
+	st = &secrets.Stats{Type: secrets.KeyStats, Name: "app"}
+	require.Nil(t, d.GetStats(st))
+	assert.Equal(t, int64(2), st.Views)
+	assert.Equal(t, "token", st.LastPeer)
+
+	list, err := d.ListStats("", secrets.SecretStats, []string{"token", "unviewed", "app"})
+	require.Nil(t, err)
+	if assert.Len(t, list, 1, "Only viewed secrets have stats") {
+		assert.Equal(t, "token", list[0].Name)
+		assert.Equal(t, int64(2), list[0].Views)
+	}
+	list, err = d.ListStats("", secrets.KeyStats, nil)
+	require.Nil(t, err)
+	assert.Empty(t, list)
+
+	// The first views of a secret can happen at the same time
+	const views = 8
+	errs := make(chan error, views)
+	for i := 0; i < views; i++ {
+		go func() {
+			errs <- d.RecordView(&secrets.Secret{Name: "busy"}, k)
+		}()
+	}
+	for i := 0; i < views; i++ {
+		assert.Nil(t, <-errs)
+	}
+	st = &secrets.Stats{Type: secrets.SecretStats, Name: "busy"}
+	require.Nil(t, d.GetStats(st))
+	assert.Equal(t, int64(views), st.Views)
+
+	// Stats can be loaded as they are
+	viewed := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	loaded := &secrets.Stats{Type: secrets.KeyStats, Name: "ci", Views: 42, LastViewed: &viewed, LastPeer: "deploy"}
+	require.Nil(t, d.AddStats(loaded))
+	assert.NotZero(t, loaded.ID)
+	st = &secrets.Stats{Type: secrets.KeyStats, Name: "ci"}
+	require.Nil(t, d.GetStats(st))
+	assert.Equal(t, int64(42), st.Views)
+	assert.Equal(t, "deploy", st.LastPeer)
+	require.NotNil(t, st.LastViewed)
+	assert.True(t, viewed.Equal(*st.LastViewed))
+	assert.NotNil(t, d.AddStats(&secrets.Stats{Type: secrets.KeyStats, Name: "ci", Views: 1}), "Stats should be unique")
+}
+
+func testAudit(t *testing.T, d db.DB) {
+	last := new(audit.Event)
+	require.Nil(t, d.GetLastAuditEvent(last))
+	assert.Empty(t, last.Hash)
+
+	start := time.Now().UTC().Truncate(time.Second)
+	for i, op := range []string{"view", "message", "view"} {
+		e := &audit.Event{
+			Time: start.Add(time.Duration(i) * time.Minute), KeyID: "app", Operation: op,
+			Result: "OK", Status: 200, PrevHash: last.Hash, Hash: op + string(rune('0'+i)),
+		}
+		require.Nil(t, d.AddAuditEvent(e))
+		assert.NotZero(t, e.ID)
+		last = e
+	}
+
+	found := new(audit.Event)
+	require.Nil(t, d.GetLastAuditEvent(found))
+	assert.Equal(t, last.Hash, found.Hash)
+	assert.True(t, last.Time.Equal(found.Time))
+
+	events, err := d.ListAuditEvents(&audit.Query{Operation: "view"})(10)
+	require.Nil(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "view0", events[0].Hash)
+
+	events, err = d.ListAuditEvents(&audit.Query{Since: start.Add(time.Minute), Until: start.Add(2 * time.Minute)})(10)
+	require.Nil(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "message1", events[0].Hash)
+
+	next := d.ListAuditEvents(&audit.Query{Offset: 1})
+	events, err = next(1)
+	require.Nil(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "message1", events[0].Hash)
+	events, err = next(1)
+	require.Nil(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "view2", events[0].Hash)
+}
+
+func testMetrics(t *testing.T, d db.DB) {
+	require.Nil(t, d.AddSecret(&secrets.Secret{Name: "token", Root: true, Key: secrets.Key{Name: "token"}}))
+	require.Nil(t, d.AddPolicy(&acl.Policy{Name: "read"}))
+
+	require.Nil(t, d.AddKey(&secrets.Key{Namespace: "zeta", Name: "app"}))
+	require.Nil(t, d.AddGroup(&secrets.Group{Namespace: "alpha", Name: "ops"}))
+	namespaces, err := d.Namespaces()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"alpha", secrets.DefaultNamespace, "zeta"}, namespaces)
+
+	metrics, err := d.Metrics()
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, metrics["secrets"])
+	assert.EqualValues(t, 2, metrics["keys"])
+	assert.EqualValues(t, 1, metrics["policies"])
+	assert.EqualValues(t, 1, metrics["groups"])
+}
+
+func testTransaction(t *testing.T, d db.DB) {
+	tr, ok := d.(db.Transactor)
+	if !ok {
+		t.Skip("The backend does not support transactions")
+	}
+
+	err := tr.Transaction(func(tx db.DB) error {
+		require.Nil(t, tx.AddKey(&secrets.Key{Name: "app"}))
+		require.Nil(t, tx.AddPolicy(&acl.Policy{Name: "read"}))
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	namespaces, err := d.Namespaces()
+	require.Nil(t, err)
+	assert.Empty(t, namespaces, "A failed transaction should be rolled back")
+
+	require.Nil(t, tr.Transaction(func(tx db.DB) error {
+		return tx.AddKey(&secrets.Key{Name: "app"})
+	}))
+	assert.Nil(t, d.GetKey(&secrets.Key{Name: "app"}))
+}
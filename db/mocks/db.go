@@ -3,6 +3,8 @@ package mocks
 import "github.com/stretchr/testify/mock"
 
 import "github.com/nutmegdevelopment/nutcracker/secrets"
+import "github.com/nutmegdevelopment/nutcracker/acl"
+import "github.com/nutmegdevelopment/nutcracker/audit"
 
 type DB struct {
 	mock.Mock
@@ -92,13 +94,13 @@ func (_m *DB) GetSharedSecret(_a0 *secrets.Secret, _a1 *secrets.Key) error {
 	return r0
 }
 
-// ListSecrets provides a mock function with given fields: _a0
-func (_m *DB) ListSecrets(_a0 *string) func(int) ([]secrets.Secret, error) {
-	ret := _m.Called(_a0)
+// ListSecrets provides a mock function with given fields: _a0, _a1, _a2
+func (_m *DB) ListSecrets(_a0 string, _a1 *string, _a2 string) func(int) ([]secrets.Secret, error) {
+	ret := _m.Called(_a0, _a1, _a2)
 
 	var r0 func(int) ([]secrets.Secret, error)
-	if rf, ok := ret.Get(0).(func(*string) func(int) ([]secrets.Secret, error)); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(string, *string, string) func(int) ([]secrets.Secret, error)); ok {
+		r0 = rf(_a0, _a1, _a2)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(func(int) ([]secrets.Secret, error))
@@ -108,13 +110,13 @@ func (_m *DB) ListSecrets(_a0 *string) func(int) ([]secrets.Secret, error) {
 	return r0
 }
 
-// ListKeys provides a mock function with given fields: _a0
-func (_m *DB) ListKeys(_a0 *string) func(int) ([]secrets.Key, error) {
-	ret := _m.Called(_a0)
+// ListKeys provides a mock function with given fields: _a0, _a1
+func (_m *DB) ListKeys(_a0 string, _a1 *string) func(int) ([]secrets.Key, error) {
+	ret := _m.Called(_a0, _a1)
 
 	var r0 func(int) ([]secrets.Key, error)
-	if rf, ok := ret.Get(0).(func(*string) func(int) ([]secrets.Key, error)); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(string, *string) func(int) ([]secrets.Key, error)); ok {
+		r0 = rf(_a0, _a1)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(func(int) ([]secrets.Key, error))
@@ -138,6 +140,20 @@ func (_m *DB) DeleteSecret(_a0 *secrets.Secret) error {
 	return r0
 }
 
+// DeleteSharedSecret provides a mock function with given fields: _a0, _a1
+func (_m *DB) DeleteSharedSecret(_a0 *secrets.Secret, _a1 *secrets.Key) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Secret, *secrets.Key) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteKey provides a mock function with given fields: _a0
 func (_m *DB) DeleteKey(_a0 *secrets.Key) error {
 	ret := _m.Called(_a0)
@@ -166,6 +182,361 @@ func (_m *DB) UpdateSecret(_a0 *secrets.Secret) error {
 	return r0
 }
 
+// AddPolicy provides a mock function with given fields: _a0
+func (_m *DB) AddPolicy(_a0 *acl.Policy) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*acl.Policy) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetPolicy provides a mock function with given fields: _a0
+func (_m *DB) GetPolicy(_a0 *acl.Policy) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*acl.Policy) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdatePolicy provides a mock function with given fields: _a0
+func (_m *DB) UpdatePolicy(_a0 *acl.Policy) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*acl.Policy) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListPolicies provides a mock function with given fields: _a0, _a1
+func (_m *DB) ListPolicies(_a0 string, _a1 *string) func(int) ([]acl.Policy, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 func(int) ([]acl.Policy, error)
+	if rf, ok := ret.Get(0).(func(string, *string) func(int) ([]acl.Policy, error)); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func(int) ([]acl.Policy, error))
+		}
+	}
+
+	return r0
+}
+
+// DeletePolicy provides a mock function with given fields: _a0
+func (_m *DB) DeletePolicy(_a0 *acl.Policy) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*acl.Policy) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AttachPolicy provides a mock function with given fields: _a0, _a1
+func (_m *DB) AttachPolicy(_a0 *secrets.Key, _a1 *acl.Policy) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Key, *acl.Policy) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DetachPolicy provides a mock function with given fields: _a0, _a1
+func (_m *DB) DetachPolicy(_a0 *secrets.Key, _a1 *acl.Policy) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Key, *acl.Policy) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddGroup provides a mock function with given fields: _a0
+func (_m *DB) AddGroup(_a0 *secrets.Group) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Group) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetGroup provides a mock function with given fields: _a0
+func (_m *DB) GetGroup(_a0 *secrets.Group) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Group) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListGroups provides a mock function with given fields: _a0
+func (_m *DB) ListGroups(_a0 string) func(int) ([]secrets.Group, error) {
+	ret := _m.Called(_a0)
+
+	var r0 func(int) ([]secrets.Group, error)
+	if rf, ok := ret.Get(0).(func(string) func(int) ([]secrets.Group, error)); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func(int) ([]secrets.Group, error))
+		}
+	}
+
+	return r0
+}
+
+// DeleteGroup provides a mock function with given fields: _a0
+func (_m *DB) DeleteGroup(_a0 *secrets.Group) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Group) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddGroupMember provides a mock function with given fields: _a0, _a1
+func (_m *DB) AddGroupMember(_a0 *secrets.Group, _a1 *secrets.Key) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Group, *secrets.Key) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RemoveGroupMember provides a mock function with given fields: _a0, _a1
+func (_m *DB) RemoveGroupMember(_a0 *secrets.Group, _a1 *secrets.Key) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Group, *secrets.Key) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListGroupMembers provides a mock function with given fields: _a0
+func (_m *DB) ListGroupMembers(_a0 *secrets.Group) func(int) ([]secrets.Key, error) {
+	ret := _m.Called(_a0)
+
+	var r0 func(int) ([]secrets.Key, error)
+	if rf, ok := ret.Get(0).(func(*secrets.Group) func(int) ([]secrets.Key, error)); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func(int) ([]secrets.Key, error))
+		}
+	}
+
+	return r0
+}
+
+// AddGroupSecret provides a mock function with given fields: _a0, _a1
+func (_m *DB) AddGroupSecret(_a0 *secrets.Group, _a1 *secrets.Secret) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Group, *secrets.Secret) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListGroupSecrets provides a mock function with given fields: _a0
+func (_m *DB) ListGroupSecrets(_a0 *secrets.Group) func(int) ([]secrets.Secret, error) {
+	ret := _m.Called(_a0)
+
+	var r0 func(int) ([]secrets.Secret, error)
+	if rf, ok := ret.Get(0).(func(*secrets.Group) func(int) ([]secrets.Secret, error)); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func(int) ([]secrets.Secret, error))
+		}
+	}
+
+	return r0
+}
+
+// RecordView provides a mock function with given fields: _a0, _a1
+func (_m *DB) RecordView(_a0 *secrets.Secret, _a1 *secrets.Key) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Secret, *secrets.Key) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetStats provides a mock function with given fields: _a0
+func (_m *DB) GetStats(_a0 *secrets.Stats) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Stats) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListStats provides a mock function with given fields: _a0, _a1, _a2
+func (_m *DB) ListStats(_a0 string, _a1 string, _a2 []string) ([]secrets.Stats, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 []secrets.Stats
+	if rf, ok := ret.Get(0).(func(string, string, []string) []secrets.Stats); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]secrets.Stats)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string, []string) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// AddStats provides a mock function with given fields: _a0
+func (_m *DB) AddStats(_a0 *secrets.Stats) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*secrets.Stats) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddAuditEvent provides a mock function with given fields: _a0
+func (_m *DB) AddAuditEvent(_a0 *audit.Event) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*audit.Event) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetLastAuditEvent provides a mock function with given fields: _a0
+func (_m *DB) GetLastAuditEvent(_a0 *audit.Event) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*audit.Event) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListAuditEvents provides a mock function with given fields: _a0
+func (_m *DB) ListAuditEvents(_a0 *audit.Query) func(int) ([]audit.Event, error) {
+	ret := _m.Called(_a0)
+
+	var r0 func(int) ([]audit.Event, error)
+	if rf, ok := ret.Get(0).(func(*audit.Query) func(int) ([]audit.Event, error)); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func(int) ([]audit.Event, error))
+		}
+	}
+
+	return r0
+}
+
+// Close provides a mock function with given fields:
+func (_m *DB) Close() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Ping provides a mock function with given fields:
 func (_m *DB) Ping() error {
 	ret := _m.Called()
@@ -180,6 +551,29 @@ func (_m *DB) Ping() error {
 	return r0
 }
 
+// Namespaces provides a mock function with given fields:
+func (_m *DB) Namespaces() ([]string, error) {
+	ret := _m.Called()
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Metrics provides a mock function with given fields:
 func (_m *DB) Metrics() (map[string]interface{}, error) {
 	ret := _m.Called()
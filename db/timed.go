@@ -0,0 +1,240 @@
+package db
+
+import (
+	"time"
+
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// Timed wraps a DB, calling observe with the method name and duration of
+// every call.  List iterators are timed each time they are called.
+func Timed(d DB, observe func(method string, took time.Duration)) DB {
+	return &timed{db: d, observe: observe}
+}
+
+type timed struct {
+	db      DB
+	observe func(string, time.Duration)
+}
+
+func (t *timed) since(method string, start time.Time) {
+	t.observe(method, time.Since(start))
+}
+
+func (t *timed) Connect() error {
+	defer t.since("Connect", time.Now())
+	return t.db.Connect()
+}
+
+func (t *timed) AddSecret(s *secrets.Secret) error {
+	defer t.since("AddSecret", time.Now())
+	return t.db.AddSecret(s)
+}
+
+func (t *timed) AddKey(k *secrets.Key) error {
+	defer t.since("AddKey", time.Now())
+	return t.db.AddKey(k)
+}
+
+func (t *timed) GetKey(k *secrets.Key) error {
+	defer t.since("GetKey", time.Now())
+	return t.db.GetKey(k)
+}
+
+func (t *timed) GetRootSecret(s *secrets.Secret) error {
+	defer t.since("GetRootSecret", time.Now())
+	return t.db.GetRootSecret(s)
+}
+
+func (t *timed) GetSharedSecret(s *secrets.Secret, k *secrets.Key) error {
+	defer t.since("GetSharedSecret", time.Now())
+	return t.db.GetSharedSecret(s, k)
+}
+
+func (t *timed) ListSecrets(namespace string, search *string, prefix string) func(int) ([]secrets.Secret, error) {
+	iter := t.db.ListSecrets(namespace, search, prefix)
+	return func(n int) ([]secrets.Secret, error) {
+		defer t.since("ListSecrets", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) ListKeys(namespace string, search *string) func(int) ([]secrets.Key, error) {
+	iter := t.db.ListKeys(namespace, search)
+	return func(n int) ([]secrets.Key, error) {
+		defer t.since("ListKeys", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) DeleteSecret(s *secrets.Secret) error {
+	defer t.since("DeleteSecret", time.Now())
+	return t.db.DeleteSecret(s)
+}
+
+func (t *timed) DeleteSharedSecret(s *secrets.Secret, k *secrets.Key) error {
+	defer t.since("DeleteSharedSecret", time.Now())
+	return t.db.DeleteSharedSecret(s, k)
+}
+
+func (t *timed) DeleteKey(k *secrets.Key) error {
+	defer t.since("DeleteKey", time.Now())
+	return t.db.DeleteKey(k)
+}
+
+func (t *timed) UpdateSecret(s *secrets.Secret) error {
+	defer t.since("UpdateSecret", time.Now())
+	return t.db.UpdateSecret(s)
+}
+
+func (t *timed) AddPolicy(p *acl.Policy) error {
+	defer t.since("AddPolicy", time.Now())
+	return t.db.AddPolicy(p)
+}
+
+func (t *timed) GetPolicy(p *acl.Policy) error {
+	defer t.since("GetPolicy", time.Now())
+	return t.db.GetPolicy(p)
+}
+
+func (t *timed) UpdatePolicy(p *acl.Policy) error {
+	defer t.since("UpdatePolicy", time.Now())
+	return t.db.UpdatePolicy(p)
+}
+
+func (t *timed) ListPolicies(namespace string, search *string) func(int) ([]acl.Policy, error) {
+	iter := t.db.ListPolicies(namespace, search)
+	return func(n int) ([]acl.Policy, error) {
+		defer t.since("ListPolicies", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) DeletePolicy(p *acl.Policy) error {
+	defer t.since("DeletePolicy", time.Now())
+	return t.db.DeletePolicy(p)
+}
+
+func (t *timed) AttachPolicy(k *secrets.Key, p *acl.Policy) error {
+	defer t.since("AttachPolicy", time.Now())
+	return t.db.AttachPolicy(k, p)
+}
+
+func (t *timed) DetachPolicy(k *secrets.Key, p *acl.Policy) error {
+	defer t.since("DetachPolicy", time.Now())
+	return t.db.DetachPolicy(k, p)
+}
+
+func (t *timed) AddGroup(g *secrets.Group) error {
+	defer t.since("AddGroup", time.Now())
+	return t.db.AddGroup(g)
+}
+
+func (t *timed) GetGroup(g *secrets.Group) error {
+	defer t.since("GetGroup", time.Now())
+	return t.db.GetGroup(g)
+}
+
+func (t *timed) ListGroups(namespace string) func(int) ([]secrets.Group, error) {
+	iter := t.db.ListGroups(namespace)
+	return func(n int) ([]secrets.Group, error) {
+		defer t.since("ListGroups", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) DeleteGroup(g *secrets.Group) error {
+	defer t.since("DeleteGroup", time.Now())
+	return t.db.DeleteGroup(g)
+}
+
+func (t *timed) AddGroupMember(g *secrets.Group, k *secrets.Key) error {
+	defer t.since("AddGroupMember", time.Now())
+	return t.db.AddGroupMember(g, k)
+}
+
+func (t *timed) RemoveGroupMember(g *secrets.Group, k *secrets.Key) error {
+	defer t.since("RemoveGroupMember", time.Now())
+	return t.db.RemoveGroupMember(g, k)
+}
+
+func (t *timed) ListGroupMembers(g *secrets.Group) func(int) ([]secrets.Key, error) {
+	iter := t.db.ListGroupMembers(g)
+	return func(n int) ([]secrets.Key, error) {
+		defer t.since("ListGroupMembers", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) AddGroupSecret(g *secrets.Group, s *secrets.Secret) error {
+	defer t.since("AddGroupSecret", time.Now())
+	return t.db.AddGroupSecret(g, s)
+}
+
+func (t *timed) ListGroupSecrets(g *secrets.Group) func(int) ([]secrets.Secret, error) {
+	iter := t.db.ListGroupSecrets(g)
+	return func(n int) ([]secrets.Secret, error) {
+		defer t.since("ListGroupSecrets", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) RecordView(s *secrets.Secret, k *secrets.Key) error {
+	defer t.since("RecordView", time.Now())
+	return t.db.RecordView(s, k)
+}
+
+func (t *timed) GetStats(st *secrets.Stats) error {
+	defer t.since("GetStats", time.Now())
+	return t.db.GetStats(st)
+}
+
+func (t *timed) ListStats(namespace, typ string, names []string) ([]secrets.Stats, error) {
+	defer t.since("ListStats", time.Now())
+	return t.db.ListStats(namespace, typ, names)
+}
+
+func (t *timed) AddStats(st *secrets.Stats) error {
+	defer t.since("AddStats", time.Now())
+	return t.db.AddStats(st)
+}
+
+func (t *timed) AddAuditEvent(e *audit.Event) error {
+	defer t.since("AddAuditEvent", time.Now())
+	return t.db.AddAuditEvent(e)
+}
+
+func (t *timed) GetLastAuditEvent(e *audit.Event) error {
+	defer t.since("GetLastAuditEvent", time.Now())
+	return t.db.GetLastAuditEvent(e)
+}
+
+func (t *timed) ListAuditEvents(q *audit.Query) func(int) ([]audit.Event, error) {
+	iter := t.db.ListAuditEvents(q)
+	return func(n int) ([]audit.Event, error) {
+		defer t.since("ListAuditEvents", time.Now())
+		return iter(n)
+	}
+}
+
+func (t *timed) Ping() error {
+	defer t.since("Ping", time.Now())
+	return t.db.Ping()
+}
+
+func (t *timed) Namespaces() ([]string, error) {
+	defer t.since("Namespaces", time.Now())
+	return t.db.Namespaces()
+}
+
+func (t *timed) Close() error {
+	defer t.since("Close", time.Now())
+	return t.db.Close()
+}
+
+func (t *timed) Metrics() (map[string]interface{}, error) {
+	defer t.since("Metrics", time.Now())
+	return t.db.Metrics()
+}
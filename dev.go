@@ -0,0 +1,63 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// devAdminKey names the admin key created in dev mode.
+const devAdminKey = "dev-admin"
+
+// initDev initialises and unseals a new vault, adds an admin key, and
+// writes the credentials for both to w.  It is only used with -dev, where
+// the vault is in memory and thrown away on exit.
+func initDev(w io.Writer) error {
+	master, err := secrets.Initialise()
+	if err != nil {
+		return err
+	}
+
+	err = database.AddSecret(master)
+	if err != nil {
+		return err
+	}
+
+	masterKey := base64.StdEncoding.EncodeToString(master.Key.Display())
+
+	// Unseal zeroes the key it is given.
+	err = secrets.Unseal(master, append([]byte{}, master.Key.Display()...))
+	if err != nil {
+		return err
+	}
+	master.Key.Zero()
+
+	admin := new(secrets.Key)
+	err = admin.New(devAdminKey)
+	if err != nil {
+		return err
+	}
+	defer admin.Zero()
+	admin.Namespace = secrets.DefaultNamespace
+	admin.ReadOnly = false
+
+	err = database.AddKey(admin)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, `
+Dev mode: the vault is in memory, initialised and unsealed.  Everything
+is lost when the server stops.  Do not use it for real secrets.
+
+    X-Secret-ID: %s
+    X-Secret-Key: %s
+
+    X-Secret-ID: %s
+    X-Secret-Key: %s
+
+`, secrets.MasterKeyName, masterKey, admin.Name, base64.StdEncoding.EncodeToString(admin.Display()))
+	return err
+}
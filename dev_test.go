@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDev(t *testing.T) {
+	defer useDatabase(new(memory.DB))()
+	assert.Nil(t, database.Connect())
+	defer database.Close()
+	keyLockout.Reset()
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, initDev(out), "Should not return error")
+	assert.False(t, secrets.IsSealed(), "Vault should be unsealed")
+
+	creds := regexp.MustCompile(`X-Secret-ID: (\S+)\n\s+X-Secret-Key: (\S+)`).FindAllStringSubmatch(out.String(), -1)
+	if !assert.Len(t, creds, 2, "Should print two keys") {
+		return
+	}
+	assert.Equal(t, secrets.MasterKeyName, creds[0][1])
+	assert.Equal(t, devAdminKey, creds[1][1])
+
+	for _, c := range creds {
+		a := new(api)
+		a.req = new(http.Request)
+		a.req.Header = make(http.Header)
+		a.req.Header.Set("X-Secret-ID", c[1])
+		a.req.Header.Set("X-Secret-Key", c[2])
+		assert.True(t, a.auth(), "Auth should succeed for "+c[1])
+		assert.True(t, a.admin, c[1]+" should be an admin key")
+	}
+
+	// The printed master key unseals the vault
+	master := &secrets.Secret{Name: secrets.MasterKeyName}
+	assert.Nil(t, database.GetRootSecret(master))
+	key, err := base64.StdEncoding.DecodeString(creds[0][2])
+	assert.Nil(t, err)
+	secrets.Seal()
+	assert.Nil(t, secrets.Unseal(master, key), "Should unseal")
+}
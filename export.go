@@ -0,0 +1,466 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// vaultExport holds the whole contents of a database, with records
+// referring to each other by name rather than ID, so that it can be
+// loaded into another.  Everything in it is still encrypted, so neither
+// exporting nor importing needs the vault unsealed.
+type vaultExport struct {
+	Namespaces []namespaceExport
+	Events     []audit.Event
+}
+
+type namespaceExport struct {
+	Name     string
+	Keys     []secrets.Key
+	Policies []policyExport
+	Groups   []groupExport
+	// Every version of every secret and share, oldest first.
+	Secrets []secretExport
+	// View stats, secrets first and then keys.
+	Stats []secrets.Stats
+}
+
+type secretExport struct {
+	secrets.Secret
+	KeyName   string
+	GroupName string
+}
+
+type policyExport struct {
+	acl.Policy
+	Keys []string
+}
+
+type groupExport struct {
+	secrets.Group
+	Members []string
+	Secrets []string
+}
+
+// exportDB reads everything in d.
+func exportDB(d db.DB) (e *vaultExport, err error) {
+	e = new(vaultExport)
+
+	namespaces, err := d.Namespaces()
+	if err != nil {
+		return
+	}
+
+	for _, name := range namespaces {
+		ns, err := exportNamespace(d, name)
+		if err != nil {
+			return nil, err
+		}
+		e.Namespaces = append(e.Namespaces, *ns)
+	}
+
+	e.Events, err = allEvents(d.ListAuditEvents(&audit.Query{}))
+	return
+}
+
+func exportNamespace(d db.DB, name string) (ns *namespaceExport, err error) {
+	ns = &namespaceExport{Name: name}
+
+	ns.Keys, err = allKeys(d.ListKeys(name, nil))
+	if err != nil {
+		return
+	}
+	keyNames := make(map[uint]string)
+	for i := range ns.Keys {
+		keyNames[ns.Keys[i].ID] = ns.Keys[i].Name
+		ns.Keys[i].Stats = nil
+	}
+
+	policies, err := allPolicies(d.ListPolicies(name, nil))
+	if err != nil {
+		return
+	}
+	attached := make(map[string][]string)
+	for _, k := range ns.Keys {
+		keyName := k.Name
+		list, err := allPolicies(d.ListPolicies(name, &keyName))
+		if err != nil {
+			return nil, err
+		}
+		for _, pol := range list {
+			attached[pol.Name] = append(attached[pol.Name], k.Name)
+		}
+	}
+	for _, pol := range policies {
+		ns.Policies = append(ns.Policies, policyExport{Policy: pol, Keys: attached[pol.Name]})
+	}
+
+	groups, err := allGroups(d.ListGroups(name))
+	if err != nil {
+		return
+	}
+	groupNames := make(map[uint]string)
+	for i := range groups {
+		g := groupExport{Group: groups[i]}
+		groupNames[g.ID] = g.Name
+
+		members, err := allKeys(d.ListGroupMembers(&groups[i]))
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range members {
+			g.Members = append(g.Members, k.Name)
+		}
+
+		shared, err := allSecrets(d.ListGroupSecrets(&groups[i]))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range shared {
+			g.Secrets = append(g.Secrets, s.Name)
+		}
+
+		ns.Groups = append(ns.Groups, g)
+	}
+
+	list, err := allSecrets(d.ListSecrets(name, nil, ""))
+	if err != nil {
+		return
+	}
+	var rootNames []string
+	seen := make(map[string]bool)
+	for _, s := range list {
+		if s.Root && !seen[s.Name] {
+			seen[s.Name] = true
+			rootNames = append(rootNames, s.Name)
+		}
+	}
+	for _, s := range list {
+		keyName, ok := keyNames[s.KeyID]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s/%s has no key", name, s.Name)
+		}
+		s.Key = secrets.Key{}
+		s.Stats = nil
+		ns.Secrets = append(ns.Secrets, secretExport{Secret: s, KeyName: keyName, GroupName: groupNames[s.GroupID]})
+	}
+
+	var names []string
+	for _, k := range ns.Keys {
+		names = append(names, k.Name)
+	}
+	ns.Stats, err = allStats(d, name, secrets.SecretStats, rootNames)
+	if err != nil {
+		return
+	}
+	keyStats, err := allStats(d, name, secrets.KeyStats, names)
+	ns.Stats = append(ns.Stats, keyStats...)
+	return
+}
+
+// checkEmpty returns an error unless d holds nothing at all.
+func checkEmpty(d db.DB) error {
+	namespaces, err := d.Namespaces()
+	if err != nil {
+		return err
+	}
+
+	last := new(audit.Event)
+	err = d.GetLastAuditEvent(last)
+	if err != nil {
+		return err
+	}
+
+	if len(namespaces) > 0 || last.Hash != "" {
+		return errors.New("The target database is not empty")
+	}
+	return nil
+}
+
+// importDB loads e into d, which must be empty.  Records get new IDs, but
+// keep their order.
+func importDB(e *vaultExport, d db.DB) error {
+	err := checkEmpty(d)
+	if err != nil {
+		return err
+	}
+
+	for _, ns := range e.Namespaces {
+		err = importNamespace(&ns, d)
+		if err != nil {
+			return fmt.Errorf("Namespace %s: %s", ns.Name, err)
+		}
+	}
+
+	for _, ev := range e.Events {
+		ev.ID = 0
+		err = d.AddAuditEvent(&ev)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importNamespace(ns *namespaceExport, d db.DB) error {
+	keys := make(map[string]secrets.Key)
+	for _, k := range ns.Keys {
+		k.ID = 0
+		k.Namespace = ns.Name
+		err := d.AddKey(&k)
+		if err != nil {
+			return err
+		}
+		keys[k.Name] = k
+	}
+
+	for _, p := range ns.Policies {
+		pol := p.Policy
+		pol.ID = 0
+		pol.Namespace = ns.Name
+		pol.Rules = nil
+		for _, r := range p.Rules {
+			pol.Rules = append(pol.Rules, acl.Rule{Pattern: r.Pattern, Capabilities: r.Capabilities})
+		}
+		err := d.AddPolicy(&pol)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range p.Keys {
+			err = d.AttachPolicy(&secrets.Key{Namespace: ns.Name, Name: name}, &acl.Policy{Namespace: ns.Name, Name: pol.Name})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	groups := make(map[string]uint)
+	for _, eg := range ns.Groups {
+		g := eg.Group
+		g.ID = 0
+		g.Namespace = ns.Name
+		err := d.AddGroup(&g)
+		if err != nil {
+			return err
+		}
+		groups[g.Name] = g.ID
+
+		for _, name := range eg.Members {
+			err = d.AddGroupMember(&g, &secrets.Key{Namespace: ns.Name, Name: name})
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range eg.Secrets {
+			err = d.AddGroupSecret(&g, &secrets.Secret{Namespace: ns.Name, Name: name})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	roots := make(map[string]bool)
+	for _, es := range ns.Secrets {
+		s := es.Secret
+		s.ID = 0
+		s.Namespace = ns.Name
+		s.Key = keys[es.KeyName]
+		s.KeyID = s.Key.ID
+		s.GroupID = groups[es.GroupName]
+
+		var err error
+		if s.Root && roots[s.Name] {
+			err = d.UpdateSecret(&s)
+		} else {
+			err = d.AddSecret(&s)
+		}
+		if err != nil {
+			return err
+		}
+		if s.Root {
+			roots[s.Name] = true
+		}
+	}
+
+	for _, st := range ns.Stats {
+		st.ID = 0
+		st.Namespace = ns.Name
+		err := d.AddStats(&st)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportSummary counts and checksums one kind of record in an export.
+type exportSummary struct {
+	Kind   string
+	Count  int
+	SHA256 string
+}
+
+type tally struct {
+	count int
+	hash  hash.Hash
+}
+
+func (t *tally) add(fields ...interface{}) {
+	t.count++
+	for _, f := range fields {
+		var b []byte
+		switch v := f.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		default:
+			b = []byte(fmt.Sprint(v))
+		}
+		fmt.Fprintf(t.hash, "%d:", len(b))
+		t.hash.Write(b)
+	}
+}
+
+// summary counts and checksums every kind of record.  IDs are left out,
+// so two exports of the same data match whichever database they came
+// from, and times are cut to the microseconds every backend keeps.  Stats
+// come last, so that summaries from before they were exported still line
+// up.
+func (e *vaultExport) summary() []exportSummary {
+	kinds := []string{"keys", "secrets", "policies", "groups", "audit events", "stats"}
+	tallies := make(map[string]*tally)
+	for _, kind := range kinds {
+		tallies[kind] = &tally{hash: sha256.New()}
+	}
+
+	for _, ns := range e.Namespaces {
+		for _, k := range ns.Keys {
+			tallies["keys"].add(ns.Name, k.Name, k.Key, k.Nonce, k.Public, k.ReadOnly)
+		}
+		for _, s := range ns.Secrets {
+			tallies["secrets"].add(ns.Name, s.Name, s.Root, s.KeyName, s.GroupName, s.Message, s.Nonce, s.Pubkey)
+		}
+		for _, p := range ns.Policies {
+			fields := []interface{}{ns.Name, p.Name, len(p.Rules)}
+			for _, r := range p.Rules {
+				fields = append(fields, r.Pattern, r.Capabilities)
+			}
+			tallies["policies"].add(append(fields, p.Keys)...)
+		}
+		for _, g := range ns.Groups {
+			tallies["groups"].add(ns.Name, g.Name, g.Members, g.Secrets)
+		}
+		for _, st := range ns.Stats {
+			viewed := ""
+			if st.LastViewed != nil {
+				viewed = st.LastViewed.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+			}
+			tallies["stats"].add(ns.Name, st.Type, st.Name, st.Views, viewed, st.LastPeer)
+		}
+	}
+
+	for _, ev := range e.Events {
+		tallies["audit events"].add(ev.Time.UTC().Format(time.RFC3339Nano), ev.Sum(), ev.Hash)
+	}
+
+	res := make([]exportSummary, len(kinds))
+	for i, kind := range kinds {
+		res[i] = exportSummary{
+			Kind:   kind,
+			Count:  tallies[kind].count,
+			SHA256: hex.EncodeToString(tallies[kind].hash.Sum(nil)),
+		}
+	}
+	return res
+}
+
+// verifyExport checks that got has the same records as want.
+func verifyExport(want, got []exportSummary) error {
+	for i := range want {
+		if i >= len(got) || want[i] != got[i] {
+			return fmt.Errorf("Verification failed: the %s do not match", want[i].Kind)
+		}
+	}
+	return nil
+}
+
+func allKeys(next func(int) ([]secrets.Key, error)) (all []secrets.Key, err error) {
+	for {
+		res, err := next(pageSize)
+		if err != nil || len(res) == 0 {
+			return all, err
+		}
+		all = append(all, res...)
+	}
+}
+
+func allSecrets(next func(int) ([]secrets.Secret, error)) (all []secrets.Secret, err error) {
+	for {
+		res, err := next(pageSize)
+		if err != nil || len(res) == 0 {
+			return all, err
+		}
+		all = append(all, res...)
+	}
+}
+
+func allPolicies(next func(int) ([]acl.Policy, error)) (all []acl.Policy, err error) {
+	for {
+		res, err := next(pageSize)
+		if err != nil || len(res) == 0 {
+			return all, err
+		}
+		all = append(all, res...)
+	}
+}
+
+func allGroups(next func(int) ([]secrets.Group, error)) (all []secrets.Group, err error) {
+	for {
+		res, err := next(pageSize)
+		if err != nil || len(res) == 0 {
+			return all, err
+		}
+		all = append(all, res...)
+	}
+}
+
+// allStats reads the stats for names a page at a time, so that a large
+// namespace does not make one huge query.
+func allStats(d db.DB, namespace, typ string, names []string) (all []secrets.Stats, err error) {
+	for len(names) > 0 {
+		n := pageSize
+		if n <= 0 || n > len(names) {
+			n = len(names)
+		}
+
+		res, err := d.ListStats(namespace, typ, names[:n])
+		if err != nil {
+			return all, err
+		}
+		all = append(all, res...)
+		names = names[n:]
+	}
+	return
+}
+
+func allEvents(next func(int) ([]audit.Event, error)) (all []audit.Event, err error) {
+	for {
+		res, err := next(pageSize)
+		if err != nil || len(res) == 0 {
+			return all, err
+		}
+		all = append(all, res...)
+	}
+}
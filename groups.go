@@ -0,0 +1,335 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// Group adds a new key group to the vault
+func Group(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() || !api.admin {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	request, err := api.read()
+	if err != nil {
+		api.log().Debug(err)
+		api.error("Bad request", 400)
+		return
+	}
+
+	if !secretIDRegex.MatchString(request.Name) {
+		api.error("Invalid group name", 400)
+		return
+	}
+
+	g := &secrets.Group{Namespace: api.namespace, Name: request.Name}
+
+	err = database.AddGroup(g)
+	switch {
+
+	case err == nil:
+		api.log().Info("New group added: ", g.Name)
+		api.message("OK", 201)
+
+	case err.Error() == "Group already exists":
+		api.error("Group already exists", 409)
+
+	default:
+		api.log().Error(err)
+		api.error("Database error", 500)
+
+	}
+
+	return
+}
+
+// GroupAdd adds a key to a group, and shares every secret shared with
+// the group with the key.
+// Requires the vault to be unsealed.
+func GroupAdd(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	g, key, ok := groupRequest(api)
+	if !ok {
+		return
+	}
+
+	if secrets.IsSealed() {
+		api.error("Please unseal first", 500)
+		return
+	}
+
+	err := database.AddGroupMember(g, key)
+	switch {
+
+	case err == gorm.ErrRecordNotFound:
+		api.error("Key or group does not exist", 404)
+		return
+
+	case err == nil:
+		break
+
+	case err.Error() == "Key is already a member":
+		api.error("Key is already a member", 409)
+		return
+
+	default:
+		api.log().Error(err)
+		api.error("Database error", 500)
+		return
+
+	}
+
+	// The membership is only kept once every group secret is shared.  If
+	// sharing fails, the key is taken out of the group again, which also
+	// revokes the shares made so far.
+	shared := false
+	defer func() {
+		if shared {
+			return
+		}
+		err := database.RemoveGroupMember(g, key)
+		if err != nil {
+			api.log().Error("Key: ", key.Name, " left in group: ", g.Name, ": ", err)
+		}
+	}()
+
+	iter := database.ListGroupSecrets(g)
+
+	for {
+
+		res, err := iter(pageSize)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+
+		if len(res) == 0 {
+			break
+		}
+
+		for i := range res {
+			root := &res[i]
+
+			err = database.GetRootSecret(root)
+			switch err {
+
+			case gorm.ErrRecordNotFound:
+				continue
+
+			case nil:
+				break
+
+			default:
+				api.log().Error(err)
+				api.error("Database error", 500)
+				return
+
+			}
+
+			err = shareSecret(root, key, g)
+			if err != nil {
+				api.log().Error(err)
+				api.error("Unable to share group secrets", 500)
+				return
+			}
+		}
+
+	}
+
+	shared = true
+	api.log().Info("Key: ", key.Name, " added to group: ", g.Name)
+
+	api.message("OK", 201)
+}
+
+// GroupRemove removes a key from a group, and revokes every share the key
+// was given through the group.
+func GroupRemove(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	g, key, ok := groupRequest(api)
+	if !ok {
+		return
+	}
+
+	err := database.RemoveGroupMember(g, key)
+	switch err {
+
+	case gorm.ErrRecordNotFound:
+		api.error("Key or group does not exist", 404)
+		return
+
+	case nil:
+		break
+
+	default:
+		api.log().Error(err)
+		api.error("Database error", 500)
+		return
+
+	}
+
+	api.log().Info("Key: ", key.Name, " removed from group: ", g.Name)
+
+	api.message("OK", 200)
+}
+
+// groupRequest authenticates a group membership request, and returns the
+// group and key it refers to.
+func groupRequest(api *api) (g *secrets.Group, key *secrets.Key, ok bool) {
+	if !api.auth() || !api.admin {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	request, err := api.read()
+	if err != nil {
+		api.log().Debug(err)
+		api.error("Bad request", 400)
+		return
+	}
+
+	if len(request.KeyID) == 0 {
+		api.error("Missing elements in request", 400)
+		return
+	}
+	if len(request.Name) == 0 {
+		api.error("Missing elements in request", 400)
+		return
+	}
+
+	g = &secrets.Group{Namespace: api.namespace, Name: request.Name}
+	key = &secrets.Key{Namespace: api.namespace, Name: request.KeyID}
+
+	return g, key, true
+}
+
+// shareWithGroup shares a secret with every member of a group, and
+// records the share so that future members get it too.
+func shareWithGroup(secret *secrets.Secret, g *secrets.Group) error {
+	iter := database.ListGroupMembers(g)
+
+	for {
+
+		res, err := iter(pageSize)
+		if err != nil {
+			return err
+		}
+
+		if len(res) == 0 {
+			break
+		}
+
+		for i := range res {
+			err = shareSecret(secret, &res[i], g)
+			if err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return database.AddGroupSecret(g, secret)
+}
+
+// shareSecret shares root with a key.  If g is not nil, the share is
+// made on behalf of the group, and is revoked when the key leaves it.
+func shareSecret(root *secrets.Secret, key *secrets.Key, g *secrets.Group) error {
+	shared, err := root.Share(key)
+	if err != nil {
+		return err
+	}
+	if g != nil {
+		shared.GroupID = g.ID
+	}
+
+	return database.AddSecret(shared)
+}
+
+func listGroups(api *api) {
+
+	iter := database.ListGroups(api.namespace)
+
+	for {
+
+		res, err := iter(pageSize)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+
+		if len(res) == 0 {
+			return
+		}
+
+		data, err := json.MarshalIndent(&res, "", "  ")
+		if err != nil {
+			api.log().Error(err)
+			api.error("JSON error", 500)
+			return
+		}
+
+		api.resp.Write(data)
+
+		res = res[:0]
+
+	}
+
+}
+
+func listGroupMembers(api *api) {
+
+	g := &secrets.Group{Namespace: api.namespace, Name: api.params["target"]}
+
+	iter := database.ListGroupMembers(g)
+
+	for {
+
+		res, err := iter(pageSize)
+		switch err {
+
+		case gorm.ErrRecordNotFound:
+			api.error("Group does not exist", 404)
+			return
+
+		case nil:
+			break
+
+		default:
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+
+		}
+
+		if len(res) == 0 {
+			return
+		}
+
+		data, err := json.MarshalIndent(&res, "", "  ")
+		if err != nil {
+			api.log().Error(err)
+			api.error("JSON error", 500)
+			return
+		}
+
+		api.resp.Write(data)
+
+		res = res[:0]
+
+	}
+
+}
@@ -0,0 +1,70 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"time"
+
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// The limits are set from Config.Lockout at startup and on reload.
+var (
+	ipLockout  = defaultConfig().Lockout.IP.tracker()
+	keyLockout = defaultConfig().Lockout.Key.tracker()
+)
+
+func lockoutID(k *secrets.Key) string {
+	return k.Namespace + "/" + k.Name
+}
+
+// lockedOut returns how long requests from ip, or for key k, are locked
+// out for, or 0.
+func lockedOut(ip string, k *secrets.Key) (d time.Duration) {
+	if ip != "" {
+		d = ipLockout.Locked(ip)
+	}
+	if k.Name != "" {
+		if kd := keyLockout.Locked(lockoutID(k)); kd > d {
+			d = kd
+		}
+	}
+	return
+}
+
+// authFailed counts a failed login against the source address and key,
+// and records any lockout that results.
+func (a *api) authFailed(ip string, k *secrets.Key) {
+	if ip != "" {
+		if d := ipLockout.Fail(ip); d > 0 {
+			a.lockout("ip", ip, k, d)
+		}
+	}
+	if k.Name != "" {
+		if d := keyLockout.Fail(lockoutID(k)); d > 0 {
+			a.lockout("key", ip, k, d)
+		}
+	}
+}
+
+// authSucceeded clears the failures for a key.  Failures from the source
+// address are kept, so that a valid key cannot be used to reset them.
+func authSucceeded(k *secrets.Key) {
+	keyLockout.Succeed(lockoutID(k))
+}
+
+func (a *api) lockout(scope, ip string, k *secrets.Key, d time.Duration) {
+	a.log().Warn("Locked out ", scope, " for ", d, ": key: ", k.Name, " from: ", ip)
+
+	authLockouts.WithLabelValues(scope).Inc()
+
+	auditLog.Log(&audit.Event{
+		RequestID: a.event().RequestID,
+		Namespace: k.Namespace,
+		KeyID:     k.Name,
+		Operation: "lockout",
+		Target:    scope,
+		Result:    audit.Denied,
+		Status:    401,
+		SourceIP:  ip,
+	})
+}
@@ -0,0 +1,146 @@
+// Package lockout tracks authentication failures and locks out sources
+// that fail too often, with an exponential backoff.
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracker counts failures by an arbitrary string, such as an IP address or
+// key ID.  It is safe for concurrent use.
+type Tracker struct {
+	// Failures allowed before a lockout.
+	Threshold int
+	// First lockout.  Each further failure doubles it, up to Max.
+	Base time.Duration
+	Max  time.Duration
+	// Failures are forgotten once nothing has failed for this long.
+	Window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	swept   time.Time
+	now     func() time.Time
+}
+
+type entry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// New returns a tracker which locks out after threshold failures, for
+// base doubling up to max.  Failures are forgotten after max.
+func New(threshold int, base, max time.Duration) *Tracker {
+	return &Tracker{
+		Threshold: threshold,
+		Base:      base,
+		Max:       max,
+		Window:    max,
+	}
+}
+
+// Configure changes the limits of a tracker which may be in use.  Failures
+// already recorded are kept.
+func (t *Tracker) Configure(threshold int, base, max time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Threshold = threshold
+	t.Base = base
+	t.Max = max
+	t.Window = max
+}
+
+func (t *Tracker) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// Locked returns how long id is still locked out for, or 0.
+func (t *Tracker) Locked(id string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[id]
+	if !ok {
+		return 0
+	}
+
+	if d := e.until.Sub(t.clock()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Fail records a failure for id.  If the failure starts a lockout, it
+// returns how long for, otherwise 0.
+func (t *Tracker) Fail(id string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock()
+	t.sweep(now)
+
+	if t.entries == nil {
+		t.entries = make(map[string]*entry)
+	}
+
+	e, ok := t.entries[id]
+	if !ok || now.Sub(e.last) > t.Window {
+		e = new(entry)
+		t.entries[id] = e
+	}
+
+	e.failures++
+	e.last = now
+
+	if e.failures < t.Threshold {
+		return 0
+	}
+
+	d := t.Base
+	for i := t.Threshold; i < e.failures && d < t.Max; i++ {
+		d *= 2
+	}
+	if d > t.Max {
+		d = t.Max
+	}
+
+	e.until = now.Add(d)
+	return d
+}
+
+// Succeed forgets the failures for id.
+func (t *Tracker) Succeed(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, id)
+}
+
+// Reset forgets every failure.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries = nil
+}
+
+// sweep drops expired entries, at most once per window, so that the map
+// does not grow without bound.
+func (t *Tracker) sweep(now time.Time) {
+	if now.Sub(t.swept) < t.Window {
+		return
+	}
+	t.swept = now
+
+	for id, e := range t.entries {
+		if now.Sub(e.last) > t.Window && now.After(e.until) {
+			delete(t.entries, id)
+		}
+	}
+}
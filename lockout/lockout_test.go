@@ -0,0 +1,55 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := New(3, time.Second, 10*time.Second)
+	tr.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), tr.Fail("a"))
+	assert.Equal(t, time.Duration(0), tr.Fail("a"))
+	assert.Equal(t, time.Duration(0), tr.Locked("a"))
+
+	assert.Equal(t, time.Second, tr.Fail("a"))
+	assert.Equal(t, time.Second, tr.Locked("a"))
+	assert.Equal(t, time.Duration(0), tr.Locked("b"))
+
+	assert.Equal(t, 2*time.Second, tr.Fail("a"))
+	assert.Equal(t, 4*time.Second, tr.Fail("a"))
+	assert.Equal(t, 8*time.Second, tr.Fail("a"))
+	assert.Equal(t, 10*time.Second, tr.Fail("a"))
+	assert.Equal(t, 10*time.Second, tr.Fail("a"))
+
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, 5*time.Second, tr.Locked("a"))
+
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, time.Duration(0), tr.Locked("a"))
+
+	tr.Succeed("a")
+	assert.Equal(t, time.Duration(0), tr.Fail("a"))
+}
+
+func TestWindow(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := New(2, time.Second, time.Minute)
+	tr.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), tr.Fail("a"))
+
+	// Old failures are forgotten
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, time.Duration(0), tr.Fail("a"))
+	assert.Equal(t, time.Second, tr.Fail("a"))
+
+	// and swept away
+	now = now.Add(2 * time.Minute)
+	tr.Fail("b")
+	assert.Len(t, tr.entries, 1)
+}
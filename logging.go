@@ -0,0 +1,83 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	stdLog "log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+)
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+var requestIDRegex = regexp.MustCompile(`^[0-9a-zA-Z_.\-]{1,64}$`)
+
+// accessLog writes one JSON line per request.
+var accessLog = &log.Logger{
+	Out:       os.Stdout,
+	Formatter: new(log.JSONFormatter),
+	Hooks:     make(log.LevelHooks),
+	Level:     log.InfoLevel,
+}
+
+// withRequestID gives every request an ID, keeping a well formed one sent
+// by the client, and returns it in the response.  The ID is stored in the
+// request header so handlers and the audit log can find it.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegex.MatchString(id) {
+			id = uuid.New()
+		}
+
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func requestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+// queryValue returns a parameter from the URL.  Unlike FormValue, it never
+// reads the request body.
+func queryValue(r *http.Request, key string) string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.Query().Get(key)
+}
+
+// logAccess records a served request.  Only the route template is logged,
+// never the URL, as it may contain credentials and secret names.
+func logAccess(r *http.Request, route string, status int, took time.Duration) {
+	keyID := r.Header.Get("X-Secret-ID")
+	if keyID == "" {
+		keyID = queryValue(r, "secretid")
+	}
+
+	accessLog.WithFields(log.Fields{
+		"request_id": requestID(r),
+		"method":     r.Method,
+		"route":      route,
+		"status":     status,
+		"duration":   took.Seconds(),
+		"key_id":     keyID,
+		"source_ip":  sourceIP(r),
+	}).Info("access")
+}
+
+// newErrorLog returns a logger for the HTTP server's own errors, such as
+// TLS handshake failures, which writes them to the main log.
+func newErrorLog() *stdLog.Logger {
+	return stdLog.New(log.StandardLogger().WriterLevel(log.WarnLevel), "", 0)
+}
@@ -1,10 +1,7 @@
 package main // import "github.com/nutmegdevelopment/nutcracker"
 
 import (
-	"crypto/tls"
 	"flag"
-	"io/ioutil"
-	stdLog "log"
 	"net/http"
 	"os"
 
@@ -12,86 +9,181 @@ import (
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/nutmegdevelopment/nutcracker/db"
-	"github.com/nutmegdevelopment/nutcracker/postgres"
 )
 
-var (
-	database  db.DB
-	viewCount int64
-	certID    string
-	certKey   string
-	certName  string
-)
-
-func init() {
-	flag.StringVar(&certID, "id", "", "ID to decrypt TLS cert")
-	flag.StringVar(&certKey, "key", "", "Key to decrypt TLS cert")
-	flag.StringVar(&certName, "cert", "", "Name of TLS cert.  Will use a selfsigned cert if empty")
-	flag.Parse()
+var database db.DB
 
-	database = new(postgres.DB)
+func addRoutes(r *mux.Router) {
+	r.HandleFunc("/health", Health).Methods("GET")
+	r.HandleFunc("/fingerprint", Fingerprint).Methods("GET")
+	r.HandleFunc("/auth", audited("auth", Auth)).Methods("GET")
+	r.HandleFunc("/initialise", audited("initialise", Initialise)).Methods("GET")
+	r.HandleFunc("/seal", audited("seal", Seal)).Methods("GET")
+	r.HandleFunc("/unseal", audited("unseal", Unseal)).Methods("GET")
+	r.HandleFunc("/secrets/message", audited("message", Message)).Methods("POST")
+	r.HandleFunc("/secrets/key", audited("key", Key)).Methods("POST")
+	r.HandleFunc("/secrets/share", audited("share", Share)).Methods("POST")
+	r.HandleFunc("/secrets/unshare", audited("unshare", Unshare)).Methods("POST")
+	r.HandleFunc("/secrets/policy", audited("policy", Policy)).Methods("POST")
+	r.HandleFunc("/secrets/attach", audited("attach", Attach)).Methods("POST")
+	r.HandleFunc("/secrets/detach", audited("detach", Detach)).Methods("POST")
+	r.HandleFunc("/secrets/group", audited("group", Group)).Methods("POST")
+	r.HandleFunc("/secrets/group/add", audited("group-add", GroupAdd)).Methods("POST")
+	r.HandleFunc("/secrets/group/remove", audited("group-remove", GroupRemove)).Methods("POST")
+	r.HandleFunc("/secrets/view", audited("view", View)).Methods("POST")
+	r.HandleFunc("/secrets/view/{messageName:.+}", audited("view", View)).Queries("secretid", "", "secretkey", "").Methods("GET")
+	r.HandleFunc("/secrets/list/{type}", audited("list", List)).Methods("GET")
+	r.HandleFunc("/secrets/list/{type}/{target:.+}", audited("list", List)).Methods("GET")
+	r.HandleFunc("/secrets/stats/{type}", audited("stats", Stats)).Methods("GET")
+	r.HandleFunc("/secrets/stats/{type}/{target:.+}", audited("stats", Stats)).Methods("GET")
+	r.HandleFunc("/secrets/audit", audited("audit", Audit)).Methods("GET")
+	r.HandleFunc("/secrets/backup", audited("backup", Backup)).Methods("POST")
+	r.HandleFunc("/secrets/update", audited("update", Update)).Methods("POST")
+	r.HandleFunc("/secrets/delete/{type}/{target:.+}", audited("delete", Delete)).Methods("DELETE")
 }
 
-func addRoutes(r *mux.Router) {
+// addMonitoringRoutes adds the unauthenticated routes served over plain
+// HTTP for health checks and metrics scrapes.
+func addMonitoringRoutes(r *mux.Router) {
 	r.HandleFunc("/health", Health).Methods("GET")
-	r.HandleFunc("/auth", Auth).Methods("GET")
+	r.HandleFunc("/ready", Ready).Methods("GET")
 	r.HandleFunc("/metrics", Metrics).Methods("GET")
-	r.HandleFunc("/initialise", Initialise).Methods("GET")
-	r.HandleFunc("/seal", Seal).Methods("GET")
-	r.HandleFunc("/unseal", Unseal).Methods("GET")
-	r.HandleFunc("/secrets/message", Message).Methods("POST")
-	r.HandleFunc("/secrets/key", Key).Methods("POST")
-	r.HandleFunc("/secrets/share", Share).Methods("POST")
-	r.HandleFunc("/secrets/view", View).Methods("POST")
-	r.HandleFunc("/secrets/view/{messageName}", View).Queries("secretid", "", "secretkey", "").Methods("GET")
-	r.HandleFunc("/secrets/list/{type}", List).Methods("GET")
-	r.HandleFunc("/secrets/list/{type}/{target}", List).Methods("GET")
-	r.HandleFunc("/secrets/update", Update).Methods("POST")
-	r.HandleFunc("/secrets/delete/{type}/{target}", Delete).Methods("DELETE")
+}
+
+// newMonitoringServer returns the plain HTTP monitoring server.
+func newMonitoringServer(addr string) *http.Server {
+	r := mux.NewRouter()
+	addMonitoringRoutes(r)
+
+	server := new(http.Server)
+	server.ErrorLog = newErrorLog()
+	server.Addr = addr
+	server.Handler = context.ClearHandler(withRequestID(instrument(r)))
+	return server
 }
 
 func main() {
+	flag.Parse()
+
+	commands := map[string]func([]string) error{
+		"migrate": migrateCommand,
+		"backup":  backupCommand,
+		"restore": restoreCommand,
+		"audit":   auditCommand,
+	}
+	if command, ok := commands[flag.Arg(0)]; ok {
+		err := command(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	err := database.Connect()
+	conf, err := readConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf.apply()
+	pageSize = conf.PageSize
+
+	database = db.Timed(conf.Database.open(), observeDB)
 
-	addr := os.Getenv("LISTEN")
-	if addr == "" {
-		addr = "0.0.0.0:8443"
+	err = database.Connect()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if os.Getenv("DEBUG") == "true" {
-		log.SetLevel(log.DebugLevel)
+	if flagDev {
+		log.Warn("Running in dev mode")
+		err = initDev(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	var cert tls.Certificate
+	err = openAuditLog(conf.Audit)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if certName == "" {
-		log.Info("Generating self-signed certificate")
-		cert, err = GenCert()
-	} else {
-		log.Info("Using certificate from vault")
-		cert, err = GetNutcrackerCert()
+	_, err = syncPolicies(conf.Policies)
+	if err != nil {
+		log.Fatal(err)
 	}
+
+	serverCerts.config = conf.TLS
+	err = loadServerCert(conf.TLS)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sock, err := Socket(addr, cert)
+	sock, err := Socket(conf.Listen, conf.TLS, serverCerts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	stopReload := make(chan struct{})
+	if conf.TLS.configured() && conf.TLS.ReloadInterval > 0 {
+		go serverCerts.reloadEvery(conf.TLS.ReloadInterval, stopReload)
+	}
+
 	r := mux.NewRouter()
 	addRoutes(r)
 
 	server := new(http.Server)
-	server.ErrorLog = new(stdLog.Logger)
-	server.ErrorLog.SetOutput(ioutil.Discard)
-	server.Addr = addr
-	server.Handler = context.ClearHandler(r)
-	log.Infof("HTTPS server listening on: %s", addr)
-	server.Serve(sock)
+	server.ErrorLog = newErrorLog()
+	server.Addr = conf.Listen
+	server.Handler = context.ClearHandler(withRequestID(instrument(r)))
+
+	monitor := newMonitoringServer(conf.ListenHTTP)
+
+	stop := notifyShutdown()
+	hup := notifyReload()
+	errs := make(chan error, 2)
+
+	go func() {
+		log.Infof("HTTP monitoring server listening on: %s", monitor.Addr)
+		errs <- monitor.ListenAndServe()
+	}()
+
+	go func() {
+		log.Infof("HTTPS server listening on: %s", server.Addr)
+		errs <- server.Serve(sock)
+	}()
+
+	var failed error
+
+loop:
+	for {
+		select {
+
+		case <-hup:
+			c, err := reload(conf, serverCerts)
+			if err != nil {
+				log.Error("Reload failed: ", err)
+			} else {
+				conf = c
+				log.Info("Configuration reloaded")
+			}
+
+		case sig := <-stop:
+			log.Infof("Received %s, shutting down", sig)
+			break loop
+
+		case failed = <-errs:
+			log.Error(failed)
+			break loop
+
+		}
+	}
+
+	close(stopReload)
+	err = shutdown(conf.ShutdownTimeout, serverCerts.Get(), server, monitor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed != nil {
+		os.Exit(1)
+	}
+	log.Info("Shut down cleanly")
 }
@@ -0,0 +1,55 @@
+package memory
+
+import (
+	"github.com/nutmegdevelopment/nutcracker/audit"
+)
+
+// AddAuditEvent appends an event to the audit log.
+func (m *DB) AddAuditEvent(e *audit.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.ID = m.nextID()
+	m.events = append(m.events, *e)
+	return nil
+}
+
+// GetLastAuditEvent selects the most recent audit event.
+// The event is left empty if there are none.
+func (m *DB) GetLastAuditEvent(e *audit.Event) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.events) > 0 {
+		*e = m.events[len(m.events)-1]
+	}
+	return nil
+}
+
+// ListAuditEvents returns an iterator function that walks through the audit events matching q, oldest first.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (m *DB) ListAuditEvents(q *audit.Query) func(int) ([]audit.Event, error) {
+	pos := q.Offset
+
+	return func(n int) (res []audit.Event, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		var found []audit.Event
+		for _, e := range m.events {
+			if (q.Namespace == "" || e.Namespace == q.Namespace) &&
+				(q.KeyID == "" || e.KeyID == q.KeyID) &&
+				(q.Target == "" || e.Target == q.Target) &&
+				(q.Operation == "" || e.Operation == q.Operation) &&
+				(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+				(q.Until.IsZero() || e.Time.Before(q.Until)) {
+				found = append(found, e)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		res = append(res, found[lo:hi]...)
+		pos += len(res)
+		return
+	}
+}
@@ -0,0 +1,283 @@
+package memory
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// AddGroup inserts a new group into the DB
+func (m *DB) AddGroup(g *secrets.Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g.Namespace = ns(g.Namespace)
+
+	if m.findGroup(g.Namespace, g.Name) != nil {
+		return errors.New("Group already exists")
+	}
+
+	g.ID = m.nextID()
+	m.groups = append(m.groups, *g)
+	return nil
+}
+
+// GetGroup selects a group by name.
+func (m *DB) GetGroup(g *secrets.Group) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g.Namespace = ns(g.Namespace)
+	return m.getGroup(g)
+}
+
+// ListGroups returns an iterator function that walks through all groups in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (m *DB) ListGroups(namespace string) func(int) ([]secrets.Group, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Group, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		var found []secrets.Group
+		for _, g := range m.groups {
+			if g.Namespace == namespace {
+				found = append(found, g)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		res = append(res, found[lo:hi]...)
+		pos += len(res)
+		return
+	}
+}
+
+// DeleteGroup removes a group, its members and every share made through it.
+func (m *DB) DeleteGroup(g *secrets.Group) (err error) {
+	if g == nil || g.Name == "" {
+		return errors.New("No group specified")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g.Namespace = ns(g.Namespace)
+	err = m.getGroup(g)
+	if err != nil {
+		return
+	}
+
+	m.removeSecrets(func(s *secrets.Secret) bool {
+		return !s.Root && s.GroupID == g.ID
+	})
+	m.removeGroupMembers(func(l *secrets.GroupMember) bool {
+		return l.GroupID == g.ID
+	})
+	m.removeGroupSecrets(func(l *secrets.GroupSecret) bool {
+		return l.GroupID == g.ID
+	})
+
+	kept := m.groups[:0]
+	for _, e := range m.groups {
+		if e.ID != g.ID {
+			kept = append(kept, e)
+		}
+	}
+	m.groups = kept
+	return nil
+}
+
+// AddGroupMember adds a key to a group.  It does not share any secrets,
+// the caller is responsible for sharing the group's secrets with the key.
+func (m *DB) AddGroupMember(g *secrets.Group, k *secrets.Key) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = m.getGroupAndKey(g, k)
+	if err != nil {
+		return
+	}
+
+	for _, l := range m.groupMembers {
+		if l.GroupID == g.ID && l.KeyID == k.ID {
+			return errors.New("Key is already a member")
+		}
+	}
+
+	m.groupMembers = append(m.groupMembers, secrets.GroupMember{ID: m.nextID(), GroupID: g.ID, KeyID: k.ID})
+	return nil
+}
+
+// RemoveGroupMember removes a key from a group, along with every share
+// the key was given through the group.
+func (m *DB) RemoveGroupMember(g *secrets.Group, k *secrets.Key) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = m.getGroupAndKey(g, k)
+	if err != nil {
+		return
+	}
+
+	m.removeSecrets(func(s *secrets.Secret) bool {
+		return !s.Root && s.GroupID == g.ID && s.KeyID == k.ID
+	})
+	m.removeGroupMembers(func(l *secrets.GroupMember) bool {
+		return l.GroupID == g.ID && l.KeyID == k.ID
+	})
+	return nil
+}
+
+// ListGroupMembers returns an iterator function that walks through the keys in a group.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (m *DB) ListGroupMembers(g *secrets.Group) func(int) ([]secrets.Key, error) {
+	pos := 0
+
+	return func(n int) (res []secrets.Key, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		g.Namespace = ns(g.Namespace)
+		err = m.getGroup(g)
+		if err != nil {
+			return
+		}
+
+		ids := map[uint]bool{}
+		for _, l := range m.groupMembers {
+			if l.GroupID == g.ID {
+				ids[l.KeyID] = true
+			}
+		}
+
+		var found []secrets.Key
+		for _, k := range m.keys {
+			if ids[k.ID] {
+				found = append(found, k)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		for _, k := range found[lo:hi] {
+			res = append(res, copyKey(k))
+		}
+		pos += len(res)
+		return
+	}
+}
+
+// AddGroupSecret records that a secret is shared with a group.  It does
+// not share the secret with the group's members.
+func (m *DB) AddGroupSecret(g *secrets.Group, s *secrets.Secret) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g.Namespace = ns(g.Namespace)
+	err = m.getGroup(g)
+	if err != nil {
+		return
+	}
+
+	for _, l := range m.groupSecrets {
+		if l.GroupID == g.ID && l.Name == s.Name {
+			return nil
+		}
+	}
+
+	m.groupSecrets = append(m.groupSecrets, secrets.GroupSecret{ID: m.nextID(), GroupID: g.ID, Name: s.Name})
+	return nil
+}
+
+// ListGroupSecrets returns an iterator function that walks through the secrets shared with a group.
+// Only the namespace and name of each secret are set.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (m *DB) ListGroupSecrets(g *secrets.Group) func(int) ([]secrets.Secret, error) {
+	pos := 0
+
+	return func(n int) (res []secrets.Secret, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		g.Namespace = ns(g.Namespace)
+		err = m.getGroup(g)
+		if err != nil {
+			return
+		}
+
+		var found []secrets.GroupSecret
+		for _, l := range m.groupSecrets {
+			if l.GroupID == g.ID {
+				found = append(found, l)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		for _, l := range found[lo:hi] {
+			res = append(res, secrets.Secret{Namespace: g.Namespace, Name: l.Name})
+		}
+		pos += len(res)
+		return
+	}
+}
+
+func (m *DB) findGroup(namespace, name string) *secrets.Group {
+	for i, g := range m.groups {
+		if g.Namespace == namespace && g.Name == name {
+			return &m.groups[i]
+		}
+	}
+	return nil
+}
+
+func (m *DB) getGroup(g *secrets.Group) error {
+	found := m.findGroup(g.Namespace, g.Name)
+	if found == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	*g = *found
+	return nil
+}
+
+func (m *DB) getGroupAndKey(g *secrets.Group, k *secrets.Key) error {
+	g.Namespace = ns(g.Namespace)
+	err := m.getGroup(g)
+	if err != nil {
+		return err
+	}
+
+	k.Namespace = ns(k.Namespace)
+	err = m.getKey(k)
+	if err != nil {
+		return err
+	}
+
+	if k.Namespace != g.Namespace {
+		return errors.New("Key and group are in different namespaces")
+	}
+	return nil
+}
+
+func (m *DB) removeGroupMembers(match func(*secrets.GroupMember) bool) {
+	kept := m.groupMembers[:0]
+	for i := range m.groupMembers {
+		if !match(&m.groupMembers[i]) {
+			kept = append(kept, m.groupMembers[i])
+		}
+	}
+	m.groupMembers = kept
+}
+
+func (m *DB) removeGroupSecrets(match func(*secrets.GroupSecret) bool) {
+	kept := m.groupSecrets[:0]
+	for i := range m.groupSecrets {
+		if !match(&m.groupSecrets[i]) {
+			kept = append(kept, m.groupSecrets[i])
+		}
+	}
+	m.groupSecrets = kept
+}
@@ -0,0 +1,726 @@
+// Package memory keeps the vault in memory, for development and tests.
+// Everything is lost when the process exits.
+package memory
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// DB is an implementation of the db.DB interface.  Records are held in
+// ID order, and copied in and out so that callers cannot change them.
+type DB struct {
+	mu        sync.RWMutex
+	connected bool
+	lastID    uint
+
+	secrets      []secrets.Secret
+	keys         []secrets.Key
+	policies     []acl.Policy
+	keyPolicies  []acl.KeyPolicy
+	groups       []secrets.Group
+	groupMembers []secrets.GroupMember
+	groupSecrets []secrets.GroupSecret
+	stats        []secrets.Stats
+	events       []audit.Event
+}
+
+// Connect makes the database ready for use.  It keeps anything already
+// stored.
+func (m *DB) Connect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connected = true
+	return nil
+}
+
+// ns returns the namespace to use for a query.
+func ns(namespace string) string {
+	if namespace == "" {
+		return secrets.DefaultNamespace
+	}
+	return namespace
+}
+
+// nextID returns a new ID.  IDs are unique across every table, which
+// keeps each table in ID order.
+func (m *DB) nextID() uint {
+	m.lastID++
+	return m.lastID
+}
+
+// Ping checks that the database is connected
+func (m *DB) Ping() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.connected {
+		return errors.New("Database is not connected")
+	}
+	return nil
+}
+
+// Close wipes the keys and secrets, and empties the database.
+func (m *DB) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.secrets {
+		secrets.Zero(m.secrets[i].Message)
+		secrets.Zero(m.secrets[i].Nonce)
+		secrets.Zero(m.secrets[i].Pubkey)
+	}
+	for i := range m.keys {
+		secrets.Zero(m.keys[i].Key)
+		secrets.Zero(m.keys[i].Nonce)
+		secrets.Zero(m.keys[i].Public)
+	}
+
+	m.connected = false
+	m.secrets, m.keys, m.policies, m.keyPolicies = nil, nil, nil, nil
+	m.groups, m.groupMembers, m.groupSecrets = nil, nil, nil
+	m.stats, m.events = nil, nil
+	return nil
+}
+
+// AddSecret inserts a new secret into the DB, and its key if it does not
+// exist yet.
+func (m *DB) AddSecret(s *secrets.Secret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.Namespace = ns(s.Namespace)
+	if s.Key.Namespace == "" {
+		s.Key.Namespace = s.Namespace
+	}
+
+	if s.Root {
+		for _, e := range m.secrets {
+			if e.Root && e.Namespace == s.Namespace && e.Name == s.Name {
+				return errors.New("Secret already exists")
+			}
+		}
+	}
+
+	if k := m.findKey(&secrets.Key{Namespace: s.Key.Namespace, Name: s.Key.Name}); k != nil {
+		s.Key.ID = k.ID
+	} else {
+		err := m.addKey(&s.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.KeyID = s.Key.ID
+	m.addSecret(s)
+	return nil
+}
+
+// AddKey inserts a key into the DB
+func (m *DB) AddKey(k *secrets.Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addKey(k)
+}
+
+// GetKey selects a key by ID or by name.
+func (m *DB) GetKey(k *secrets.Key) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k.Namespace = ns(k.Namespace)
+	return m.getKey(k)
+}
+
+// GetRootSecret returns the latest matching root secret
+func (m *DB) GetRootSecret(s *secrets.Secret) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s.Namespace = ns(s.Namespace)
+	s.Root = true
+	return m.getSecret(s)
+}
+
+// GetSharedSecret returns the shared cert linking s and k
+func (m *DB) GetSharedSecret(s *secrets.Secret, k *secrets.Key) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k.Namespace = ns(k.Namespace)
+	err := m.getKey(k)
+	if err != nil {
+		return err
+	}
+
+	s.Namespace = k.Namespace
+	s.Root = false
+	s.KeyID = k.ID
+	return m.getSecret(s)
+}
+
+// UpdateSecret updates a secret by adding a new copy of it to the db.
+func (m *DB) UpdateSecret(s *secrets.Secret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s.KeyID == 0 {
+		s.KeyID = s.Key.ID
+	}
+	m.addSecret(s)
+	return nil
+}
+
+// ListSecrets returns an iterator function that walks through all secrets in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a key name is specified, the results are limited to secrets shared with that key.
+// If a prefix is specified, the results are limited to secrets whose names start with it.
+func (m *DB) ListSecrets(namespace string, key *string, prefix string) func(int) ([]secrets.Secret, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Secret, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		ids := map[uint]bool{}
+		if key != nil {
+			for _, k := range m.keys {
+				if k.Name == *key {
+					ids[k.ID] = true
+				}
+			}
+		}
+
+		var found []secrets.Secret
+		for _, s := range m.secrets {
+			if s.Namespace == namespace && strings.HasPrefix(s.Name, prefix) && (key == nil || ids[s.KeyID]) {
+				found = append(found, s)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		for _, s := range found[lo:hi] {
+			res = append(res, copySecret(s))
+		}
+		pos += len(res)
+		return
+	}
+}
+
+// ListKeys returns an iterator function that walks through all keys in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a secret name is specified, the results are limited to keys with access to that secret.
+func (m *DB) ListKeys(namespace string, secret *string) func(int) ([]secrets.Key, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Key, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		ids := map[uint]bool{}
+		if secret != nil {
+			for _, s := range m.secrets {
+				if s.Name == *secret {
+					ids[s.KeyID] = true
+				}
+			}
+		}
+
+		var found []secrets.Key
+		for _, k := range m.keys {
+			if k.Namespace == namespace && (secret == nil || ids[k.ID]) {
+				found = append(found, k)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		for _, k := range found[lo:hi] {
+			res = append(res, copyKey(k))
+		}
+		pos += len(res)
+		return
+	}
+}
+
+// DeleteSecret removes a secret from the DB
+func (m *DB) DeleteSecret(s *secrets.Secret) (err error) {
+	if s == nil || s.Name == "" {
+		return errors.New("No secret specified")
+	}
+
+	if s.Name == "master" {
+		return errors.New("Cannot delete master")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.Namespace = ns(s.Namespace)
+
+	inNamespace := map[uint]bool{}
+	for _, g := range m.groups {
+		if g.Namespace == s.Namespace {
+			inNamespace[g.ID] = true
+		}
+	}
+
+	m.removeGroupSecrets(func(l *secrets.GroupSecret) bool {
+		return l.Name == s.Name && inNamespace[l.GroupID]
+	})
+	m.removeStats(s.Namespace, secrets.SecretStats, s.Name)
+	m.removeSecrets(func(e *secrets.Secret) bool {
+		return e.Namespace == s.Namespace && e.Name == s.Name
+	})
+	return nil
+}
+
+// DeleteSharedSecret removes every share linking s and k, leaving both in place.
+// It returns gorm.ErrRecordNotFound if the secret was not shared with the key.
+func (m *DB) DeleteSharedSecret(s *secrets.Secret, k *secrets.Key) (err error) {
+	if s == nil || s.Name == "" {
+		return errors.New("No secret specified")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k.Namespace = ns(k.Namespace)
+	err = m.getKey(k)
+	if err != nil {
+		return
+	}
+
+	n := m.removeSecrets(func(e *secrets.Secret) bool {
+		return !e.Root && e.Namespace == k.Namespace && e.Name == s.Name && e.KeyID == k.ID
+	})
+	if n == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteKey removes a key, its policy attachments, group memberships,
+// shares and stats from the DB
+func (m *DB) DeleteKey(k *secrets.Key) (err error) {
+	if k == nil || k.Name == "" {
+		return errors.New("No key specified")
+	}
+
+	if k.Name == "master" {
+		return errors.New("Cannot delete master")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k.Namespace = ns(k.Namespace)
+
+	found := m.findKey(&secrets.Key{Namespace: k.Namespace, Name: k.Name})
+	if found == nil {
+		return nil
+	}
+	id := found.ID
+
+	m.removeKeyPolicies(func(l *acl.KeyPolicy) bool {
+		return l.KeyID == id
+	})
+	m.removeGroupMembers(func(l *secrets.GroupMember) bool {
+		return l.KeyID == id
+	})
+	m.removeStats(k.Namespace, secrets.KeyStats, k.Name)
+	m.removeSecrets(func(e *secrets.Secret) bool {
+		return !e.Root && e.KeyID == id
+	})
+
+	kept := m.keys[:0]
+	for _, e := range m.keys {
+		if e.ID != id {
+			kept = append(kept, e)
+		}
+	}
+	m.keys = kept
+	return nil
+}
+
+// AddPolicy inserts a new policy and its rules into the DB
+func (m *DB) AddPolicy(pol *acl.Policy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pol.Namespace = ns(pol.Namespace)
+
+	if m.findPolicy(pol.Namespace, pol.Name) != nil {
+		return errors.New("Policy already exists")
+	}
+
+	pol.ID = m.nextID()
+	m.setRules(pol)
+	m.policies = append(m.policies, copyPolicy(*pol))
+	return nil
+}
+
+// GetPolicy selects a policy and its rules by name.
+func (m *DB) GetPolicy(pol *acl.Policy) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	pol.Namespace = ns(pol.Namespace)
+	return m.getPolicy(pol)
+}
+
+// ListPolicies returns an iterator function that walks through all policies in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a key name is specified, the results are limited to policies attached to that key.
+func (m *DB) ListPolicies(namespace string, key *string) func(int) ([]acl.Policy, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []acl.Policy, err error) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		ids := map[uint]bool{}
+		if key != nil {
+			if k := m.findKey(&secrets.Key{Namespace: namespace, Name: *key}); k != nil {
+				for _, l := range m.keyPolicies {
+					if l.KeyID == k.ID {
+						ids[l.PolicyID] = true
+					}
+				}
+			}
+		}
+
+		var found []acl.Policy
+		for _, p := range m.policies {
+			if p.Namespace == namespace && (key == nil || ids[p.ID]) {
+				found = append(found, p)
+			}
+		}
+
+		lo, hi := window(len(found), pos, n)
+		for _, p := range found[lo:hi] {
+			res = append(res, copyPolicy(p))
+		}
+		pos += len(res)
+		return
+	}
+}
+
+// UpdatePolicy replaces the rules of an existing policy.  Keys it is
+// attached to keep it.
+func (m *DB) UpdatePolicy(pol *acl.Policy) (err error) {
+	if pol == nil || pol.Name == "" {
+		return errors.New("No policy specified")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := m.findPolicy(ns(pol.Namespace), pol.Name)
+	if existing == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	pol.ID = existing.ID
+	pol.Namespace = existing.Namespace
+	m.setRules(pol)
+	existing.Rules = copyPolicy(*pol).Rules
+	return nil
+}
+
+// DeletePolicy removes a policy, its rules and any key attachments from the DB
+func (m *DB) DeletePolicy(pol *acl.Policy) (err error) {
+	if pol == nil || pol.Name == "" {
+		return errors.New("No policy specified")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pol.Namespace = ns(pol.Namespace)
+	err = m.getPolicy(pol)
+	if err != nil {
+		return
+	}
+
+	m.removeKeyPolicies(func(l *acl.KeyPolicy) bool {
+		return l.PolicyID == pol.ID
+	})
+
+	kept := m.policies[:0]
+	for _, p := range m.policies {
+		if p.ID != pol.ID {
+			kept = append(kept, p)
+		}
+	}
+	m.policies = kept
+	return nil
+}
+
+// AttachPolicy grants the policy to a key
+func (m *DB) AttachPolicy(k *secrets.Key, pol *acl.Policy) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, err := m.keyPolicy(k, pol)
+	if err != nil {
+		return
+	}
+
+	for _, l := range m.keyPolicies {
+		if l.KeyID == link.KeyID && l.PolicyID == link.PolicyID {
+			return nil
+		}
+	}
+
+	link.ID = m.nextID()
+	m.keyPolicies = append(m.keyPolicies, link)
+	return nil
+}
+
+// DetachPolicy removes the policy from a key
+func (m *DB) DetachPolicy(k *secrets.Key, pol *acl.Policy) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, err := m.keyPolicy(k, pol)
+	if err != nil {
+		return
+	}
+
+	m.removeKeyPolicies(func(l *acl.KeyPolicy) bool {
+		return l.KeyID == link.KeyID && l.PolicyID == link.PolicyID
+	})
+	return nil
+}
+
+// Namespaces lists every namespace holding a secret, key, policy or group.
+func (m *DB) Namespaces() (res []string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := map[string]bool{}
+	for _, s := range m.secrets {
+		seen[s.Namespace] = true
+	}
+	for _, k := range m.keys {
+		seen[k.Namespace] = true
+	}
+	for _, p := range m.policies {
+		seen[p.Namespace] = true
+	}
+	for _, g := range m.groups {
+		seen[g.Namespace] = true
+	}
+
+	for namespace := range seen {
+		res = append(res, namespace)
+	}
+	sort.Strings(res)
+	return
+}
+
+// Metrics returns data about the state of the database
+func (m *DB) Metrics() (map[string]interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return map[string]interface{}{
+		"secrets":  len(m.secrets),
+		"keys":     len(m.keys),
+		"policies": len(m.policies),
+		"groups":   len(m.groups),
+	}, nil
+}
+
+func (m *DB) addSecret(s *secrets.Secret) {
+	s.ID = m.nextID()
+
+	// The key is stored on its own, and stats are not stored at all.
+	stored := copySecret(*s)
+	stored.Key = secrets.Key{}
+	m.secrets = append(m.secrets, stored)
+}
+
+func (m *DB) addKey(k *secrets.Key) error {
+	k.Namespace = ns(k.Namespace)
+
+	if m.findKey(&secrets.Key{Namespace: k.Namespace, Name: k.Name}) != nil {
+		return errors.New("Key already exists")
+	}
+
+	k.ID = m.nextID()
+	m.keys = append(m.keys, copyKey(*k))
+	return nil
+}
+
+// findKey returns the stored key matching the ID, namespace and name of
+// k, whichever are set, or nil.
+func (m *DB) findKey(k *secrets.Key) *secrets.Key {
+	for i, e := range m.keys {
+		if (k.ID == 0 || e.ID == k.ID) &&
+			(k.Namespace == "" || e.Namespace == k.Namespace) &&
+			(k.Name == "" || e.Name == k.Name) {
+			return &m.keys[i]
+		}
+	}
+	return nil
+}
+
+func (m *DB) getKey(k *secrets.Key) error {
+	found := m.findKey(k)
+	if found == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	*k = copyKey(*found)
+	return nil
+}
+
+// getSecret fills in s from the latest secret matching its namespace,
+// name, root flag and key, along with its key.
+func (m *DB) getSecret(s *secrets.Secret) error {
+	for i := len(m.secrets) - 1; i >= 0; i-- {
+		e := m.secrets[i]
+		if e.Namespace == s.Namespace && e.Root == s.Root &&
+			(s.Name == "" || e.Name == s.Name) &&
+			(s.KeyID == 0 || e.KeyID == s.KeyID) {
+			*s = copySecret(e)
+			s.Key.ID = s.KeyID
+			return m.getKey(&s.Key)
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (m *DB) findPolicy(namespace, name string) *acl.Policy {
+	for i, p := range m.policies {
+		if p.Namespace == namespace && p.Name == name {
+			return &m.policies[i]
+		}
+	}
+	return nil
+}
+
+func (m *DB) getPolicy(pol *acl.Policy) error {
+	found := m.findPolicy(pol.Namespace, pol.Name)
+	if found == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	*pol = copyPolicy(*found)
+	return nil
+}
+
+// setRules gives the rules of pol new IDs.
+func (m *DB) setRules(pol *acl.Policy) {
+	for i := range pol.Rules {
+		pol.Rules[i].ID = m.nextID()
+		pol.Rules[i].PolicyID = pol.ID
+	}
+}
+
+// keyPolicy looks up k and pol, and returns the link between them.
+func (m *DB) keyPolicy(k *secrets.Key, pol *acl.Policy) (link acl.KeyPolicy, err error) {
+	k.Namespace = ns(k.Namespace)
+	err = m.getKey(k)
+	if err != nil {
+		return
+	}
+
+	pol.Namespace = ns(pol.Namespace)
+	err = m.getPolicy(pol)
+	if err != nil {
+		return
+	}
+
+	if k.Namespace != pol.Namespace {
+		return link, errors.New("Key and policy are in different namespaces")
+	}
+
+	return acl.KeyPolicy{KeyID: k.ID, PolicyID: pol.ID}, nil
+}
+
+func (m *DB) removeSecrets(match func(*secrets.Secret) bool) (n int) {
+	kept := m.secrets[:0]
+	for i := range m.secrets {
+		if match(&m.secrets[i]) {
+			n++
+		} else {
+			kept = append(kept, m.secrets[i])
+		}
+	}
+	m.secrets = kept
+	return
+}
+
+func (m *DB) removeKeyPolicies(match func(*acl.KeyPolicy) bool) {
+	kept := m.keyPolicies[:0]
+	for i := range m.keyPolicies {
+		if !match(&m.keyPolicies[i]) {
+			kept = append(kept, m.keyPolicies[i])
+		}
+	}
+	m.keyPolicies = kept
+}
+
+// window returns the bounds of the page of n results starting at pos.
+func window(total, pos, n int) (lo, hi int) {
+	if pos > total {
+		pos = total
+	}
+	hi = total
+	if n >= 0 && pos+n < total {
+		hi = pos + n
+	}
+	return pos, hi
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func copyKey(k secrets.Key) secrets.Key {
+	return secrets.Key{
+		ID:        k.ID,
+		Namespace: k.Namespace,
+		Name:      k.Name,
+		Key:       clone(k.Key),
+		Nonce:     clone(k.Nonce),
+		Public:    clone(k.Public),
+		ReadOnly:  k.ReadOnly,
+	}
+}
+
+func copySecret(s secrets.Secret) secrets.Secret {
+	s.Message = clone(s.Message)
+	s.Nonce = clone(s.Nonce)
+	s.Pubkey = clone(s.Pubkey)
+	s.Key = copyKey(s.Key)
+	s.Stats = nil
+	return s
+}
+
+func copyPolicy(p acl.Policy) acl.Policy {
+	rules := p.Rules
+	p.Rules = nil
+	for _, r := range rules {
+		r.Capabilities = append(acl.Capabilities{}, r.Capabilities...)
+		p.Rules = append(p.Rules, r)
+	}
+	return p
+}
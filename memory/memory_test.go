@@ -0,0 +1,38 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/db/dbtest"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ db.DB = new(DB)
+
+func TestDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) (db.DB, func()) {
+		d := new(DB)
+		if err := d.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return d, func() { d.Close() }
+	})
+}
+
+func TestCopies(t *testing.T) {
+	d := new(DB)
+	assert.Nil(t, d.Connect())
+
+	k := &secrets.Key{Name: "app", Public: []byte("public")}
+	assert.Nil(t, d.AddKey(k))
+	secrets.Zero(k.Public)
+
+	found := &secrets.Key{Name: "app"}
+	assert.Nil(t, d.GetKey(found))
+	assert.Equal(t, []byte("public"), found.Public, "Callers cannot change a stored key")
+
+	assert.Nil(t, d.Close())
+	assert.NotNil(t, d.Ping())
+}
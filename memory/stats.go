@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// RecordView counts a view of s by k in the stats for both.
+func (m *DB) RecordView(s *secrets.Secret, k *secrets.Key) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	m.addView(ns(s.Namespace), secrets.SecretStats, s.Name, k.Name, now)
+	m.addView(ns(k.Namespace), secrets.KeyStats, k.Name, s.Name, now)
+	return nil
+}
+
+func (m *DB) addView(namespace, typ, name, peer string, now time.Time) {
+	st := m.findStats(namespace, typ, name)
+	if st == nil {
+		m.stats = append(m.stats, secrets.Stats{ID: m.nextID(), Namespace: namespace, Type: typ, Name: name})
+		st = &m.stats[len(m.stats)-1]
+	}
+
+	st.Views++
+	st.LastViewed = &now
+	st.LastPeer = peer
+}
+
+// GetStats selects the stats for a secret or key by type and name.
+// It returns gorm.ErrRecordNotFound if it has never been viewed.
+func (m *DB) GetStats(st *secrets.Stats) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	st.Namespace = ns(st.Namespace)
+	found := m.findStats(st.Namespace, st.Type, st.Name)
+	if found == nil {
+		return gorm.ErrRecordNotFound
+	}
+
+	*st = *found
+	if found.LastViewed != nil {
+		viewed := *found.LastViewed
+		st.LastViewed = &viewed
+	}
+	return nil
+}
+
+// ListStats selects the stats for the secrets or keys of one type with
+// the given names.  Names which have never been viewed are left out.
+func (m *DB) ListStats(namespace, typ string, names []string) (res []secrets.Stats, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	namespace = ns(namespace)
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	for _, st := range m.stats {
+		if st.Namespace == namespace && st.Type == typ && wanted[st.Name] {
+			if st.LastViewed != nil {
+				viewed := *st.LastViewed
+				st.LastViewed = &viewed
+			}
+			res = append(res, st)
+		}
+	}
+	return
+}
+
+// AddStats inserts stats as they are, rather than counting a view.
+func (m *DB) AddStats(st *secrets.Stats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st.Namespace = ns(st.Namespace)
+	if m.findStats(st.Namespace, st.Type, st.Name) != nil {
+		return errors.New("Stats already exist")
+	}
+
+	st.ID = m.nextID()
+	added := *st
+	if st.LastViewed != nil {
+		viewed := *st.LastViewed
+		added.LastViewed = &viewed
+	}
+	m.stats = append(m.stats, added)
+	return nil
+}
+
+func (m *DB) findStats(namespace, typ, name string) *secrets.Stats {
+	for i, st := range m.stats {
+		if st.Namespace == namespace && st.Type == typ && st.Name == name {
+			return &m.stats[i]
+		}
+	}
+	return nil
+}
+
+func (m *DB) removeStats(namespace, typ, name string) {
+	kept := m.stats[:0]
+	for _, st := range m.stats {
+		if st.Namespace != namespace || st.Type != typ || st.Name != name {
+			kept = append(kept, st)
+		}
+	}
+	m.stats = kept
+}
@@ -0,0 +1,145 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	startTime = time.Now()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nutcracker_http_requests_total",
+		Help: "HTTP requests served, by route and status code.",
+	}, []string{"route", "method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nutcracker_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nutcracker_auth_failures_total",
+		Help: "Requests whose credentials were missing or invalid.",
+	})
+
+	authLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nutcracker_auth_lockouts_total",
+		Help: "Lockouts after repeated authentication failures, by scope (ip or key).",
+	}, []string{"scope"})
+
+	secretViews = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nutcracker_secret_views_total",
+		Help: "Secrets decrypted, by namespace.  Per secret counts are in the view stats.",
+	}, []string{"namespace"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nutcracker_db_duration_seconds",
+		Help:    "Time taken by database calls, by method.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method"})
+
+	sealed = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nutcracker_sealed",
+		Help: "1 if the vault is sealed, 0 if it is unsealed.",
+	}, func() float64 {
+		if secrets.IsSealed() {
+			return 1
+		}
+		return 0
+	})
+
+	uptime = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nutcracker_uptime_seconds",
+		Help: "Seconds since the server started.",
+	}, func() float64 {
+		return time.Since(startTime).Seconds()
+	})
+
+	metricsHandler = promhttp.Handler()
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		authFailures,
+		authLockouts,
+		secretViews,
+		dbDuration,
+		sealed,
+		uptime,
+		dbCollector{},
+	)
+}
+
+// Metrics serves metrics in the Prometheus text format
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// observeDB records the duration of a database call.
+func observeDB(method string, took time.Duration) {
+	dbDuration.WithLabelValues(method).Observe(took.Seconds())
+}
+
+// instrument counts, times and logs every request served by a router.
+// Routes are labelled with their path template, so secret names do not
+// end up in the labels or the access log.
+func instrument(r *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if r.Match(req, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		r.ServeHTTP(sw, req)
+
+		took := time.Since(start)
+
+		requestDuration.WithLabelValues(route, req.Method).Observe(took.Seconds())
+		requestsTotal.WithLabelValues(route, req.Method, strconv.Itoa(sw.status)).Inc()
+		logAccess(req, route, sw.status, took)
+	})
+}
+
+var dbCountDesc = prometheus.NewDesc(
+	"nutcracker_db_objects",
+	"Objects stored in the database, by type.",
+	[]string{"type"}, nil)
+
+// dbCollector reports the counts from database.Metrics at scrape time.
+type dbCollector struct{}
+
+func (dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbCountDesc
+}
+
+func (dbCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics, err := database.Metrics()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for k, v := range metrics {
+		n, ok := v.(int)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(dbCountDesc, prometheus.GaugeValue, float64(n), k)
+	}
+}
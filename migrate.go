@@ -0,0 +1,138 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/postgres"
+)
+
+// migrateCommand copies the configured database into the one given by
+// the flags in args.
+func migrateCommand(args []string) error {
+	to := DatabaseConfig{MaxConnections: postgres.DefaultMaxConnections}
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&to.Driver, "to-driver", "", "Database backend to copy to: postgres, mysql or bolt")
+	fs.StringVar(&to.URL, "to-url", "", "Connection string of the postgres or mysql database to copy to")
+	fs.StringVar(&to.Path, "to-path", "", "Path of the bolt database file to copy to")
+	dryRun := fs.Bool("dry-run", false, "Check the copy in memory, without writing to the target")
+	fs.Parse(args)
+
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+	pageSize = conf.PageSize
+
+	if to.Driver == "memory" || conf.Database.Driver == "memory" {
+		return errors.New("Cannot migrate to or from the memory backend")
+	}
+	if to == conf.Database {
+		return errors.New("The source and target databases are the same")
+	}
+	err = to.validate()
+	if err != nil {
+		return err
+	}
+
+	src := conf.Database.open()
+	err = src.Connect()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// A dry run copies to memory, so it does not touch the target at all.
+	var dst db.DB = new(memory.DB)
+	if !*dryRun {
+		dst = to.open()
+	}
+	err = dst.Connect()
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return migrate(src, dst, *dryRun, os.Stdout)
+}
+
+// migrate copies everything in src to dst, which must be empty, and checks
+// that dst then holds the same records.  A dry run copies to memory
+// instead, and leaves dst alone.
+func migrate(src, dst db.DB, dryRun bool, out io.Writer) error {
+	e, err := exportDB(src)
+	if err != nil {
+		return err
+	}
+
+	err = load(e, e.summary(), dst, dryRun, out)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Fprintln(out, "Dry run: everything can be copied.  Nothing was written.")
+	} else {
+		fmt.Fprintln(out, "Migration complete, counts and checksums match.")
+	}
+	return nil
+}
+
+// load imports e into dst, which must be empty, prints the summary of
+// each kind of record, and checks that dst then matches want.  A dry run
+// imports into memory instead, and leaves dst alone.
+// Backends which support transactions are left empty if anything fails.
+// Otherwise dst may be left half filled, and load says how to clear it.
+func load(e *vaultExport, want []exportSummary, dst db.DB, dryRun bool, out io.Writer) error {
+	err := checkEmpty(dst)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		dst = new(memory.DB)
+		err = dst.Connect()
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+	}
+
+	for _, s := range want {
+		fmt.Fprintf(out, "%-13s %6d  %s\n", s.Kind, s.Count, s.SHA256)
+	}
+
+	if t, ok := dst.(db.Transactor); ok {
+		return t.Transaction(func(tx db.DB) error {
+			return loadAndVerify(e, want, tx)
+		})
+	}
+
+	err = loadAndVerify(e, want, dst)
+	if err != nil && !dryRun {
+		fmt.Fprintln(out, "The target database may now hold part of the copy, and must be emptied before trying again.")
+		fmt.Fprintln(out, "Delete the bolt file, or drop and recreate the database.")
+	}
+	return err
+}
+
+// loadAndVerify imports e into d, and checks that d then matches want.
+func loadAndVerify(e *vaultExport, want []exportSummary, d db.DB) error {
+	err := importDB(e, d)
+	if err != nil {
+		return err
+	}
+
+	copied, err := exportDB(d)
+	if err != nil {
+		return err
+	}
+
+	return verifyExport(want, copied.summary())
+}
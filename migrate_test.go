@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/bolt"
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fillVault stores a master secret, a secret with two versions shared
+// with a key and viewed with it, a policy, a group in another namespace,
+// and audit events.
+// It returns the secret key of the key the secret is shared with.
+func fillVault(t *testing.T, d db.DB) []byte {
+	master, err := secrets.Initialise()
+	require.Nil(t, err)
+	require.Nil(t, d.AddSecret(master))
+	require.Nil(t, secrets.Unseal(master, append([]byte{}, master.Key.Display()...)))
+	defer secrets.Seal()
+
+	root, err := secrets.New("app/db", []byte("v1"))
+	require.Nil(t, err)
+	require.Nil(t, d.AddSecret(root))
+	require.Nil(t, root.Update([]byte("v2")))
+	require.Nil(t, d.UpdateSecret(root))
+
+	key := new(secrets.Key)
+	require.Nil(t, key.New("app"))
+	key.ReadOnly = true
+	require.Nil(t, d.AddKey(key))
+	shared, err := root.Share(key)
+	require.Nil(t, err)
+	require.Nil(t, d.AddSecret(shared))
+	require.Nil(t, d.RecordView(root, key))
+	require.Nil(t, d.RecordView(root, key))
+
+	require.Nil(t, d.AddPolicy(&acl.Policy{Name: "readers", Rules: []acl.Rule{
+		{Pattern: "app/*", Capabilities: acl.Capabilities{acl.Read, acl.List}},
+	}}))
+	require.Nil(t, d.AttachPolicy(&secrets.Key{Name: "app"}, &acl.Policy{Name: "readers"}))
+
+	team := new(secrets.Key)
+	require.Nil(t, team.New("ci"))
+	team.Namespace = "team"
+	require.Nil(t, d.AddKey(team))
+	teamRoot, err := secrets.New("deploy", []byte("token"))
+	require.Nil(t, err)
+	teamRoot.Namespace = "team"
+	require.Nil(t, d.AddSecret(teamRoot))
+	g := &secrets.Group{Namespace: "team", Name: "builders"}
+	require.Nil(t, d.AddGroup(g))
+	require.Nil(t, d.AddGroupMember(g, &secrets.Key{Namespace: "team", Name: "ci"}))
+	require.Nil(t, d.AddGroupSecret(g, teamRoot))
+	teamShared, err := teamRoot.Share(team)
+	require.Nil(t, err)
+	teamShared.GroupID = g.ID
+	require.Nil(t, d.AddSecret(teamShared))
+
+	l, err := audit.New(audit.DBSink{Store: d})
+	require.Nil(t, err)
+	l.Log(&audit.Event{KeyID: "master", Operation: "message", Target: "app/db", Result: "OK", Status: 201})
+	l.Log(&audit.Event{KeyID: "app", Operation: "view", Target: "app/db", Result: "OK", Status: 200})
+
+	return append([]byte{}, key.Display()...)
+}
+
+func tempBolt(t *testing.T) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "nutcracker")
+	require.Nil(t, err)
+
+	d := &bolt.DB{Path: filepath.Join(dir, "nutcracker.db")}
+	require.Nil(t, d.Connect())
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src := new(memory.DB)
+	require.Nil(t, src.Connect())
+	key := fillVault(t, src)
+
+	dst, done := tempBolt(t)
+	defer done()
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, migrate(src, dst, true, out), "Dry run should succeed")
+	assert.Contains(t, out.String(), "Nothing was written")
+	assert.Contains(t, out.String(), "secrets            6")
+	assert.Nil(t, checkEmpty(dst), "Dry run should not write")
+
+	out.Reset()
+	assert.Nil(t, migrate(src, dst, false, out), "Migration should succeed")
+	assert.Contains(t, out.String(), "Migration complete")
+
+	// The secret can still be read with the key it was shared with
+	root := &secrets.Secret{Name: "app/db"}
+	shared := &secrets.Secret{Name: "app/db"}
+	assert.Nil(t, dst.GetRootSecret(root))
+	assert.Nil(t, dst.GetSharedSecret(shared, &secrets.Key{Name: "app"}))
+	message, err := root.Decrypt(shared, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(message))
+
+	pol, err := dst.ListPolicies("", &shared.Key.Name)(10)
+	assert.Nil(t, err)
+	assert.Len(t, pol, 1)
+
+	// and so are its stats
+	st := &secrets.Stats{Type: secrets.SecretStats, Name: "app/db"}
+	assert.Nil(t, dst.GetStats(st))
+	assert.Equal(t, int64(2), st.Views)
+	assert.Equal(t, "app", st.LastPeer)
+
+	// Removing the member removes the share made through the group
+	assert.Nil(t, dst.RemoveGroupMember(&secrets.Group{Namespace: "team", Name: "builders"}, &secrets.Key{Namespace: "team", Name: "ci"}))
+	err = dst.GetSharedSecret(&secrets.Secret{Name: "deploy"}, &secrets.Key{Namespace: "team", Name: "ci"})
+	assert.NotNil(t, err)
+
+	assert.EqualError(t, migrate(src, dst, false, out), "The target database is not empty")
+}
+
+func TestLoadFailure(t *testing.T) {
+	src := new(memory.DB)
+	require.Nil(t, src.Connect())
+	fillVault(t, src)
+
+	e, err := exportDB(src)
+	require.Nil(t, err)
+	want := e.summary()
+	e.Namespaces[0].Secrets[1].Message[0] ^= 1
+
+	// Bolt has no transaction to roll back, so the caller is told to
+	// clear the target
+	dst, done := tempBolt(t)
+	defer done()
+
+	out := new(bytes.Buffer)
+	assert.EqualError(t, load(e, want, dst, false, out), "Verification failed: the secrets do not match")
+	assert.Contains(t, out.String(), "must be emptied before trying again")
+	assert.NotNil(t, checkEmpty(dst))
+}
+
+func TestVerifyExport(t *testing.T) {
+	src := new(memory.DB)
+	require.Nil(t, src.Connect())
+	fillVault(t, src)
+
+	e, err := exportDB(src)
+	require.Nil(t, err)
+	want := e.summary()
+	assert.Nil(t, verifyExport(want, e.summary()))
+
+	e.Namespaces[0].Secrets[1].Message[0] ^= 1
+	assert.EqualError(t, verifyExport(want, e.summary()), "Verification failed: the secrets do not match")
+
+	e.Namespaces[0].Secrets[1].Message[0] ^= 1
+	e.Namespaces[0].Stats[0].Views++
+	assert.EqualError(t, verifyExport(want, e.summary()), "Verification failed: the stats do not match")
+}
@@ -0,0 +1,95 @@
+// Package mysql stores the vault in MySQL, with the same schema as the
+// postgres backend.
+package mysql
+
+import (
+	"errors"
+	"time"
+
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/audit"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/nutmegdevelopment/nutcracker/sqldb"
+)
+
+// DefaultMaxConnections is the size of the connection pool if
+// MaxConnections is not set.
+const DefaultMaxConnections = 25
+
+// tableOptions makes names case sensitive, as they are in postgres.
+const tableOptions = "ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin"
+
+// DB is an implementation of the db.DB interface
+type DB struct {
+	// URL is a MySQL DSN, such as user:password@tcp(host:3306)/nutcracker.
+	URL            string
+	MaxConnections int
+
+	sqldb.DB
+}
+
+// dialect counts views with an upsert.  Root secret versions are not
+// numbered, so a new one is inserted like any other secret.
+var dialect = sqldb.Dialect{
+	UpsertView: `insert into stats (namespace, type, name, views, last_viewed, last_peer)
+		values (?, ?, ?, 1, ?, ?)
+		on duplicate key update
+		views = views + 1, last_viewed = values(last_viewed), last_peer = values(last_peer)`,
+}
+
+// Connect connects to the database using URL.
+// After connect, it creates tables if missing.
+func (p *DB) Connect() (err error) {
+	if p.URL == "" {
+		return errors.New("No MySQL URL specified")
+	}
+
+	cfg, err := driver.ParseDSN(p.URL)
+	if err != nil {
+		return
+	}
+	// Times are stored in UTC, and must scan into time.Time.
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+
+	max := p.MaxConnections
+	if max <= 0 {
+		max = DefaultMaxConnections
+	}
+
+	if p.Conn != nil {
+		p.Conn.Close()
+	}
+
+	conn, err := gorm.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return
+	}
+	conn.DB().SetMaxOpenConns(max)
+	p.DB = sqldb.DB{Conn: conn, Dialect: dialect, Reconnect: p.Connect}
+
+	d := p.Conn.Set("gorm:table_options", tableOptions).AutoMigrate(
+		&secrets.Secret{},
+		&secrets.Key{},
+		&acl.Policy{},
+		&acl.Rule{},
+		&acl.KeyPolicy{},
+		&secrets.Group{},
+		&secrets.GroupMember{},
+		&secrets.GroupSecret{},
+		&secrets.Stats{},
+		&audit.Event{})
+	if d.Error != nil {
+		return d.Error
+	}
+
+	// Timestamps default to whole seconds, but the audit hash covers
+	// microseconds.
+	err = p.Conn.Model(&audit.Event{}).ModifyColumn("time", "datetime(6) not null").Error
+	if err != nil {
+		return
+	}
+	return p.Conn.Model(&secrets.Stats{}).ModifyColumn("last_viewed", "datetime(6) null").Error
+}
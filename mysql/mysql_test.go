@@ -0,0 +1,42 @@
+package mysql
+
+import (
+	"os"
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/db/dbtest"
+)
+
+var _ db.DB = new(DB)
+
+// The tests need a database which they can empty, for example:
+//
+//	docker run -d -p 3306:3306 -e MYSQL_ALLOW_EMPTY_PASSWORD=yes -e MYSQL_DATABASE=nutcracker mysql:8
+//	NUTCRACKER_TEST_MYSQL='root@tcp(localhost:3306)/nutcracker' go test ./mysql
+const testURLEnv = "NUTCRACKER_TEST_MYSQL"
+
+var tables = []string{
+	"secrets", "keys", "policies", "rules", "key_policies",
+	"groups", "group_members", "group_secrets", "stats", "events",
+}
+
+func TestDB(t *testing.T) {
+	url := os.Getenv(testURLEnv)
+	if url == "" {
+		t.Skip(testURLEnv + " is not set")
+	}
+
+	dbtest.Run(t, func(t *testing.T) (db.DB, func()) {
+		d := &DB{URL: url, MaxConnections: 2}
+		if err := d.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range tables {
+			if err := d.Conn.Exec("delete from `" + table + "`").Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		return d, func() { d.Close() }
+	})
+}
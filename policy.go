@@ -0,0 +1,169 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// Policy adds a new named policy to the vault
+func Policy(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() || !api.admin {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	request, err := api.read()
+	if err != nil {
+		api.log().Debug(err)
+		api.error("Bad request", 400)
+		return
+	}
+
+	p := &acl.Policy{
+		Namespace: api.namespace,
+		Name:      request.Name,
+		Rules:     request.Rules,
+	}
+
+	err = p.Validate()
+	if err != nil {
+		api.error(err.Error(), 400)
+		return
+	}
+
+	err = database.AddPolicy(p)
+	switch {
+
+	case err == nil:
+		api.log().Info("New policy added: ", p.Name)
+		api.message("OK", 201)
+
+	case err.Error() == "Policy already exists":
+		api.error("Policy already exists", 409)
+
+	default:
+		api.log().Error(err)
+		api.error("Database error", 500)
+
+	}
+
+	return
+}
+
+// Attach grants a policy to a key
+func Attach(w http.ResponseWriter, r *http.Request) {
+	attach(w, r, true)
+}
+
+// Detach removes a policy from a key
+func Detach(w http.ResponseWriter, r *http.Request) {
+	attach(w, r, false)
+}
+
+func attach(w http.ResponseWriter, r *http.Request, add bool) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() || !api.admin {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	request, err := api.read()
+	if err != nil {
+		api.log().Debug(err)
+		api.error("Bad request", 400)
+		return
+	}
+
+	if len(request.KeyID) == 0 {
+		api.error("Missing elements in request", 400)
+		return
+	}
+	if len(request.Name) == 0 {
+		api.error("Missing elements in request", 400)
+		return
+	}
+
+	if request.KeyID == secrets.MasterKeyName {
+		api.error("Cannot change policies for master", 400)
+		return
+	}
+
+	key := &secrets.Key{Namespace: api.namespace, Name: request.KeyID}
+	p := &acl.Policy{Namespace: api.namespace, Name: request.Name}
+
+	if add {
+		err = database.AttachPolicy(key, p)
+	} else {
+		err = database.DetachPolicy(key, p)
+	}
+	switch err {
+
+	case gorm.ErrRecordNotFound:
+		api.error("Key or policy does not exist", 404)
+		return
+
+	case nil:
+		break
+
+	default:
+		api.log().Error(err)
+		api.error("Database error", 500)
+		return
+
+	}
+
+	if add {
+		api.log().Info("Policy: ", p.Name, " attached to: ", key.Name)
+	} else {
+		api.log().Info("Policy: ", p.Name, " detached from: ", key.Name)
+	}
+
+	api.message("OK", 200)
+}
+
+func listPolicies(api *api) {
+
+	var search *string
+	if _, ok := api.params["target"]; ok {
+		search = new(string)
+		*search = api.params["target"]
+	}
+
+	iter := database.ListPolicies(api.namespace, search)
+
+	for {
+
+		res, err := iter(pageSize)
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+
+		if len(res) == 0 {
+			return
+		}
+
+		data, err := json.MarshalIndent(&res, "", "  ")
+		if err != nil {
+			api.log().Error(err)
+			api.error("JSON error", 500)
+			return
+		}
+
+		api.resp.Write(data)
+
+		res = res[:0]
+
+	}
+
+}
@@ -0,0 +1,194 @@
+package postgres
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration is one step in the history of the schema.  Steps never change
+// once released; a new step is added instead.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations brings a database up to date, oldest first.  Version 1 is the
+// schema which AutoMigrate created in releases before versioning, so it is
+// a no-op for their databases, and version 2 adds what they lack.
+var migrations = []migration{
+	{1, "Schema of releases before versioning", []string{
+		`create table if not exists secrets (
+			id serial primary key,
+			name text not null,
+			message bytea,
+			nonce bytea,
+			pubkey bytea,
+			key_id integer,
+			root boolean)`,
+		`create table if not exists keys (
+			id serial primary key,
+			name text not null unique,
+			key bytea,
+			nonce bytea,
+			public bytea,
+			read_only boolean)`,
+	}},
+
+	// Existing secrets and keys move to the default namespace.
+	{2, "Namespaces, policies, groups, stats and audit events", []string{
+		`alter table secrets add column if not exists namespace text not null default 'default'`,
+		`alter table secrets add column if not exists group_id integer`,
+		`alter table keys add column if not exists namespace text not null default 'default'`,
+		`create unique index if not exists idx_keys_namespace_name on keys (namespace, name)`,
+		`create table if not exists policies (
+			id serial primary key,
+			namespace text not null default 'default',
+			name text not null)`,
+		`create unique index if not exists idx_policies_namespace_name on policies (namespace, name)`,
+		`create table if not exists rules (
+			id serial primary key,
+			policy_id integer,
+			pattern text not null,
+			capabilities text)`,
+		`create table if not exists key_policies (
+			id serial primary key,
+			key_id integer not null,
+			policy_id integer not null)`,
+		`create table if not exists groups (
+			id serial primary key,
+			namespace text not null default 'default',
+			name text not null)`,
+		`create unique index if not exists idx_groups_namespace_name on groups (namespace, name)`,
+		`create table if not exists group_members (
+			id serial primary key,
+			group_id integer not null,
+			key_id integer not null)`,
+		`create table if not exists group_secrets (
+			id serial primary key,
+			group_id integer not null,
+			name text not null)`,
+		`create table if not exists stats (
+			id serial primary key,
+			namespace text not null default 'default',
+			type text not null,
+			name text not null,
+			views bigint not null default 0,
+			last_viewed timestamp with time zone,
+			last_peer text not null default '')`,
+		`create unique index if not exists idx_stats_namespace_type_name on stats (namespace, type, name)`,
+		`create table if not exists events (
+			id serial primary key,
+			time timestamp with time zone not null,
+			request_id text,
+			namespace text,
+			key_id text not null,
+			operation text not null,
+			target text,
+			result text not null,
+			status integer,
+			source_ip text,
+			prev_hash text not null,
+			hash text not null)`,
+		`create unique index if not exists uix_events_hash on events (hash)`,
+	}},
+
+	// Key names used to be globally unique, they are now unique per namespace.
+	{3, "Key names are unique per namespace", []string{
+		`alter table keys drop constraint if exists keys_name_key`,
+	}},
+
+	{4, "Index secret and key lookups", []string{
+		`create index if not exists secrets_name_root_idx on secrets (name, root)`,
+		`create index if not exists secrets_key_id_idx on secrets (key_id)`,
+		`create index if not exists keys_name_idx on keys (name)`,
+	}},
+
+	// Every version of a root secret is a row of its own, so root names
+	// are unique together with a version number.  Existing versions are
+	// numbered in the order they were written.
+	{5, "Number root secret versions, and make root names unique", []string{
+		`alter table secrets add column version integer not null default 1`,
+		`update secrets set version = v.version from (
+			select id, row_number() over (partition by namespace, name order by id) as version
+			from secrets where root) v
+		where secrets.id = v.id`,
+		`create unique index secrets_root_name_idx on secrets (namespace, name, version) where root`,
+	}},
+
+	// Secrets whose key is gone can never be read: a share needs the key
+	// it was made for, and a root secret the key it is encrypted with.
+	// They are moved aside to orphaned_secrets before the constraint is
+	// added, rather than dropped.
+	{6, "Secrets refer to keys", []string{
+		`create table orphaned_secrets as
+			select * from secrets where key_id not in (select id from keys)`,
+		`delete from secrets where key_id not in (select id from keys)`,
+		`alter table secrets add constraint secrets_key_id_fkey foreign key (key_id) references keys (id)`,
+	}},
+}
+
+// migrationLock is the advisory lock held while migrating, so that servers
+// starting at the same time take turns.
+const migrationLock = 0x6e757463
+
+// migrate applies every migration the database does not have yet, in one
+// transaction.  It is safe to run at every startup, and from several
+// servers at once.
+func migrate(conn *gorm.DB) (err error) {
+	tx := conn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Exec("select pg_advisory_xact_lock(?)", migrationLock).Error
+	if err != nil {
+		return
+	}
+
+	err = tx.Exec(`create table if not exists schema_version (
+		version integer primary key,
+		description text not null,
+		applied_at timestamp with time zone not null default now())`).Error
+	if err != nil {
+		return
+	}
+
+	var current int
+	err = tx.Raw("select coalesce(max(version), 0) from schema_version").Row().Scan(&current)
+	if err != nil {
+		return
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("The database schema is version %d, newer than this release supports (%d)", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		for _, stmt := range m.statements {
+			err = tx.Exec(stmt).Error
+			if err != nil {
+				return fmt.Errorf("Schema migration %d (%s): %s", m.version, m.description, err)
+			}
+		}
+
+		err = tx.Exec("insert into schema_version (version, description) values (?, ?)",
+			m.version, m.description).Error
+		if err != nil {
+			return
+		}
+	}
+
+	return tx.Commit().Error
+}
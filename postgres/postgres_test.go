@@ -0,0 +1,147 @@
+package postgres
+
+import (
+	"os"
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/db/dbtest"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ db.DB = new(DB)
+
+// The tests need a database which they can empty, for example:
+//
+//	docker run -d -p 5432:5432 -e POSTGRES_HOST_AUTH_METHOD=trust postgres:13
+//	NUTCRACKER_TEST_POSTGRES='postgres://postgres@localhost/postgres?sslmode=disable' go test ./postgres
+const testURLEnv = "NUTCRACKER_TEST_POSTGRES"
+
+// Secrets are deleted before the keys they refer to.
+var tables = []string{
+	"secrets", "keys", "policies", "rules", "key_policies",
+	"groups", "group_members", "group_secrets", "stats", "events",
+}
+
+func testDB(t *testing.T) *DB {
+	url := os.Getenv(testURLEnv)
+	if url == "" {
+		t.Skip(testURLEnv + " is not set")
+	}
+
+	d := &DB{URL: url, MaxConnections: 2}
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if err := d.Conn.Exec("delete from " + table).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+func TestDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) (db.DB, func()) {
+		d := testDB(t)
+		return d, func() { d.Close() }
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "Versions should be consecutive")
+		assert.NotEmpty(t, m.description)
+	}
+
+	d := testDB(t)
+	defer d.Close()
+
+	// Running them again changes nothing
+	require.Nil(t, migrate(d.Conn))
+
+	var version int
+	require.Nil(t, d.Conn.Raw("select max(version) from schema_version").Row().Scan(&version))
+	assert.Equal(t, len(migrations), version)
+
+	key := &secrets.Key{Name: "app"}
+	require.Nil(t, d.AddKey(key))
+	root := &secrets.Secret{Name: "token", Root: true, Key: secrets.Key{Name: "token"}}
+	require.Nil(t, d.AddSecret(root))
+	require.Nil(t, d.UpdateSecret(root))
+
+	// Versions of a root secret are allowed, but not a second root
+	err := d.Conn.Exec("insert into secrets (namespace, name, key_id, root) values ('default', 'token', ?, true)", key.ID).Error
+	assert.NotNil(t, err, "Root names should be unique")
+
+	err = d.Conn.Exec("insert into secrets (namespace, name, key_id, root) values ('default', 'token', 0, false)").Error
+	assert.NotNil(t, err, "Shares should refer to a key")
+}
+
+// baselineSchema is what AutoMigrate created in releases before the
+// schema was versioned.
+var baselineSchema = []string{
+	`create table secrets (id serial primary key, name text not null,
+		message bytea, nonce bytea, pubkey bytea, key_id integer, root boolean)`,
+	`create table keys (id serial primary key, name text not null unique,
+		key bytea, nonce bytea, public bytea, read_only boolean)`,
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	for _, table := range append(tables, "schema_version", "orphaned_secrets") {
+		require.Nil(t, d.Conn.Exec("drop table if exists "+table+" cascade").Error)
+	}
+	for _, stmt := range baselineSchema {
+		require.Nil(t, d.Conn.Exec(stmt).Error)
+	}
+
+	// A secret with its own key, shared with a second key and updated
+	// once, and a share and a root secret whose keys were deleted.
+	var ids []int
+	for _, name := range []string{"token", "app"} {
+		var id int
+		require.Nil(t, d.Conn.Raw("insert into keys (name, key, read_only) values (?, 'k', false) returning id", name).Row().Scan(&id))
+		ids = append(ids, id)
+	}
+	insert := "insert into secrets (name, message, key_id, root) values (?, ?, ?, ?)"
+	require.Nil(t, d.Conn.Exec(insert, "token", []byte("v1"), ids[0], true).Error)
+	require.Nil(t, d.Conn.Exec(insert, "token", []byte("v2"), ids[0], true).Error)
+	require.Nil(t, d.Conn.Exec(insert, "token", []byte("shared"), ids[1], false).Error)
+	require.Nil(t, d.Conn.Exec(insert, "gone", []byte("x"), 999999, true).Error)
+	require.Nil(t, d.Conn.Exec(insert, "token", []byte("x"), 999999, false).Error)
+
+	require.Nil(t, migrate(d.Conn))
+
+	var version int
+	require.Nil(t, d.Conn.Raw("select max(version) from schema_version").Row().Scan(&version))
+	assert.Equal(t, len(migrations), version)
+
+	root := &secrets.Secret{Name: "token"}
+	require.Nil(t, d.GetRootSecret(root))
+	assert.Equal(t, secrets.DefaultNamespace, root.Namespace)
+	assert.Equal(t, "v2", string(root.Message))
+
+	shared := &secrets.Secret{Name: "token"}
+	require.Nil(t, d.GetSharedSecret(shared, &secrets.Key{Name: "app"}))
+	assert.Equal(t, "shared", string(shared.Message))
+
+	var orphans int
+	require.Nil(t, d.Conn.Raw("select count(*) from orphaned_secrets").Row().Scan(&orphans))
+	assert.Equal(t, 2, orphans, "Secrets without a key should be moved aside")
+
+	// Key names are unique per namespace now
+	assert.Nil(t, d.AddKey(&secrets.Key{Namespace: "team", Name: "app"}))
+
+	// The upgraded schema passes the shared tests
+	dbtest.Run(t, func(t *testing.T) (db.DB, func()) {
+		for _, table := range tables {
+			require.Nil(t, d.Conn.Exec("delete from "+table).Error)
+		}
+		return d, func() {}
+	})
+}
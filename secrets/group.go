@@ -0,0 +1,23 @@
+package secrets
+
+// Group is a named set of keys which secrets can be shared with as a unit.
+type Group struct {
+	ID        uint   `gorm:"primary_key" json:"-"`
+	Namespace string `sql:"not null;default:'default';unique_index:idx_groups_namespace_name" json:",omitempty"`
+	Name      string `sql:"not null;unique_index:idx_groups_namespace_name"`
+}
+
+// GroupMember links a key to a group.
+type GroupMember struct {
+	ID      uint `gorm:"primary_key"`
+	GroupID uint `sql:"not null"`
+	KeyID   uint `sql:"not null"`
+}
+
+// GroupSecret records that a secret has been shared with a group, so that
+// keys added to the group later can be given a share of it.
+type GroupSecret struct {
+	ID      uint   `gorm:"primary_key"`
+	GroupID uint   `sql:"not null"`
+	Name    string `sql:"not null"`
+}
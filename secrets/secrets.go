@@ -18,6 +18,10 @@ var (
 
 const MasterKeyName = "master"
 
+// DefaultNamespace is used for secrets and keys created without a namespace,
+// and holds the master secret.
+const DefaultNamespace = "default"
+
 func init() {
 	master = new([32]byte)
 	randomSrc = rand.Reader
@@ -30,6 +34,7 @@ func Initialise() (masterKey *Secret, err error) {
 
 	// We can't use masterKey.New() here
 	masterKey.Name = MasterKeyName
+	masterKey.Namespace = DefaultNamespace
 	masterKey.Root = true
 
 	if err = masterKey.newNonce(); err != nil {
@@ -50,6 +55,7 @@ func Initialise() (masterKey *Secret, err error) {
 	if err != nil {
 		return
 	}
+	masterKey.Key.Namespace = DefaultNamespace
 
 	// Encrypt the master key
 	masterKey.Message = secretbox.Seal(
@@ -94,14 +100,17 @@ func IsSealed() bool {
 }
 
 type Secret struct {
-	ID      uint   `gorm:"primary_key" json:"-"`
-	Name    string `sql:"not null"`
-	Message []byte `json:",omitempty"`
-	Nonce   []byte `json:"-"`
-	Key     Key    `json:",omitempty"`
-	Pubkey  []byte `json:"-"`
-	KeyID   uint   `json:"-"`
-	Root    bool   `json:"-"`
+	ID        uint   `gorm:"primary_key" json:"-"`
+	Namespace string `sql:"not null;default:'default'" json:",omitempty"`
+	Name      string `sql:"not null"`
+	Message   []byte `json:",omitempty"`
+	Nonce     []byte `json:"-"`
+	Key       Key    `json:",omitempty"`
+	Pubkey    []byte `json:"-"`
+	KeyID     uint   `json:"-"`
+	Root      bool   `json:"-"`
+	GroupID   uint   `json:"-"` // Set on shares made through a group
+	Stats     *Stats `sql:"-" json:",omitempty"`
 }
 
 func (s *Secret) nonce() *[24]byte {
@@ -197,6 +206,7 @@ func (s *Secret) Share(key *Key) (shared *Secret, err error) {
 	}
 	shared = new(Secret)
 	shared.Name = s.Name
+	shared.Namespace = s.Namespace
 
 	shared.Key = *key
 
@@ -272,13 +282,15 @@ func (s *Secret) Decrypt(shared *Secret, key []byte) (message []byte, err error)
 }
 
 type Key struct {
-	ID       uint   `gorm:"primary_key" json:"-"`
-	Name     string `sql:"not null;unique" json:"Id,omitempty"`
-	Key      []byte `json:",omitempty"`
-	Nonce    []byte `json:"-"`
-	Public   []byte `json:"-"`
-	ReadOnly bool
-	raw      *[32]byte
+	ID        uint   `gorm:"primary_key" json:"-"`
+	Namespace string `sql:"not null;default:'default';unique_index:idx_keys_namespace_name" json:",omitempty"`
+	Name      string `sql:"not null;unique_index:idx_keys_namespace_name" json:"Id,omitempty"`
+	Key       []byte `json:",omitempty"`
+	Nonce     []byte `json:"-"`
+	Public    []byte `json:"-"`
+	ReadOnly  bool
+	Stats     *Stats `sql:"-" json:",omitempty"`
+	raw       *[32]byte
 }
 
 func (k *Key) nonce() *[24]byte {
@@ -0,0 +1,23 @@
+package secrets
+
+import "time"
+
+// Types of object that view statistics are kept for.
+const (
+	SecretStats = "secret"
+	KeyStats    = "key"
+)
+
+// Stats records how often a secret, or a key, has been used to view a
+// secret.  Secrets and keys that have never been viewed have no stats.
+type Stats struct {
+	ID         uint       `gorm:"primary_key" json:"-"`
+	Namespace  string     `sql:"not null;default:'default';unique_index:idx_stats_namespace_type_name" json:",omitempty"`
+	Type       string     `sql:"not null;unique_index:idx_stats_namespace_type_name" json:"-"`
+	Name       string     `sql:"not null;unique_index:idx_stats_namespace_type_name"`
+	Views      int64      `sql:"not null;default:0"`
+	LastViewed *time.Time `json:",omitempty"`
+	// LastPeer is the key that last viewed a secret, or the secret that a
+	// key last viewed.
+	LastPeer string `sql:"not null;default:''" json:",omitempty"`
+}
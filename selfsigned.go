@@ -0,0 +1,244 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/client"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// selfSignedName names the secret holding a persisted self-signed cert,
+// and the key it is shared with.
+const selfSignedName = "nutcracker-tls"
+
+// selfSignedSource returns where to read the persisted self-signed cert
+// from.  It returns false if the key file does not exist yet.
+func selfSignedSource(c TLSConfig) (src TLSConfig, ok bool, err error) {
+	if c.SelfSignedKeyFile == "" {
+		return c, false, nil
+	}
+
+	data, err := ioutil.ReadFile(c.SelfSignedKeyFile)
+	if os.IsNotExist(err) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+
+	src = c
+	src.CertName = selfSignedName
+	src.CertID = selfSignedName
+	src.CertKey = strings.TrimSpace(string(data))
+	return src, true, nil
+}
+
+// loadServerCert loads the certificate to serve at startup.  Without a
+// configured cert, the self-signed cert persisted in the vault is used.
+// If there is none yet, a new one is generated, to be persisted when the
+// vault is unsealed.
+func loadServerCert(c TLSConfig) error {
+	if !c.configured() {
+		src, ok, err := selfSignedSource(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = serverCerts.load(src)
+			if err == nil {
+				return nil
+			}
+			log.Warn("Cannot use the self-signed certificate stored in the vault: ", err)
+		}
+	}
+
+	return serverCerts.load(c)
+}
+
+// persistSelfSigned stores a generated cert in the vault, shared with a
+// read-only key whose secret is written to the key file, so that the same
+// cert is served after a restart and clients can pin it.  A stored cert
+// which could not be served, because it expired or the key file was lost,
+// is replaced.  It needs the vault to be unsealed, and does nothing unless
+// a generated cert is being served.
+func persistSelfSigned() error {
+	c := serverCerts.config
+	if c.configured() || c.SelfSignedKeyFile == "" || serverCerts.current().configured() {
+		return nil
+	}
+
+	message, err := encodeCert(serverCerts.Get())
+	if err != nil {
+		return err
+	}
+
+	root := &secrets.Secret{Namespace: secrets.DefaultNamespace, Name: selfSignedName}
+	err = database.GetRootSecret(root)
+	switch err {
+
+	case gorm.ErrRecordNotFound:
+		root = nil
+
+	case nil:
+		break
+
+	default:
+		return err
+
+	}
+
+	src, ok, err := selfSignedSource(c)
+	if err != nil {
+		return err
+	}
+
+	// A stored cert is replaced in place, so that every instance sharing
+	// the key file serves the new one after a restart.  Only if the key
+	// file is missing or cannot read it is a new key made.
+	if root != nil {
+		if ok {
+			log.Warn("Replacing the self-signed certificate stored in the vault, as it could not be served")
+		} else {
+			log.Warnf("%s is missing, replacing the self-signed certificate stored in the vault and its key",
+				c.SelfSignedKeyFile)
+		}
+
+		err = root.Update(message)
+		if err != nil {
+			return err
+		}
+		err = database.UpdateSecret(root)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			err = serverCerts.load(src)
+			if err == nil {
+				return nil
+			}
+			log.Warnf("%s cannot read the self-signed certificate stored in the vault, making a new key: %s",
+				c.SelfSignedKeyFile, err)
+		}
+	}
+
+	key := new(secrets.Key)
+	err = key.New(selfSignedName)
+	if err != nil {
+		return err
+	}
+	defer key.Zero()
+	key.Namespace = secrets.DefaultNamespace
+	key.ReadOnly = true
+
+	src = c
+	src.CertName = selfSignedName
+	src.CertID = selfSignedName
+	src.CertKey = base64.StdEncoding.EncodeToString(key.Display())
+
+	// Write the key file first, so a failure cannot leave a cert in the
+	// vault which nothing can read.
+	err = ioutil.WriteFile(c.SelfSignedKeyFile, []byte(src.CertKey+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = storeSelfSigned(key, root, message)
+	if err != nil {
+		os.Remove(c.SelfSignedKeyFile)
+		return err
+	}
+
+	log.Info("Self-signed certificate stored in the vault")
+
+	// Reading it back checks that it round trips.
+	return serverCerts.load(src)
+}
+
+// selfSignedPolicy lets the key to the self-signed cert read that one
+// secret, rather than every secret as a read-only key could.
+func selfSignedPolicy() *acl.Policy {
+	return &acl.Policy{
+		Namespace: secrets.DefaultNamespace,
+		Name:      selfSignedName,
+		Rules:     []acl.Rule{{Pattern: selfSignedName, Capabilities: acl.Capabilities{acl.Read}}},
+	}
+}
+
+// storeSelfSigned replaces any key to the self-signed cert with key, and
+// shares the cert with it.  A nil root is first created from message.
+func storeSelfSigned(key *secrets.Key, root *secrets.Secret, message []byte) (err error) {
+	err = database.DeleteKey(&secrets.Key{Namespace: secrets.DefaultNamespace, Name: selfSignedName})
+	if err != nil {
+		return
+	}
+
+	err = database.AddKey(key)
+	if err != nil {
+		return
+	}
+
+	pol := selfSignedPolicy()
+	err = database.GetPolicy(&acl.Policy{Namespace: pol.Namespace, Name: pol.Name})
+	if err == gorm.ErrRecordNotFound {
+		err = database.AddPolicy(pol)
+	}
+	if err != nil {
+		return
+	}
+
+	err = database.AttachPolicy(&secrets.Key{Namespace: key.Namespace, Name: key.Name}, pol)
+	if err != nil {
+		return
+	}
+
+	if root == nil {
+		root, err = secrets.New(selfSignedName, message)
+		if err != nil {
+			return
+		}
+		root.Namespace = secrets.DefaultNamespace
+
+		err = database.AddSecret(root)
+		if err != nil {
+			return
+		}
+	}
+
+	shared, err := root.Share(key)
+	if err != nil {
+		return
+	}
+
+	return database.AddSecret(shared)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the TLS certificate, so
+// that clients of a self-signed server can pin it.
+func Fingerprint(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+
+	cert := serverCerts.Get()
+	if cert == nil || len(cert.Certificate) == 0 {
+		api.error("No certificate loaded", 503)
+		return
+	}
+
+	res := map[string]interface{}{
+		"response": "OK",
+		"sha256":   client.Fingerprint(cert.Certificate[0]),
+	}
+	if cert.Leaf != nil {
+		res["expires"] = cert.Leaf.NotAfter.UTC().Format(time.RFC3339)
+	}
+
+	api.reply(res, 200)
+}
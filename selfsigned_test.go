@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/client"
+	"github.com/nutmegdevelopment/nutcracker/memory"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nutcracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := defaultTLSConfig()
+	conf.SelfSignedKeyFile = filepath.Join(dir, "tls.key")
+
+	old := serverCerts
+	defer func() { serverCerts = old }()
+
+	defer useDatabase(new(memory.DB))()
+	require.Nil(t, database.Connect())
+	defer database.Close()
+
+	stored := func() []byte {
+		root := &secrets.Secret{Name: selfSignedName}
+		require.Nil(t, database.GetRootSecret(root))
+		return root.Message
+	}
+	restart := func() string {
+		secrets.Seal()
+		serverCerts = &certStore{config: conf}
+		require.Nil(t, loadServerCert(conf))
+		return client.Fingerprint(serverCerts.Get().Certificate[0])
+	}
+
+	// First boot generates a cert
+	serverCerts = &certStore{config: conf}
+	assert.Nil(t, loadServerCert(conf))
+	generated := client.Fingerprint(serverCerts.Get().Certificate[0])
+
+	// and stores it once the vault is unsealed
+	master, err := secrets.Initialise()
+	assert.Nil(t, err, "Should not return error")
+	require.Nil(t, database.AddSecret(master))
+	masterKey := append([]byte{}, master.Key.Display()...)
+	unseal := func() {
+		require.Nil(t, secrets.Unseal(master, append([]byte{}, masterKey...)), "Should unseal")
+	}
+	unseal()
+
+	assert.Nil(t, persistSelfSigned())
+	assert.Equal(t, selfSignedName, serverCerts.current().CertName)
+
+	info, err := os.Stat(conf.SelfSignedKeyFile)
+	assert.Nil(t, err, "Key file should be written")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The key can read the cert, and nothing else
+	set, err := keyPolicies(&secrets.Key{Namespace: secrets.DefaultNamespace, Name: selfSignedName})
+	assert.Nil(t, err)
+	assert.True(t, set.Allows(acl.Read, selfSignedName))
+	assert.False(t, set.Allows(acl.Read, "app/db"))
+
+	// Nothing changes the second time
+	message := stored()
+	assert.Nil(t, persistSelfSigned())
+	assert.Equal(t, message, stored())
+
+	// After a restart, the same cert is served while sealed
+	assert.Equal(t, generated, restart())
+
+	w := httptest.NewRecorder()
+	Fingerprint(w, httptest.NewRequest("GET", "/fingerprint", nil))
+	assert.Equal(t, 200, w.Code)
+
+	var res map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, generated, res["sha256"])
+	assert.NotEmpty(t, res["expires"])
+
+	// A stored cert which cannot be served, such as an expired one, is
+	// replaced, and the key file still reads it
+	unseal()
+	root := &secrets.Secret{Name: selfSignedName}
+	require.Nil(t, database.GetRootSecret(root))
+	require.Nil(t, root.Update([]byte("not a cert")))
+	require.Nil(t, database.UpdateSecret(root))
+
+	replaced := restart()
+	assert.NotEqual(t, generated, replaced)
+	unseal()
+	assert.Nil(t, persistSelfSigned())
+	assert.Equal(t, selfSignedName, serverCerts.current().CertName)
+	assert.Equal(t, replaced, restart())
+
+	// Without the key file, the stored cert and its key are replaced
+	os.Remove(conf.SelfSignedKeyFile)
+	rekeyed := restart()
+	assert.NotEqual(t, replaced, rekeyed)
+	unseal()
+	assert.Nil(t, persistSelfSigned())
+	assert.Equal(t, rekeyed, restart())
+
+	keys, err := database.ListKeys(secrets.DefaultNamespace, nil)(10)
+	assert.Nil(t, err)
+	found := 0
+	for _, k := range keys {
+		if k.Name == selfSignedName {
+			found++
+		}
+	}
+	assert.Equal(t, 1, found, "The old key should be deleted")
+}
@@ -0,0 +1,59 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// notifyShutdown returns a channel which receives SIGTERM and SIGINT.
+func notifyShutdown() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	return ch
+}
+
+// shutdown stops the servers accepting new connections and waits up to
+// timeout for in-flight requests to finish.  Whether or not they do, it
+// then seals the vault, wipes the TLS private key and closes the database,
+// so nothing sensitive outlives the process.  The first error is returned.
+func shutdown(timeout time.Duration, cert *tls.Certificate, servers ...*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Warnf("Server on %s did not drain: %s", s.Addr, err)
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	secrets.Seal()
+	if cert != nil {
+		zeroPrivateKey(cert.PrivateKey)
+	}
+
+	if err := database.Close(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return <-errs
+}
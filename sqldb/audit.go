@@ -0,0 +1,68 @@
+package sqldb
+
+import (
+	"github.com/nutmegdevelopment/nutcracker/audit"
+)
+
+// AddAuditEvent appends an event to the audit table.
+func (p *DB) AddAuditEvent(e *audit.Event) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	return p.Conn.Create(e).Error
+}
+
+// GetLastAuditEvent selects the most recent audit event.
+// The event is left empty if the table is empty.
+func (p *DB) GetLastAuditEvent(e *audit.Event) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	var res []audit.Event
+	err := p.Conn.Order("id desc").Limit(1).Find(&res).Error
+	if err != nil || len(res) == 0 {
+		return err
+	}
+
+	*e = res[0]
+	return nil
+}
+
+// ListAuditEvents returns an iterator function that walks through the audit events matching q, oldest first.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (p *DB) ListAuditEvents(q *audit.Query) func(int) ([]audit.Event, error) {
+	pos := q.Offset
+
+	return func(n int) (res []audit.Event, err error) {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+
+		d := p.Conn
+		at := p.quote("time")
+		if q.Namespace != "" {
+			d = d.Where("namespace = ?", q.Namespace)
+		}
+		if q.KeyID != "" {
+			d = d.Where("key_id = ?", q.KeyID)
+		}
+		if q.Target != "" {
+			d = d.Where("target = ?", q.Target)
+		}
+		if q.Operation != "" {
+			d = d.Where("operation = ?", q.Operation)
+		}
+		if !q.Since.IsZero() {
+			d = d.Where(at+" >= ?", q.Since)
+		}
+		if !q.Until.IsZero() {
+			d = d.Where(at+" < ?", q.Until)
+		}
+
+		err = d.Order("id asc").Limit(n).Offset(pos).Find(&res).Error
+		pos += len(res)
+		return
+	}
+}
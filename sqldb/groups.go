@@ -0,0 +1,231 @@
+package sqldb
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// AddGroup inserts a new group into the DB
+func (p *DB) AddGroup(g *secrets.Group) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	g.Namespace = ns(g.Namespace)
+
+	d := p.Conn.Find(&secrets.Group{}, &secrets.Group{Namespace: g.Namespace, Name: g.Name})
+	if d.Error == nil {
+		return errors.New("Group already exists")
+	}
+	if d.Error != gorm.ErrRecordNotFound {
+		return d.Error
+	}
+
+	return p.Conn.Create(g).Error
+}
+
+// GetGroup selects a group by name.
+func (p *DB) GetGroup(g *secrets.Group) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	g.Namespace = ns(g.Namespace)
+	return p.Conn.Find(g, &secrets.Group{Namespace: g.Namespace, Name: g.Name}).Error
+}
+
+// ListGroups returns an iterator function that walks through all groups in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (p *DB) ListGroups(namespace string) func(int) ([]secrets.Group, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Group, err error) {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+
+		err = p.Conn.Where(
+			"namespace = ?", namespace).Order("id asc").Limit(n).Offset(pos).Find(&res).Error
+		pos += len(res)
+		return
+	}
+}
+
+// DeleteGroup removes a group, its members and every share made through it.
+func (p *DB) DeleteGroup(g *secrets.Group) (err error) {
+	if g == nil || g.Name == "" {
+		return errors.New("No group specified")
+	}
+
+	err = p.GetGroup(g)
+	if err != nil {
+		return
+	}
+
+	tx := p.Conn.Begin()
+
+	err = tx.Where("group_id = ? and root = ?", g.ID, false).Delete(secrets.Secret{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Where("group_id = ?", g.ID).Delete(secrets.GroupMember{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Where("group_id = ?", g.ID).Delete(secrets.GroupSecret{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Where("id = ?", g.ID).Delete(secrets.Group{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	return tx.Commit().Error
+}
+
+// AddGroupMember adds a key to a group.  It does not share any secrets,
+// the caller is responsible for sharing the group's secrets with the key.
+func (p *DB) AddGroupMember(g *secrets.Group, k *secrets.Key) (err error) {
+	err = p.getGroupAndKey(g, k)
+	if err != nil {
+		return
+	}
+
+	link := &secrets.GroupMember{GroupID: g.ID, KeyID: k.ID}
+
+	d := p.Conn.Find(&secrets.GroupMember{}, link)
+	switch {
+
+	case d.Error == nil:
+		return errors.New("Key is already a member")
+
+	case d.Error != gorm.ErrRecordNotFound:
+		return d.Error
+
+	}
+
+	return p.Conn.Create(link).Error
+}
+
+// RemoveGroupMember removes a key from a group, along with every share
+// the key was given through the group.
+func (p *DB) RemoveGroupMember(g *secrets.Group, k *secrets.Key) (err error) {
+	err = p.getGroupAndKey(g, k)
+	if err != nil {
+		return
+	}
+
+	tx := p.Conn.Begin()
+
+	err = tx.Where(
+		"group_id = ? and key_id = ? and root = ?", g.ID, k.ID, false).Delete(secrets.Secret{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Where("group_id = ? and key_id = ?", g.ID, k.ID).Delete(secrets.GroupMember{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	return tx.Commit().Error
+}
+
+// ListGroupMembers returns an iterator function that walks through the keys in a group.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (p *DB) ListGroupMembers(g *secrets.Group) func(int) ([]secrets.Key, error) {
+	pos := 0
+
+	return func(n int) (res []secrets.Key, err error) {
+		if err = p.GetGroup(g); err != nil {
+			return
+		}
+
+		keys := p.quote("keys")
+		err = p.Conn.Joins(
+			"join group_members on group_members.key_id = "+keys+".id").Where(
+			"group_members.group_id = ?", g.ID).Order(keys + ".id asc").Limit(n).Offset(pos).Find(&res).Error
+		pos += len(res)
+		return
+	}
+}
+
+// AddGroupSecret records that a secret is shared with a group.  It does
+// not share the secret with the group's members.
+func (p *DB) AddGroupSecret(g *secrets.Group, s *secrets.Secret) (err error) {
+	err = p.GetGroup(g)
+	if err != nil {
+		return
+	}
+
+	link := &secrets.GroupSecret{GroupID: g.ID, Name: s.Name}
+
+	d := p.Conn.Find(&secrets.GroupSecret{}, link)
+	switch {
+
+	case d.Error == nil:
+		return nil
+
+	case d.Error != gorm.ErrRecordNotFound:
+		return d.Error
+
+	}
+
+	return p.Conn.Create(link).Error
+}
+
+// ListGroupSecrets returns an iterator function that walks through the secrets shared with a group.
+// Only the namespace and name of each secret are set.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+func (p *DB) ListGroupSecrets(g *secrets.Group) func(int) ([]secrets.Secret, error) {
+	pos := 0
+
+	return func(n int) (res []secrets.Secret, err error) {
+		if err = p.GetGroup(g); err != nil {
+			return
+		}
+
+		var links []secrets.GroupSecret
+		err = p.Conn.Where(
+			"group_id = ?", g.ID).Order("id asc").Limit(n).Offset(pos).Find(&links).Error
+		if err != nil {
+			return
+		}
+
+		for _, l := range links {
+			res = append(res, secrets.Secret{Namespace: g.Namespace, Name: l.Name})
+		}
+		pos += len(res)
+		return
+	}
+}
+
+func (p *DB) getGroupAndKey(g *secrets.Group, k *secrets.Key) (err error) {
+	err = p.GetGroup(g)
+	if err != nil {
+		return
+	}
+
+	err = p.GetKey(k)
+	if err != nil {
+		return
+	}
+
+	if k.Namespace != g.Namespace {
+		return errors.New("Key and group are in different namespaces")
+	}
+	return
+}
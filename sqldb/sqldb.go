@@ -0,0 +1,659 @@
+// Package sqldb holds the gorm queries which the postgres and mysql
+// backends share.  Each backend connects, keeps the schema up to date, and
+// gives the statements which differ between databases in a Dialect.
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/db"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// Dialect holds the statements which differ between databases.
+type Dialect struct {
+	// UpsertView counts one view in the stats, inserting the row if it is
+	// missing.  It takes the namespace, type, name, time and peer.
+	UpsertView string
+	// InsertVersion inserts a new version of a root secret, returning its
+	// ID.  It takes the namespace, name, message, nonce, pubkey, key ID and
+	// group ID, then the namespace and name again.  Without it, a version
+	// is inserted like any other secret.
+	InsertVersion string
+}
+
+// DB implements the db.DB interface, apart from Connect, over a gorm
+// connection.  Backends embed it.
+type DB struct {
+	Conn    *gorm.DB
+	Dialect Dialect
+	// Reconnect is called when the database cannot be reached.
+	Reconnect func() error
+}
+
+// likeEscaper escapes the wildcards in a string used in a like pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ns returns the namespace to use for a query.
+func ns(namespace string) string {
+	if namespace == "" {
+		return secrets.DefaultNamespace
+	}
+	return namespace
+}
+
+// quote quotes a table or column name which is a reserved word in some
+// databases, such as keys in MySQL.
+func (p *DB) quote(name string) string {
+	return p.Conn.Dialect().Quote(name)
+}
+
+func (p *DB) refresh() error {
+	conn := p.Conn.DB()
+	if conn == nil {
+		// A transaction holds on to its connection, and cannot reconnect.
+		return nil
+	}
+	err := conn.Ping()
+	if err != nil {
+		return p.Reconnect()
+	}
+	return nil
+}
+
+// Ping checks that the database is connected
+func (p *DB) Ping() (err error) {
+	return p.Conn.DB().Ping()
+}
+
+// Close closes the database connection.
+func (p *DB) Close() (err error) {
+	if p.Conn != nil {
+		err = p.Conn.Close()
+	}
+	return
+}
+
+// Transaction calls f with a DB which makes its changes in one
+// transaction, committed if f returns nil and rolled back otherwise.
+func (p *DB) Transaction(f func(db.DB) error) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	tx := p.Conn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	err := f(&txDB{DB{Conn: tx, Dialect: p.Dialect}})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// txDB is a DB inside a transaction, which Transaction opens and closes.
+type txDB struct {
+	DB
+}
+
+func (t *txDB) Connect() error {
+	return errors.New("Cannot connect inside a transaction")
+}
+
+func (t *txDB) Close() error {
+	return errors.New("Cannot close inside a transaction")
+}
+
+// AddSecret inserts a new secret into the DB
+func (p *DB) AddSecret(s *secrets.Secret) error {
+
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	s.Namespace = ns(s.Namespace)
+	if s.Key.Namespace == "" {
+		s.Key.Namespace = s.Namespace
+	}
+
+	if s.Root {
+		where := &secrets.Secret{Namespace: s.Namespace, Name: s.Name, Root: true}
+		d := p.Conn.Find(&secrets.Secret{}, where)
+		if d.Error == nil {
+			return errors.New("Secret already exists")
+		}
+		if d.Error != gorm.ErrRecordNotFound {
+			return d.Error
+		}
+	}
+
+	d := p.Conn.Find(&secrets.Key{}, &secrets.Key{Namespace: s.Key.Namespace, Name: s.Key.Name})
+	switch {
+
+	case d.Error == gorm.ErrRecordNotFound:
+		err := p.Conn.Create(&s.Key).Error
+		if err != nil {
+			return err
+		}
+
+	case d.Error != nil:
+		return d.Error
+
+	}
+
+	return p.addSecret(s)
+}
+
+func (p *DB) addSecret(s *secrets.Secret) error {
+	return p.Conn.Create(s).Error
+}
+
+// AddKey inserts a key into the DB
+func (p *DB) AddKey(k *secrets.Key) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	k.Namespace = ns(k.Namespace)
+	return p.Conn.Create(k).Error
+}
+
+// GetKey selects a key from the database based on values provided in k.
+func (p *DB) GetKey(k *secrets.Key) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	k.Namespace = ns(k.Namespace)
+	return p.Conn.Find(k, k).Error
+}
+
+// GetRootSecret returns the latest matching root secret
+func (p *DB) GetRootSecret(s *secrets.Secret) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	s.Namespace = ns(s.Namespace)
+	s.Root = true
+	d := p.Conn.Order("id asc").Find(s, s)
+	if d.Error != nil {
+		return d.Error
+	}
+	return p.Conn.Find(&s.Key, s.KeyID).Error
+}
+
+// GetSharedSecret returns the shared cert linking s and k
+func (p *DB) GetSharedSecret(s *secrets.Secret, k *secrets.Key) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	// We don't use a join due to conflicting columns
+	err := p.GetKey(k)
+	if err != nil {
+		return err
+	}
+
+	s.Namespace = k.Namespace
+	s.Root = false
+	s.KeyID = k.ID
+	d := p.Conn.Order("id asc").Find(s, s)
+	if d.Error != nil {
+		return d.Error
+	}
+	return p.Conn.Find(&s.Key, s.KeyID).Error
+}
+
+// UpdateSecret updates a secret by adding a new copy of it to the db.
+func (p *DB) UpdateSecret(s *secrets.Secret) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	// we need a new ID
+	s.ID = 0
+	if !s.Root || p.Dialect.InsertVersion == "" {
+		return p.addSecret(s)
+	}
+
+	s.Namespace = ns(s.Namespace)
+	if s.Key.ID != 0 {
+		s.KeyID = s.Key.ID
+	}
+	return p.Conn.Raw(p.Dialect.InsertVersion,
+		s.Namespace, s.Name, s.Message, s.Nonce, s.Pubkey, s.KeyID, s.GroupID,
+		s.Namespace, s.Name).Row().Scan(&s.ID)
+}
+
+// ListSecrets returns an iterator function that walks through all secrets in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a key name is specified, the results are limited to secrets shared with that key.
+// If a prefix is specified, the results are limited to secrets whose names start with it.
+func (p *DB) ListSecrets(namespace string, key *string, prefix string) func(int) ([]secrets.Secret, error) {
+	pos := 0
+	namespace = ns(namespace)
+	like := likeEscaper.Replace(prefix) + "%"
+
+	return func(n int) (res []secrets.Secret, err error) {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+
+		var rows *sql.Rows
+
+		if key != nil {
+			keys := p.quote("keys")
+			rows, err = p.Conn.Table("secrets").Select(
+				"secrets.id, secrets.namespace, secrets.name, secrets.message, secrets.nonce, secrets.pubkey, secrets.key_id, secrets.root, secrets.group_id").Joins(
+				"left join "+keys+" on secrets.key_id = "+keys+".id").Where(
+				"secrets.namespace = ? and "+keys+".name = ? and secrets.name like ?",
+				namespace, *key, like).Order("secrets.id asc").Limit(n).Offset(pos).Rows()
+		} else {
+			rows, err = p.Conn.Table("secrets").Select(
+				"id, namespace, name, message, nonce, pubkey, key_id, root, group_id").Where(
+				"namespace = ? and name like ?", namespace, like).Order("id asc").Limit(n).Offset(pos).Rows()
+		}
+		if err != nil {
+			return
+		}
+
+		for rows.Next() {
+			out := new(secrets.Secret)
+			var group sql.NullInt64
+			err = rows.Scan(&out.ID, &out.Namespace, &out.Name, &out.Message, &out.Nonce, &out.Pubkey, &out.KeyID, &out.Root, &group)
+			if err != nil {
+				return
+			}
+			out.GroupID = uint(group.Int64)
+			res = append(res, *out)
+		}
+		err = rows.Close()
+		pos += len(res)
+		return
+	}
+}
+
+// ListKeys returns an iterator function that walks through all keys in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a secret name is specified, the results are limited to keys with access to that secret.
+func (p *DB) ListKeys(namespace string, secret *string) func(int) ([]secrets.Key, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []secrets.Key, err error) {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+
+		var rows *sql.Rows
+
+		keys := p.quote("keys")
+		if secret != nil {
+			rows, err = p.Conn.Table("keys").Select(
+				keys+".id, "+keys+".namespace, "+keys+".name, "+keys+"."+p.quote("key")+", "+
+					keys+".nonce, "+keys+".public, "+keys+".read_only").Joins(
+				"left join secrets on "+keys+".id = secrets.key_id").Where(
+				keys+".namespace = ? and secrets.name = ?", namespace, *secret).Order(keys + ".id asc").Limit(n).Offset(pos).Rows()
+		} else {
+			rows, err = p.Conn.Table("keys").Select(
+				"id, namespace, name, "+p.quote("key")+", nonce, public, read_only").Where(
+				"namespace = ?", namespace).Order("id asc").Limit(n).Offset(pos).Rows()
+		}
+		if err != nil {
+			return
+		}
+
+		for rows.Next() {
+			out := new(secrets.Key)
+			var ro sql.NullBool
+			err = rows.Scan(&out.ID, &out.Namespace, &out.Name, &out.Key, &out.Nonce, &out.Public, &ro)
+			if err != nil {
+				return
+			}
+			if ro.Valid {
+				out.ReadOnly = ro.Bool
+			} else {
+				out.ReadOnly = false
+			}
+			res = append(res, *out)
+		}
+		err = rows.Close()
+		pos += len(res)
+		return
+	}
+}
+
+// DeleteSecret removes a secret from the DB
+func (p *DB) DeleteSecret(s *secrets.Secret) (err error) {
+	if s == nil || s.Name == "" {
+		return errors.New("No secret specified")
+	}
+
+	if s.Name == "master" {
+		return errors.New("Cannot delete master")
+	}
+
+	s.Namespace = ns(s.Namespace)
+
+	err = p.Conn.Where(
+		"name = ? and group_id in (select id from "+p.quote("groups")+" where namespace = ?)",
+		s.Name, s.Namespace).Delete(secrets.GroupSecret{}).Error
+	if err != nil {
+		return
+	}
+
+	err = p.Conn.Where(
+		"namespace = ? and type = ? and name = ?",
+		s.Namespace, secrets.SecretStats, s.Name).Delete(secrets.Stats{}).Error
+	if err != nil {
+		return
+	}
+
+	return p.Conn.Where(
+		"namespace = ? and name = ?", s.Namespace, s.Name).Delete(secrets.Secret{}).Error
+}
+
+// DeleteSharedSecret removes every share linking s and k, leaving both in place.
+// It returns gorm.ErrRecordNotFound if the secret was not shared with the key.
+func (p *DB) DeleteSharedSecret(s *secrets.Secret, k *secrets.Key) (err error) {
+	if s == nil || s.Name == "" {
+		return errors.New("No secret specified")
+	}
+
+	err = p.GetKey(k)
+	if err != nil {
+		return
+	}
+
+	d := p.Conn.Where(
+		"namespace = ? and name = ? and key_id = ? and root = ?",
+		k.Namespace, s.Name, k.ID, false).Delete(secrets.Secret{})
+	if d.Error != nil {
+		return d.Error
+	}
+	if d.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteKey removes a key, and every secret shared with it, from the DB
+func (p *DB) DeleteKey(k *secrets.Key) (err error) {
+	if k == nil || k.Name == "" {
+		return errors.New("No key specified")
+	}
+
+	if k.Name == "master" {
+		return errors.New("Cannot delete master")
+	}
+
+	k.Namespace = ns(k.Namespace)
+	ofKey := "key_id in (select id from " + p.quote("keys") + " where namespace = ? and name = ?)"
+
+	err = p.Conn.Where(
+		ofKey, k.Namespace, k.Name).Delete(acl.KeyPolicy{}).Error
+	if err != nil {
+		return
+	}
+
+	err = p.Conn.Where(
+		ofKey, k.Namespace, k.Name).Delete(secrets.GroupMember{}).Error
+	if err != nil {
+		return
+	}
+
+	err = p.Conn.Where(
+		"namespace = ? and type = ? and name = ?",
+		k.Namespace, secrets.KeyStats, k.Name).Delete(secrets.Stats{}).Error
+	if err != nil {
+		return
+	}
+
+	err = p.Conn.Where(
+		"root = ? and "+ofKey, false, k.Namespace, k.Name).Delete(secrets.Secret{}).Error
+	if err != nil {
+		return
+	}
+
+	return p.Conn.Where(
+		"namespace = ? and name = ?", k.Namespace, k.Name).Delete(secrets.Key{}).Error
+}
+
+// AddPolicy inserts a new policy and its rules into the DB
+func (p *DB) AddPolicy(pol *acl.Policy) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	pol.Namespace = ns(pol.Namespace)
+
+	d := p.Conn.Find(&acl.Policy{}, &acl.Policy{Namespace: pol.Namespace, Name: pol.Name})
+	if d.Error == nil {
+		return errors.New("Policy already exists")
+	}
+	if d.Error != gorm.ErrRecordNotFound {
+		return d.Error
+	}
+
+	return p.Conn.Create(pol).Error
+}
+
+// GetPolicy selects a policy and its rules by name.
+func (p *DB) GetPolicy(pol *acl.Policy) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	pol.Namespace = ns(pol.Namespace)
+	return p.Conn.Preload("Rules").Find(
+		pol, &acl.Policy{Namespace: pol.Namespace, Name: pol.Name}).Error
+}
+
+// ListPolicies returns an iterator function that walks through all policies in a namespace.
+// The iterator takes an integer argument, which is the maximum number of results to return per iteration.
+// If a key name is specified, the results are limited to policies attached to that key.
+func (p *DB) ListPolicies(namespace string, key *string) func(int) ([]acl.Policy, error) {
+	pos := 0
+	namespace = ns(namespace)
+
+	return func(n int) (res []acl.Policy, err error) {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+
+		q := p.Conn.Preload("Rules").Where(
+			"policies.namespace = ?", namespace).Order("policies.id asc").Limit(n).Offset(pos)
+		if key != nil {
+			keys := p.quote("keys")
+			q = q.Joins(
+				"join key_policies on key_policies.policy_id = policies.id").Joins(
+				"join "+keys+" on "+keys+".id = key_policies.key_id").Where(
+				keys+".namespace = ? and "+keys+".name = ?", namespace, *key)
+		}
+
+		err = q.Find(&res).Error
+		pos += len(res)
+		return
+	}
+}
+
+// UpdatePolicy replaces the rules of an existing policy.  Keys it is
+// attached to keep it.
+func (p *DB) UpdatePolicy(pol *acl.Policy) (err error) {
+	if pol == nil || pol.Name == "" {
+		return errors.New("No policy specified")
+	}
+
+	existing := &acl.Policy{Namespace: pol.Namespace, Name: pol.Name}
+	err = p.GetPolicy(existing)
+	if err != nil {
+		return
+	}
+
+	tx := p.Conn.Begin()
+
+	err = tx.Where("policy_id = ?", existing.ID).Delete(acl.Rule{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	for i := range pol.Rules {
+		pol.Rules[i].ID = 0
+		pol.Rules[i].PolicyID = existing.ID
+		err = tx.Create(&pol.Rules[i]).Error
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	pol.ID = existing.ID
+	pol.Namespace = existing.Namespace
+	return tx.Commit().Error
+}
+
+// DeletePolicy removes a policy, its rules and any key attachments from the DB
+func (p *DB) DeletePolicy(pol *acl.Policy) (err error) {
+	if pol == nil || pol.Name == "" {
+		return errors.New("No policy specified")
+	}
+
+	err = p.GetPolicy(pol)
+	if err != nil {
+		return
+	}
+
+	tx := p.Conn.Begin()
+
+	err = tx.Where("policy_id = ?", pol.ID).Delete(acl.KeyPolicy{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Where("policy_id = ?", pol.ID).Delete(acl.Rule{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Where("id = ?", pol.ID).Delete(acl.Policy{}).Error
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	return tx.Commit().Error
+}
+
+// AttachPolicy grants the policy to a key
+func (p *DB) AttachPolicy(k *secrets.Key, pol *acl.Policy) (err error) {
+	err = p.GetKey(k)
+	if err != nil {
+		return
+	}
+
+	err = p.GetPolicy(pol)
+	if err != nil {
+		return
+	}
+
+	if k.Namespace != pol.Namespace {
+		return errors.New("Key and policy are in different namespaces")
+	}
+
+	link := &acl.KeyPolicy{KeyID: k.ID, PolicyID: pol.ID}
+
+	d := p.Conn.Find(&acl.KeyPolicy{}, link)
+	switch {
+
+	case d.Error == nil:
+		return nil
+
+	case d.Error != gorm.ErrRecordNotFound:
+		return d.Error
+
+	}
+
+	return p.Conn.Create(link).Error
+}
+
+// DetachPolicy removes the policy from a key
+func (p *DB) DetachPolicy(k *secrets.Key, pol *acl.Policy) (err error) {
+	err = p.GetKey(k)
+	if err != nil {
+		return
+	}
+
+	err = p.GetPolicy(pol)
+	if err != nil {
+		return
+	}
+
+	return p.Conn.Where(
+		"key_id = ? and policy_id = ?", k.ID, pol.ID).Delete(acl.KeyPolicy{}).Error
+}
+
+// Namespaces lists every namespace holding a secret, key, policy or group.
+func (p *DB) Namespaces() (res []string, err error) {
+	if err = p.refresh(); err != nil {
+		return
+	}
+
+	rows, err := p.Conn.Raw(
+		"select namespace from secrets union select namespace from " + p.quote("keys") + " union " +
+			"select namespace from policies union select namespace from " + p.quote("groups") + " order by 1").Rows()
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var namespace string
+		err = rows.Scan(&namespace)
+		if err != nil {
+			return
+		}
+		res = append(res, namespace)
+	}
+	err = rows.Close()
+	return
+}
+
+// Metrics returns data about the state of the database
+func (p *DB) Metrics() (map[string]interface{}, error) {
+	metrics := make(map[string]interface{})
+	var count int
+
+	err := p.Conn.Table("secrets").Count(&count).Error
+	if err != nil {
+		return metrics, err
+	}
+	metrics["secrets"] = count
+
+	err = p.Conn.Table("keys").Count(&count).Error
+	if err != nil {
+		return metrics, err
+	}
+	metrics["keys"] = count
+
+	err = p.Conn.Table("policies").Count(&count).Error
+	if err != nil {
+		return metrics, err
+	}
+	metrics["policies"] = count
+
+	err = p.Conn.Table("groups").Count(&count).Error
+	if err != nil {
+		return metrics, err
+	}
+	metrics["groups"] = count
+
+	return metrics, nil
+}
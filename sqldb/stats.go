@@ -0,0 +1,80 @@
+package sqldb
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// RecordView counts a view of s by k in the stats for both.
+func (p *DB) RecordView(s *secrets.Secret, k *secrets.Key) (err error) {
+	if err = p.refresh(); err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	tx := p.Conn.Begin()
+
+	err = p.addView(tx, &secrets.Stats{
+		Namespace: ns(s.Namespace), Type: secrets.SecretStats, Name: s.Name}, k.Name, now)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = p.addView(tx, &secrets.Stats{
+		Namespace: ns(k.Namespace), Type: secrets.KeyStats, Name: k.Name}, s.Name, now)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	return tx.Commit().Error
+}
+
+// addView counts one view in the stats.  It is a single upsert, so that
+// two first views at the same time both count, rather than one of them
+// breaking the unique index.
+func (p *DB) addView(tx *gorm.DB, st *secrets.Stats, peer string, now time.Time) error {
+	return tx.Exec(p.Dialect.UpsertView, st.Namespace, st.Type, st.Name, now, peer).Error
+}
+
+// GetStats selects the stats for a secret or key by type and name.
+// It returns gorm.ErrRecordNotFound if it has never been viewed.
+func (p *DB) GetStats(st *secrets.Stats) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	st.Namespace = ns(st.Namespace)
+	return p.Conn.Find(st, &secrets.Stats{Namespace: st.Namespace, Type: st.Type, Name: st.Name}).Error
+}
+
+// ListStats selects the stats for the secrets or keys of one type with
+// the given names, in one query.  Names which have never been viewed are
+// left out.
+func (p *DB) ListStats(namespace, typ string, names []string) (res []secrets.Stats, err error) {
+	if len(names) == 0 {
+		return
+	}
+	if err = p.refresh(); err != nil {
+		return
+	}
+
+	err = p.Conn.Where("namespace = ? and type = ? and name in (?)",
+		ns(namespace), typ, names).Order("id asc").Find(&res).Error
+	return
+}
+
+// AddStats inserts stats as they are, rather than counting a view.
+func (p *DB) AddStats(st *secrets.Stats) error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+
+	st.ID = 0
+	st.Namespace = ns(st.Namespace)
+	return p.Conn.Create(st).Error
+}
@@ -0,0 +1,213 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nutmegdevelopment/nutcracker/acl"
+	"github.com/nutmegdevelopment/nutcracker/secrets"
+)
+
+// Stats returns view statistics for secrets or keys.
+// Add ?unused=90d to only show those which have not been viewed in that time.
+func Stats(w http.ResponseWriter, r *http.Request) {
+	api := newAPI(w, r)
+	defer api.req.Body.Close()
+
+	if !api.auth() {
+		api.error("Unauthorized", 401)
+		return
+	}
+
+	_, err := api.read()
+	if err != nil {
+		api.log().Debug(err)
+		api.error("Bad request", 400)
+		return
+	}
+
+	cutoff, err := parseTime(api.req.FormValue("unused"), time.Now())
+	if err != nil {
+		api.error(err.Error(), 400)
+		return
+	}
+
+	var typ string
+	var c acl.Capability
+
+	switch api.params["type"] {
+
+	case "secret", "secrets":
+		typ, c = secrets.SecretStats, acl.List
+
+	case "key", "keys":
+		typ, c = secrets.KeyStats, acl.ManageKeys
+
+	default:
+		api.error("Invalid type for stats", 400)
+		return
+
+	}
+
+	if target, ok := api.params["target"]; ok {
+		if !api.can(c, target) {
+			api.error("Forbidden", 403)
+			return
+		}
+		api.reply(viewStats(api, typ, target), 200)
+		return
+	}
+
+	var next func() ([]string, error)
+	if typ == secrets.SecretStats {
+		next = secretNamePages(api)
+	} else {
+		next = keyNamePages(api)
+	}
+
+	for {
+
+		names, err := next()
+		if err != nil {
+			api.log().Error(err)
+			api.error("Database error", 500)
+			return
+		}
+
+		if names == nil {
+			return
+		}
+
+		allowed := names[:0]
+		for _, name := range names {
+			if api.can(c, name) {
+				allowed = append(allowed, name)
+			}
+		}
+		viewed := pageStats(api, typ, allowed)
+
+		var res []secrets.Stats
+		for _, name := range allowed {
+			st, ok := viewed[name]
+			if !ok {
+				st = &secrets.Stats{Namespace: api.namespace, Type: typ, Name: name}
+			}
+			if !cutoff.IsZero() && st.LastViewed != nil && !st.LastViewed.Before(cutoff) {
+				continue
+			}
+			res = append(res, *st)
+		}
+		if len(res) == 0 {
+			continue
+		}
+
+		data, err := json.MarshalIndent(&res, "", "  ")
+		if err != nil {
+			api.log().Error(err)
+			api.error("JSON error", 500)
+			return
+		}
+
+		api.resp.Write(data)
+
+	}
+}
+
+// secretNamePages returns a function that walks through the names of the
+// secrets in the namespace a page at a time.  Each name is only returned
+// once, however many versions and shares it has.  It returns nil once
+// every secret has been seen.
+func secretNamePages(api *api) func() ([]string, error) {
+	iter := database.ListSecrets(api.namespace, nil, api.req.FormValue("prefix"))
+	seen := make(map[string]bool)
+
+	return func() ([]string, error) {
+		for {
+			page, err := iter(pageSize)
+			if err != nil || len(page) == 0 {
+				return nil, err
+			}
+
+			names := []string{}
+			for _, s := range page {
+				if s.Root && !seen[s.Name] && s.Name != secrets.MasterKeyName {
+					seen[s.Name] = true
+					names = append(names, s.Name)
+				}
+			}
+			if len(names) > 0 {
+				return names, nil
+			}
+		}
+	}
+}
+
+// keyNamePages returns a function that walks through the names of the
+// keys in the namespace a page at a time.  It returns nil once every key
+// has been seen.
+func keyNamePages(api *api) func() ([]string, error) {
+	iter := database.ListKeys(api.namespace, nil)
+
+	return func() ([]string, error) {
+		page, err := iter(pageSize)
+		if err != nil || len(page) == 0 {
+			return nil, err
+		}
+
+		names := make([]string, len(page))
+		for i := range page {
+			names[i] = page[i].Name
+		}
+		return names, nil
+	}
+}
+
+// viewStats returns the stats for a secret or key.  Secrets and keys which
+// have never been viewed get empty stats.
+func viewStats(api *api, typ, name string) *secrets.Stats {
+	st := &secrets.Stats{Namespace: api.namespace, Type: typ, Name: name}
+
+	err := database.GetStats(st)
+	switch err {
+
+	case nil, gorm.ErrRecordNotFound:
+		break
+
+	default:
+		api.log().Error(err)
+
+	}
+
+	return st
+}
+
+// pageStats looks up the stats for a page of secrets or keys in one
+// query, keyed by name.  Those which have never been viewed are missing.
+func pageStats(api *api, typ string, names []string) map[string]*secrets.Stats {
+	res := make(map[string]*secrets.Stats)
+	if len(names) == 0 {
+		return res
+	}
+
+	list, err := database.ListStats(api.namespace, typ, names)
+	if err != nil {
+		api.log().Error(err)
+		return res
+	}
+
+	for i := range list {
+		res[list[i].Name] = &list[i]
+	}
+	return res
+}
+
+// recordView updates the stats after a key views a secret.  Failing to
+// record a view does not stop the secret being returned.
+func recordView(api *api, s *secrets.Secret, k *secrets.Key) {
+	err := database.RecordView(s, k)
+	if err != nil {
+		api.log().Error(err)
+	}
+}
@@ -0,0 +1,157 @@
+package main // import "github.com/nutmegdevelopment/nutcracker"
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tlsVersions maps the versions accepted in the config to their IDs.  Only
+// AEAD cipher suites are offered, so nothing older than 1.2 is useful.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites maps the TLS 1.2 cipher names accepted in the config to
+// their IDs.  TLS 1.3 suites are not configurable.
+var cipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// curves maps the curve names accepted in the config to their IDs.
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// defaultTLSConfig allows TLS 1.2 and 1.3, with forward secret AEAD suites
+// for both ECDSA and RSA certificates.
+func defaultTLSConfig() TLSConfig {
+	return TLSConfig{
+		MinVersion: "1.2",
+		MaxVersion: "1.3",
+		Ciphers: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+		},
+		Curves:         []string{"X25519", "P256"},
+		HTTP2:          true,
+		ReloadInterval: time.Hour,
+	}
+}
+
+// configured reports whether a cert is read from the vault or files,
+// rather than generated.
+func (t TLSConfig) configured() bool {
+	return t.CertName != "" || t.CertFile != ""
+}
+
+// config returns the listener settings for the policy.  The caller adds
+// the certificate.
+func (t TLSConfig) config() (*tls.Config, error) {
+	min, ok := tlsVersions[t.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported TLS min_version: %s", t.MinVersion)
+	}
+	max, ok := tlsVersions[t.MaxVersion]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported TLS max_version: %s", t.MaxVersion)
+	}
+	if max < min {
+		return nil, fmt.Errorf("TLS max_version %s is below min_version %s", t.MaxVersion, t.MinVersion)
+	}
+
+	if min < tls.VersionTLS13 && len(t.Ciphers) == 0 {
+		return nil, fmt.Errorf("At least one TLS cipher is required")
+	}
+	ciphers := make([]uint16, len(t.Ciphers))
+	for i, name := range t.Ciphers {
+		id, ok := cipherSuites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS cipher: %s", name)
+		}
+		ciphers[i] = id
+	}
+
+	if len(t.Curves) == 0 {
+		return nil, fmt.Errorf("At least one TLS curve is required")
+	}
+	prefs := make([]tls.CurveID, len(t.Curves))
+	for i, name := range t.Curves {
+		id, ok := curves[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS curve: %s", name)
+		}
+		prefs[i] = id
+	}
+
+	protos := []string{"http/1.1"}
+	if t.HTTP2 {
+		protos = []string{"h2", "http/1.1"}
+	}
+
+	return &tls.Config{
+		Rand:                     nil, // Use crypto/rand
+		MinVersion:               min,
+		MaxVersion:               max,
+		CipherSuites:             ciphers,
+		CurvePreferences:         prefs,
+		NextProtos:               protos,
+		SessionTicketsDisabled:   false,
+		ClientAuth:               tls.NoClientCert,
+		PreferServerCipherSuites: true,
+	}, nil
+}
+
+// checkCert reports why clients could not complete a handshake with cert
+// under the policy, or nil if they can.
+func (t TLSConfig) checkCert(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("TLS cert contains no certificates")
+	}
+
+	var typ string
+	switch cert.PrivateKey.(type) {
+
+	case *ecdsa.PrivateKey:
+		typ = "ECDSA"
+
+	case *rsa.PrivateKey:
+		typ = "RSA"
+
+	case nil:
+		return fmt.Errorf("TLS cert has no private key")
+
+	default:
+		return fmt.Errorf("Unsupported TLS private key type: %T", cert.PrivateKey)
+
+	}
+
+	// TLS 1.3 suites work with any key type.
+	if t.MinVersion == "1.3" {
+		return nil
+	}
+
+	for _, name := range t.Ciphers {
+		if strings.Contains(name, "_"+typ+"_") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("TLS cert has an %s key, but no %s cipher suites are enabled", typ, typ)
+}
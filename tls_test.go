@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRSACert(t *testing.T) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nutcracker"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects to a listener using policy and returns the
+// connection state seen by the client.
+func handshake(t *testing.T, policy TLSConfig, cert tls.Certificate, client *tls.Config) (tls.ConnectionState, error) {
+	certs := new(certStore)
+	certs.Set(&cert)
+
+	sock, err := Socket("127.0.0.1:0", policy, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	go func() {
+		conn, err := sock.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	client.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", sock.Addr().String(), client)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState(), nil
+}
+
+func TestTLSPolicy(t *testing.T) {
+	ecCert, err := GenCert()
+	assert.Nil(t, err, "Should not return error")
+	rsaCert := newRSACert(t)
+
+	policy := defaultTLSConfig()
+
+	for name, cert := range map[string]tls.Certificate{"ECDSA": ecCert, "RSA": rsaCert} {
+		assert.Nil(t, policy.checkCert(&cert), name)
+
+		state, err := handshake(t, policy, cert, &tls.Config{MaxVersion: tls.VersionTLS12})
+		assert.Nil(t, err, name)
+		assert.Equal(t, uint16(tls.VersionTLS12), state.Version, name)
+
+		state, err = handshake(t, policy, cert, &tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+		assert.Nil(t, err, name)
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version, name)
+		assert.Equal(t, "h2", state.NegotiatedProtocol, name)
+	}
+
+	// An RSA cert needs an RSA suite, unless only TLS 1.3 is allowed
+	policy.Ciphers = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	assert.Nil(t, policy.checkCert(&ecCert))
+	assert.EqualError(t, policy.checkCert(&rsaCert), "TLS cert has an RSA key, but no RSA cipher suites are enabled")
+
+	policy.MinVersion = "1.3"
+	assert.Nil(t, policy.checkCert(&rsaCert))
+
+	_, err = handshake(t, policy, rsaCert, &tls.Config{MaxVersion: tls.VersionTLS12})
+	assert.NotNil(t, err, "TLS 1.2 clients should be refused")
+
+	// Without HTTP/2, clients fall back to HTTP/1.1
+	policy.HTTP2 = false
+	state, err := handshake(t, policy, rsaCert, &tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+
+	assert.EqualError(t, policy.checkCert(&tls.Certificate{Certificate: ecCert.Certificate}), "TLS cert has no private key")
+}
+
+func TestTLSPolicyValidate(t *testing.T) {
+	for name, edit := range map[string]func(*TLSConfig){
+		"old version":   func(c *TLSConfig) { c.MinVersion = "1.0" },
+		"max below min": func(c *TLSConfig) { c.MinVersion, c.MaxVersion = "1.3", "1.2" },
+		"no ciphers":    func(c *TLSConfig) { c.Ciphers = nil },
+		"curve":         func(c *TLSConfig) { c.Curves = []string{"P192"} },
+	} {
+		c := defaultTLSConfig()
+		edit(&c)
+		_, err := c.config()
+		assert.NotNil(t, err, name)
+	}
+
+	// TLS 1.3 suites are fixed, so none need to be listed
+	c := defaultTLSConfig()
+	c.MinVersion, c.Ciphers = "1.3", nil
+	_, err := c.config()
+	assert.Nil(t, err, "Should not return error")
+}
@@ -1,6 +1,7 @@
 package main // import "github.com/nutmegdevelopment/nutcracker"
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -12,17 +13,18 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/jinzhu/gorm"
 	"github.com/nutmegdevelopment/nutcracker/secrets"
 )
 
-var ciphers = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
-
 func newCert(key *ecdsa.PrivateKey) (cert *x509.Certificate, err error) {
 	template := &x509.Certificate{
 		SerialNumber: new(big.Int).SetInt64(time.Now().UnixNano()),
@@ -83,71 +85,278 @@ func GenCert() (tlsCert tls.Certificate, err error) {
 	return tls.X509KeyPair(certBytes, keyBytes)
 }
 
-// Loads a cert from disk, given paths to the cert and key.
-func LoadCert(cert, key string) (tlsCert tls.Certificate, err error) {
-	return tls.LoadX509KeyPair(cert, key)
-}
+// encodeCert returns a certificate chain and its private key as PEM, in
+// the form stored in the vault.
+func encodeCert(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err != nil {
+			return nil, err
+		}
+	}
 
-// Creates a TLS socket
-func Socket(address string, cert tls.Certificate) (socket net.Listener, err error) {
-	cfg := &tls.Config{
-		Rand:                     nil, // Use crypto/rand
-		CipherSuites:             ciphers,
-		SessionTicketsDisabled:   false,
-		ClientAuth:               tls.NoClientCert,
-		PreferServerCipherSuites: true,
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	err = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		return nil, err
 	}
 
-	cfg.Certificates = make([]tls.Certificate, 1)
-	cfg.Certificates[0] = cert
+	return buf.Bytes(), nil
+}
 
-	return tls.Listen("tcp", address, cfg)
+// loadCert returns the configured certificate from files or the vault, or
+// a new self-signed one if none is configured.
+func loadCert(c TLSConfig) (tls.Certificate, error) {
+	switch {
+
+	case c.CertFile != "":
+		log.Info("Using certificate from ", c.CertFile)
+		return LoadCert(c.CertFile, c.KeyFile)
+
+	case c.CertName != "":
+		log.Info("Using certificate from vault")
+		return GetNutcrackerCert(c)
+
+	default:
+		log.Info("Generating self-signed certificate")
+		return GenCert()
+
+	}
 }
 
-func GetNutcrackerCert() (cert tls.Certificate, err error) {
-	encoded, err := readDBcert()
+// LoadCert loads a cert from disk, given paths to the cert and key.  The
+// key may be in the cert file, in which case key can be empty.
+func LoadCert(cert, key string) (tlsCert tls.Certificate, err error) {
+	data, err := ioutil.ReadFile(cert)
 	if err != nil {
 		return
 	}
-	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)-8))
-	n, err := base64.StdEncoding.Decode(decoded, encoded[8:])
 
-	decoded = decoded[:n]
+	if key != "" && key != cert {
+		var keyData []byte
+		keyData, err = ioutil.ReadFile(key)
+		if err != nil {
+			return
+		}
+		defer secrets.Zero(keyData)
+		data = append(append(data, '\n'), keyData...)
+	}
+	defer secrets.Zero(data)
+
+	tlsCert, err = parseCertPEM(data)
+	if err != nil {
+		err = fmt.Errorf("TLS cert %s: %s", cert, err)
+	}
+	return
+}
+
+// parseCertPEM reads a certificate chain and its private key from PEM.
+// The chain is put in order, starting with the certificate for the key.
+func parseCertPEM(data []byte) (cert tls.Certificate, err error) {
+	var certs []*x509.Certificate
 
-	for len(decoded) > 0 {
+	for {
 		var block *pem.Block
-		block, decoded = pem.Decode(decoded)
+		block, data = pem.Decode(data)
 		if block == nil {
 			break
 		}
 
-		if block.Type == "CERTIFICATE" {
-			cert.Certificate = append(cert.Certificate, block.Bytes)
-		}
+		switch {
+
+		case block.Type == "CERTIFICATE":
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return cert, fmt.Errorf("Invalid certificate: %s", err)
+			}
+			certs = append(certs, c)
 
-		if block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+		case block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY"):
+			if cert.PrivateKey != nil {
+				return cert, errors.New("More than one private key found")
+			}
 			cert.PrivateKey, err = parsePrivateKey(block.Bytes)
 			if err != nil {
-				continue
+				return
 			}
+
 		}
+	}
 
+	if len(certs) == 0 {
+		return cert, errors.New("No certificate found")
+	}
+	if cert.PrivateKey == nil {
+		return cert, errors.New("No private key found")
+	}
+
+	chain, err := orderChain(certs, cert.PrivateKey)
+	if err != nil {
+		return
 	}
 
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	cert.Leaf = chain[0]
 	return
+}
+
+// orderChain finds the certificate for key, then follows its issuers
+// through the other certificates.  A root is left out, as clients must
+// already trust it.  Certificates which are not part of the chain are an
+// error, as they are usually a mistake.
+func orderChain(certs []*x509.Certificate, key crypto.PrivateKey) ([]*x509.Certificate, error) {
+	var leaf *x509.Certificate
+	var rest []*x509.Certificate
+
+	for _, c := range certs {
+		if leaf == nil && keyMatches(c, key) {
+			leaf = c
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	if leaf == nil {
+		return nil, errors.New("The private key does not match any certificate")
+	}
+
+	chain := []*x509.Certificate{leaf}
+	for last := leaf; !selfSigned(last); {
+		var next *x509.Certificate
+		for i, c := range rest {
+			if last.CheckSignatureFrom(c) == nil {
+				next = c
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+		if next == nil || selfSigned(next) {
+			break
+		}
+		chain = append(chain, next)
+		last = next
+	}
 
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("Certificate %q is not part of the chain for %q",
+			rest[0].Subject.CommonName, leaf.Subject.CommonName)
+	}
+	return chain, nil
 }
 
-func readDBcert() (cert []byte, err error) {
+// keyMatches reports whether key is the private key for c.
+func keyMatches(c *x509.Certificate, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+
+	a, err := x509.MarshalPKIXPublicKey(c.PublicKey)
+	if err != nil {
+		return false
+	}
+	b, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
+
+// selfSigned reports whether c is its own issuer.
+func selfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawIssuer, c.RawSubject) &&
+		c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
+
+// Creates a TLS socket, serving the certificate in certs
+func Socket(address string, c TLSConfig, certs *certStore) (socket net.Listener, err error) {
+	cfg, err := c.config()
+	if err != nil {
+		return
+	}
+	cfg.GetCertificate = certs.GetCertificate
+
+	return tls.Listen("tcp", address, cfg)
+}
+
+// GetNutcrackerCert reads a cert and key from the vault.  The secret holds
+// PEM, or base64 encoded PEM, with the certificate chain and private key.
+func GetNutcrackerCert(c TLSConfig) (cert tls.Certificate, err error) {
+	data, err := readDBcert(c)
+	if err != nil {
+		return
+	}
+	defer secrets.Zero(data)
+
+	if !isPEM(data) {
+		var decoded []byte
+		decoded, err = decodeCert(data)
+		if err != nil {
+			err = fmt.Errorf("TLS cert %s is neither PEM nor base64 encoded PEM: %s", c.CertName, err)
+			return
+		}
+		defer secrets.Zero(decoded)
+		data = decoded
+	}
+
+	cert, err = parseCertPEM(data)
+	if err != nil {
+		err = fmt.Errorf("TLS cert %s: %s", c.CertName, err)
+	}
+	return
+}
+
+// legacyCertHeader is the length of the header which older releases
+// expected in front of a base64 encoded cert in the vault.  Certs stored
+// that way are still read, but new ones are stored as plain PEM.
+const legacyCertHeader = 8
+
+func isPEM(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN"))
+}
+
+// decodeCert decodes a base64 encoded PEM cert, with or without the header
+// of the old format.
+func decodeCert(data []byte) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err == nil && isPEM(decoded) {
+		return decoded, nil
+	}
+	secrets.Zero(decoded)
+
+	if len(data) > legacyCertHeader {
+		legacy := data[legacyCertHeader:]
+		old := make([]byte, base64.StdEncoding.DecodedLen(len(legacy)))
+		// Like older releases, use as much as decodes.
+		n, _ := base64.StdEncoding.Decode(old, legacy)
+		if isPEM(old[:n]) {
+			log.Warn("TLS cert is stored in an old format, store it again as PEM to update it")
+			return old[:n], nil
+		}
+		secrets.Zero(old)
+	}
+
+	if err == nil {
+		err = errors.New("No PEM data found")
+	}
+	return nil, err
+}
+
+func readDBcert(c TLSConfig) (cert []byte, err error) {
 	root := new(secrets.Secret)
 	shared := new(secrets.Secret)
-	root.Name = certName
-	shared.Name = certName
+	root.Name = c.CertName
+	shared.Name = c.CertName
 
 	key := new(secrets.Key)
-	key.Name = certID
+	key.Name = c.CertID
 
-	priv, err := base64.StdEncoding.DecodeString(certKey)
+	priv, err := base64.StdEncoding.DecodeString(c.CertKey)
 	if err != nil {
 		return
 	}
@@ -184,6 +393,33 @@ func readDBcert() (cert []byte, err error) {
 	return root.Decrypt(shared, priv)
 }
 
+// zeroPrivateKey overwrites the secret parts of an RSA or ECDSA key.
+func zeroPrivateKey(key crypto.PrivateKey) {
+	var ints []*big.Int
+
+	switch k := key.(type) {
+
+	case *ecdsa.PrivateKey:
+		ints = append(ints, k.D)
+
+	case *rsa.PrivateKey:
+		ints = append(ints, k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv)
+		ints = append(ints, k.Primes...)
+
+	}
+
+	for _, n := range ints {
+		if n == nil {
+			continue
+		}
+		bits := n.Bits()
+		for i := range bits {
+			bits[i] = 0
+		}
+		n.SetInt64(0)
+	}
+}
+
 // Taken from crypto/x509
 func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
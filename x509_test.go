@@ -1,8 +1,19 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestX509(t *testing.T) {
@@ -12,3 +23,136 @@ func TestX509(t *testing.T) {
 
 	assert.NotEmpty(t, tlsCert.Certificate, "Certificate data not empty")
 }
+
+// issue creates a certificate for a new key, signed by parent, or self
+// signed if parent is nil.
+func issue(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil || cn != "leaf",
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func certPEM(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return data
+}
+
+func keyPEM(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func TestParseCertPEM(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	root, rootKey := issue(t, "root", nil, nil, later)
+	inter, interKey := issue(t, "intermediate", root, rootKey, later)
+	leaf, leafKey := issue(t, "leaf", inter, interKey, later)
+	other, _ := issue(t, "other", nil, nil, later)
+
+	// Out of order, with the root, the chain is put in order without it
+	data := append(certPEM(root, leaf, inter), keyPEM(t, leafKey)...)
+	cert, err := parseCertPEM(data)
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, [][]byte{leaf.Raw, inter.Raw}, cert.Certificate)
+	assert.Equal(t, leaf, cert.Leaf)
+
+	_, err = verifyCert(&cert, defaultTLSConfig(), time.Now())
+	assert.Nil(t, err, "Should not return error")
+
+	for name, data := range map[string][]byte{
+		"No certificate found":                                    keyPEM(t, leafKey),
+		"No private key found":                                    certPEM(leaf),
+		"The private key does not match any certificate":          append(certPEM(leaf), keyPEM(t, interKey)...),
+		`Certificate "other" is not part of the chain for "leaf"`: append(certPEM(leaf, inter, other), keyPEM(t, leafKey)...),
+		"More than one private key found":                         append(certPEM(leaf), append(keyPEM(t, leafKey), keyPEM(t, leafKey)...)...),
+	} {
+		_, err = parseCertPEM(data)
+		assert.EqualError(t, err, name)
+	}
+}
+
+func TestVerifyCert(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	root, rootKey := issue(t, "root", nil, nil, later)
+	inter, interKey := issue(t, "intermediate", root, rootKey, time.Now().Add(-time.Minute))
+	leaf, leafKey := issue(t, "leaf", inter, interKey, later)
+	_, otherKey := issue(t, "other", nil, nil, later)
+
+	cert, err := parseCertPEM(append(certPEM(leaf, inter), keyPEM(t, leafKey)...))
+	assert.Nil(t, err, "Should not return error")
+
+	_, err = verifyCert(&cert, defaultTLSConfig(), time.Now())
+	assert.Contains(t, err.Error(), `TLS cert "intermediate" expired`)
+
+	// Certificates assembled elsewhere are checked too
+	cert.Certificate = [][]byte{leaf.Raw, root.Raw}
+	_, err = verifyCert(&cert, defaultTLSConfig(), time.Now().Add(-time.Minute))
+	assert.Contains(t, err.Error(), `TLS cert "leaf" is not signed by "root"`)
+
+	cert.Certificate = [][]byte{leaf.Raw}
+	cert.PrivateKey = otherKey
+	_, err = verifyCert(&cert, defaultTLSConfig(), time.Now())
+	assert.EqualError(t, err, "TLS private key does not match the certificate")
+}
+
+func TestLoadCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nutcracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leaf, leafKey := issue(t, "leaf", nil, nil, time.Now().Add(time.Hour))
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, certPEM(leaf), 0600)
+	ioutil.WriteFile(keyFile, keyPEM(t, leafKey), 0600)
+
+	cert, err := LoadCert(certFile, keyFile)
+	assert.Nil(t, err, "Should not return error")
+	assert.Equal(t, leaf, cert.Leaf)
+
+	_, err = LoadCert(certFile, "")
+	assert.EqualError(t, err, "TLS cert "+certFile+": No private key found")
+
+	// The key can be in the cert file
+	ioutil.WriteFile(certFile, append(certPEM(leaf), keyPEM(t, leafKey)...), 0600)
+	_, err = LoadCert(certFile, "")
+	assert.Nil(t, err, "Should not return error")
+
+	s := &certStore{config: defaultTLSConfig()}
+	src := defaultTLSConfig()
+	src.CertFile = certFile
+	assert.Nil(t, s.load(src))
+	assert.Equal(t, "leaf", servedCN(s))
+}